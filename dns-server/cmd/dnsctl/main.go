@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// dnsctl - тестовые запросы к DNS и управление dns-server через его HTTP API
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  dnsctl query [flags] name [type]   запрос к серверу (по умолчанию A)
+  dnsctl stats                       статистика кеша
+  dnsctl top [n]                     частые имена и клиенты, коды ответов
+  dnsctl flush [name [type]]         сбросить кеш целиком или для имени
+  dnsctl reload                      перечитать конфиг сервера
+  dnsctl services [name]             зарегистрированные сервисы
+  dnsctl register name addr port [ttl]
+                                     зарегистрировать экземпляр сервиса (ttl в секундах)
+  dnsctl deregister name id          снять экземпляр с регистрации
+
+Флаги query:
+  -server addr     адрес сервера (по умолчанию 127.0.0.1:53, для tls - порт 853)
+  -net proto       udp, tcp или tls (DoT)
+  -tls-name name   имя для проверки сертификата DoT
+  -insecure        не проверять сертификат DoT
+  -dnssec          запросить подписи (бит DO)
+  -cd              отключить проверку DNSSEC на сервере (бит CD)
+  -timeout d       таймаут (по умолчанию 5s)
+
+Для stats, flush, reload и сервисов:
+  -admin url       адрес API (DNSCTL_ADMIN, по умолчанию http://127.0.0.1:8053)
+  -token token     токен API (DNSCTL_TOKEN)
+`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+
+	var err error
+	switch cmd {
+	case "query", "q":
+		err = query(args)
+	case "stats":
+		err = admin(args, 0, func(a *adminClient, _ []string) error { return a.stats() })
+	case "top":
+		err = admin(args, 1, func(a *adminClient, rest []string) error { return a.top(rest) })
+	case "flush":
+		err = admin(args, 2, func(a *adminClient, rest []string) error { return a.flush(rest) })
+	case "reload":
+		err = admin(args, 0, func(a *adminClient, _ []string) error { return a.reload() })
+	case "services":
+		err = admin(args, 1, func(a *adminClient, rest []string) error { return a.services(rest) })
+	case "register":
+		err = admin(args, 4, func(a *adminClient, rest []string) error { return a.register(rest) })
+	case "deregister":
+		err = admin(args, 2, func(a *adminClient, rest []string) error { return a.deregister(rest) })
+	case "help", "-h", "-help", "--help":
+		usage()
+		return
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dnsctl:", err)
+		os.Exit(1)
+	}
+}
+
+func query(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	fs.Usage = usage
+	server := fs.String("server", "", "")
+	proto := fs.String("net", "udp", "")
+	tlsName := fs.String("tls-name", "", "")
+	insecure := fs.Bool("insecure", false, "")
+	dnssec := fs.Bool("dnssec", false, "")
+	cd := fs.Bool("cd", false, "")
+	timeout := fs.Duration("timeout", 5*time.Second, "")
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := miekg_dns.Fqdn(fs.Arg(0))
+	qtype := miekg_dns.TypeA
+	if fs.NArg() == 2 {
+		t, ok := miekg_dns.StringToType[strings.ToUpper(fs.Arg(1))]
+		if !ok {
+			return fmt.Errorf("unknown type %s", fs.Arg(1))
+		}
+		qtype = t
+	}
+
+	c := &miekg_dns.Client{Timeout: *timeout}
+	port := "53"
+	switch *proto {
+	case "udp", "tcp":
+		c.Net = *proto
+	case "tls":
+		c.Net = "tcp-tls"
+		port = "853"
+	default:
+		return fmt.Errorf("unknown protocol %s", *proto)
+	}
+
+	addr := *server
+	if addr == "" {
+		addr = "127.0.0.1"
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	if c.Net == "tcp-tls" {
+		host, _, _ := net.SplitHostPort(addr)
+		if *tlsName != "" {
+			host = *tlsName
+		}
+		c.TLSConfig = &tls.Config{ServerName: host, InsecureSkipVerify: *insecure}
+	}
+
+	m := new(miekg_dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(1232, *dnssec)
+	m.CheckingDisabled = *cd
+
+	resp, rtt, err := c.Exchange(m, addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println(resp.String())
+	fmt.Printf(";; Query time: %v\n;; SERVER: %s (%s)\n;; MSG SIZE: %d\n", rtt.Round(time.Microsecond), addr, *proto, resp.Len())
+	return nil
+}
+
+type adminClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// admin разбирает общие флаги API и вызывает команду с оставшимися аргументами
+func admin(args []string, maxArgs int, run func(*adminClient, []string) error) error {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	fs.Usage = usage
+	base := fs.String("admin", envOr("DNSCTL_ADMIN", "http://127.0.0.1:8053"), "")
+	token := fs.String("token", os.Getenv("DNSCTL_TOKEN"), "")
+	_ = fs.Parse(args)
+	if fs.NArg() > maxArgs {
+		usage()
+		os.Exit(2)
+	}
+	a := &adminClient{
+		base:  strings.TrimSuffix(*base, "/"),
+		token: *token,
+		http:  &http.Client{Timeout: 10 * time.Second},
+	}
+	return run(a, fs.Args())
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// do отправляет запрос к API; in, если не nil, уходит телом в JSON
+func (a *adminClient) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, a.base+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (a *adminClient) stats() error {
+	var st map[string]json.RawMessage
+	if err := a.do(http.MethodGet, "/cache/stats", nil, &st); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(st))
+	for k := range st {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%-14s %s\n", k+":", st[k])
+	}
+	return nil
+}
+
+func (a *adminClient) top(args []string) error {
+	path := "/stats/queries"
+	if len(args) > 0 {
+		path += "?" + url.Values{"top": {args[0]}}.Encode()
+	}
+	type entry struct {
+		Key   string `json:"key"`
+		Count uint64 `json:"count"`
+	}
+	var rep struct {
+		Window      string            `json:"window"`
+		Queries     uint64            `json:"queries"`
+		Rcodes      map[string]uint64 `json:"rcodes"`
+		TopNames    []entry           `json:"top_names"`
+		TopClients  []entry           `json:"top_clients"`
+		TopNXDomain []entry           `json:"top_nxdomain_clients"`
+		TopBlocked  []entry           `json:"top_blocked"`
+	}
+	if err := a.do(http.MethodGet, path, nil, &rep); err != nil {
+		return err
+	}
+
+	fmt.Printf("queries in last %s: %d\n", rep.Window, rep.Queries)
+	rcodes := make([]string, 0, len(rep.Rcodes))
+	for rc := range rep.Rcodes {
+		rcodes = append(rcodes, rc)
+	}
+	sort.Slice(rcodes, func(i, j int) bool { return rep.Rcodes[rcodes[i]] > rep.Rcodes[rcodes[j]] })
+	for _, rc := range rcodes {
+		fmt.Printf("  %-10s %d\n", rc, rep.Rcodes[rc])
+	}
+	for _, section := range []struct {
+		title   string
+		entries []entry
+	}{
+		{"names", rep.TopNames},
+		{"clients", rep.TopClients},
+		{"NXDOMAIN clients", rep.TopNXDomain},
+		{"blocked names", rep.TopBlocked},
+	} {
+		if len(section.entries) == 0 {
+			continue
+		}
+		fmt.Printf("\ntop %s:\n", section.title)
+		for _, e := range section.entries {
+			fmt.Printf("  %8d  %s\n", e.Count, e.Key)
+		}
+	}
+	return nil
+}
+
+func (a *adminClient) flush(args []string) error {
+	q := url.Values{}
+	if len(args) > 0 {
+		q.Set("name", args[0])
+	}
+	if len(args) > 1 {
+		q.Set("type", args[1])
+	}
+	path := "/cache/flush"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var res struct {
+		Removed int `json:"removed"`
+	}
+	if err := a.do(http.MethodPost, path, nil, &res); err != nil {
+		return err
+	}
+	fmt.Printf("removed %d entries\n", res.Removed)
+	return nil
+}
+
+func (a *adminClient) reload() error {
+	var res map[string]string
+	if err := a.do(http.MethodPost, "/reload", nil, &res); err != nil {
+		return err
+	}
+	fmt.Println(res["status"])
+	return nil
+}
+
+type service struct {
+	Name     string     `json:"name"`
+	ID       string     `json:"id,omitempty"`
+	Address  string     `json:"address"`
+	Port     int        `json:"port"`
+	Protocol string     `json:"protocol,omitempty"`
+	TTL      int        `json:"ttl,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"` // только в ответах сервера
+}
+
+func (a *adminClient) services(args []string) error {
+	path := "/services"
+	if len(args) > 0 {
+		path += "?" + url.Values{"name": {args[0]}}.Encode()
+	}
+	var list []service
+	if err := a.do(http.MethodGet, path, nil, &list); err != nil {
+		return err
+	}
+	for _, svc := range list {
+		var left time.Duration
+		if svc.Expires != nil {
+			left = time.Until(*svc.Expires).Round(time.Second)
+		}
+		fmt.Printf("%-20s %-24s %s/%s  expires in %v\n", svc.Name, svc.ID,
+			net.JoinHostPort(svc.Address, strconv.Itoa(svc.Port)), svc.Protocol, left)
+	}
+	return nil
+}
+
+func (a *adminClient) register(args []string) error {
+	if len(args) < 3 {
+		usage()
+		os.Exit(2)
+	}
+	svc := service{Name: args[0], Address: args[1]}
+	var err error
+	if svc.Port, err = strconv.Atoi(args[2]); err != nil {
+		return fmt.Errorf("invalid port %s", args[2])
+	}
+	if len(args) > 3 {
+		if svc.TTL, err = strconv.Atoi(args[3]); err != nil {
+			return fmt.Errorf("invalid ttl %s", args[3])
+		}
+	}
+	var res service
+	if err := a.do(http.MethodPost, "/services", svc, &res); err != nil {
+		return err
+	}
+	fmt.Printf("registered %s/%s for %ds\n", res.Name, res.ID, res.TTL)
+	return nil
+}
+
+func (a *adminClient) deregister(args []string) error {
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var res map[string]int
+	if err := a.do(http.MethodDelete, "/services/"+url.PathEscape(args[0])+"/"+url.PathEscape(args[1]), nil, &res); err != nil {
+		return err
+	}
+	fmt.Printf("deregistered %s/%s\n", args[0], args[1])
+	return nil
+}
@@ -4,30 +4,159 @@ import (
 	"context"
 	"dns-server/internal/config"
 	dns "dns-server/internal/dns"
+	"dns-server/internal/logging"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
 	"os/signal"
+	"runtime"
+	"strings"
 	"syscall"
 )
 
+// Переопределяется при сборке: go build -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+type options struct {
+	configPath string
+	listen     string
+	logLevel   string
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  dns-server [flags]          запустить сервер
+  dns-server check [flags]    проверить конфиг и выйти
+  dns-server version          показать версию
+
+Flags:
+  -config path     файл конфига (DNS_SERVER_CONFIG, по умолчанию config.yaml)
+  -listen addr     адреса для запросов через запятую (DNS_SERVER_LISTEN)
+  -log-level lvl   debug, info, warn, error (DNS_SERVER_LOG_LEVEL)
+
+Также DNS_SERVER_UPSTREAM - апстримы через запятую.
+`)
+}
+
 func main() {
-	configPath := "config.yaml"
+	args := os.Args[1:]
+	cmd := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "run":
+		run(parseFlags(cmd, args))
+	case "check":
+		check(parseFlags(cmd, args))
+	case "version":
+		fmt.Printf("dns-server %s (%s)\n", version, runtime.Version())
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// Приоритет: флаг, потом переменная окружения, потом конфиг
+func parseFlags(cmd string, args []string) options {
+	var o options
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = usage
+	fs.StringVar(&o.configPath, "config", envOr("DNS_SERVER_CONFIG", "config.yaml"), "")
+	fs.StringVar(&o.listen, "listen", os.Getenv("DNS_SERVER_LISTEN"), "")
+	fs.StringVar(&o.logLevel, "log-level", os.Getenv("DNS_SERVER_LOG_LEVEL"), "")
+	_ = fs.Parse(args)
+	if fs.NArg() > 0 {
+		usage()
+		os.Exit(2)
+	}
+	return o
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
 
-	cfg, err := config.Load(configPath)
+func loadConfig(o options) (*config.Config, error) {
+	ov := config.Overrides{Listen: o.listen, LogLevel: o.logLevel}
+	if v := os.Getenv("DNS_SERVER_UPSTREAM"); v != "" {
+		ov.Upstream = strings.Split(v, ",")
+	}
+	cfg, err := config.LoadWithOverrides(o.configPath, ov)
 	if err != nil {
-		log.Printf("failed to load config: %v", err)
+		return nil, err
+	}
+
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logging.SetLevel(level)
+	return cfg, nil
+}
+
+func check(o options) {
+	cfg, err := loadConfig(o)
+	if err == nil {
+		// Сервер заодно читает файлы зон и ключи DNSSEC
+		_, err = dns.NewServer(cfg)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", o.configPath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", o.configPath)
+}
+
+func run(o options) {
+	cfg, err := loadConfig(o)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
 	}
 
 	srv, err := dns.NewServer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to init server: %v", err)
 	}
+	srv.SetReloader(func() (*config.Config, error) { return loadConfig(o) })
 
-	log.Printf("Starting DNS on %s (UDP/TCP). Upstream: %v", cfg.Listen, cfg.Upstream)
+	if cfg.Mode == config.ModeRecursive {
+		log.Printf("Starting dns-server %s on %s. Recursive, root hints: %v", version, listeners(cfg), cfg.Recursive.RootHints)
+	} else {
+		log.Printf("Starting dns-server %s on %s. Upstream: %v", version, listeners(cfg), cfg.Upstream)
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	if err := srv.Run(ctx); err != nil {
-		log.Fatalf("DNS server error: %v", err)
+	for {
+		err := srv.Run(ctx)
+		if errors.Is(err, dns.ErrReload) {
+			srv = srv.Next()
+			log.Printf("Config reloaded")
+			continue
+		}
+		if err != nil {
+			log.Fatalf("DNS server error: %v", err)
+		}
+		return
+	}
+}
+
+func listeners(cfg *config.Config) string {
+	var out []string
+	for _, l := range cfg.Listeners {
+		protos := strings.ToUpper(strings.Join(l.Protocols, "/"))
+		if l.UDPSockets > 1 {
+			protos += fmt.Sprintf(", %d UDP sockets", l.UDPSockets)
+		}
+		out = append(out, l.Address+" ("+protos+")")
 	}
+	return strings.Join(out, ", ")
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	t.Setenv("DNS_SERVER_CONFIG", "/etc/env.yaml")
+	t.Setenv("DNS_SERVER_LISTEN", "127.0.0.1:5353")
+	t.Setenv("DNS_SERVER_LOG_LEVEL", "")
+
+	// Флаг важнее переменной окружения, без обоих - значение по умолчанию
+	o := parseFlags("check", []string{"-listen", "127.0.0.1:5300"})
+	want := options{configPath: "/etc/env.yaml", listen: "127.0.0.1:5300"}
+	if o != want {
+		t.Errorf("options %+v, want %+v", o, want)
+	}
+	t.Setenv("DNS_SERVER_CONFIG", "")
+	if o := parseFlags("run", nil); o.configPath != "config.yaml" || o.listen != "127.0.0.1:5353" {
+		t.Errorf("options %+v, want defaults and listen from env", o)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "listen: 127.0.0.1:53\nupstream: [\"9.9.9.9:53\"]\nlog_level: warn\n"
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DNS_SERVER_UPSTREAM", "")
+	cfg, err := loadConfig(options{configPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Listeners) != 1 || cfg.Listeners[0].Address != "127.0.0.1:53" || cfg.LogLevel != "warn" {
+		t.Errorf("config values lost: %+v %s", cfg.Listeners, cfg.LogLevel)
+	}
+
+	t.Setenv("DNS_SERVER_UPSTREAM", "1.1.1.1:53,tls://9.9.9.9:853#dns.quad9.net")
+	cfg, err = loadConfig(options{configPath: path, listen: "127.0.0.1:5300,[::1]:5300", logLevel: "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, l := range cfg.Listeners {
+		addrs = append(addrs, l.Address)
+	}
+	if !slices.Equal(addrs, []string{"127.0.0.1:5300", "[::1]:5300"}) || cfg.LogLevel != "debug" ||
+		!slices.Equal(cfg.Upstream, []string{"1.1.1.1:53", "tls://9.9.9.9:853#dns.quad9.net"}) {
+		t.Errorf("overrides not applied: listeners %v, upstream %v, log level %s", addrs, cfg.Upstream, cfg.LogLevel)
+	}
+
+	// Подставленные значения проверяются так же, как значения из файла
+	tests := []struct {
+		name     string
+		o        options
+		upstream string
+	}{
+		{name: "bad listen", o: options{configPath: path, listen: "nope"}},
+		{name: "duplicate listen", o: options{configPath: path, listen: "127.0.0.1:5300,127.0.0.1:5300"}},
+		{name: "bad log level", o: options{configPath: path, logLevel: "loud"}},
+		{name: "bad upstream", o: options{configPath: path}, upstream: "udp://1.1.1.1:53"},
+	}
+	for _, tt := range tests {
+		t.Setenv("DNS_SERVER_UPSTREAM", tt.upstream)
+		if _, err := loadConfig(tt.o); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
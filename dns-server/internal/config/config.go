@@ -1,22 +1,363 @@
 package config
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"net"
 	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
+	miekg_dns "github.com/miekg/dns"
 )
 
 
 type Config struct {
 	Listen string	`yaml:"listen"`
+	Listeners []ListenerConfig `yaml:"listeners"` // вместо listen, если адресов несколько
 	TTL		uint32	`yaml:"ttl"`
-	Upstream []string	`yaml:"upstream"`
-	Records map[string]string `yaml:"records"`
+	Upstream []string	`yaml:"upstream"` // host:port, tcp://host:port или tls://host:port#имя
+	UpstreamPool UpstreamPoolConfig `yaml:"upstream_pool"`
+	Mode string `yaml:"mode"`
+	QueryTimeout time.Duration `yaml:"query_timeout"` // на все попытки одного запроса
+	Recursive RecursiveConfig `yaml:"recursive"`
+	Records map[string]RecordSet `yaml:"records"`
+
+	LogLevel string `yaml:"log_level"`
+
+	TSIGKeys map[string]TSIGKey `yaml:"tsig_keys"`
+	Zones    []ZoneConfig       `yaml:"zones"`
+
+	SecondaryZones []SecondaryZoneConfig `yaml:"secondary_zones"`
+
+	DNSSEC DNSSECConfig `yaml:"dnssec"`
+
+	// ECS для запросов, не попавших ни в одну forward-зону
+	ECS          ECSConfig           `yaml:"ecs"`
+	ForwardZones []ForwardZoneConfig `yaml:"forward_zones"`
+
+	ServeStale ServeStaleConfig `yaml:"serve_stale"`
+	CacheFile  string           `yaml:"cache_file"`
+	Prefetch   PrefetchConfig   `yaml:"prefetch"`
+
+	Admin AdminConfig `yaml:"admin"`
+
+	Services ServicesConfig `yaml:"services"`
+
+	QueryStats QueryStatsConfig `yaml:"query_stats"`
+
+	DNS64 DNS64Config `yaml:"dns64"`
+
+	Hardening HardeningConfig `yaml:"hardening"`
+
+	Rebinding RebindingConfig `yaml:"rebinding"`
+
+	Rewrite []RewriteRule `yaml:"rewrite"`
+
+	// Порядок обработки запроса; пусто - DefaultPlugins
+	Plugins       []string                  `yaml:"plugins"`
+	PluginOptions map[string]map[string]any `yaml:"plugin_options"` // для своих плагинов
+
+	ACL       ACLConfig       `yaml:"acl"`
+	Blocklist BlocklistConfig `yaml:"blocklist"`
+}
+
+var DefaultPlugins = []string{"acl", "blocklist", "rewrite", "dns64", "services", "local", "cache", "forward"}
+
+// Доступ по адресу клиента: deny важнее allow, пустой allow - все
+type ACLConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// Блокировка доменов (вместе с поддоменами)
+type BlocklistConfig struct {
+	Domains []string `yaml:"domains"`
+	Files   []string `yaml:"files"`  // домен на строку или формат hosts, # - комментарий
+	Action  string   `yaml:"action"` // nxdomain (по умолчанию), refuse или zero (0.0.0.0 и ::)
+}
+
+const (
+	BlockNXDomain = "nxdomain"
+	BlockRefuse   = "refuse"
+	BlockZero     = "zero"
+)
+
+// Подмена имени запроса до разрешения; в ответе имя возвращается обратно.
+// exact - имя целиком, suffix - домен и всё ниже, regex - регулярка по FQDN
+// (в to можно ссылаться на группы: ${1})
+type RewriteRule struct {
+	Type string `yaml:"type"`
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+const (
+	RewriteExact  = "exact"
+	RewriteSuffix = "suffix"
+	RewriteRegex  = "regex"
+)
+
+// Защита от DNS rebinding: публичные имена не должны указывать на внутренние адреса
+type RebindingConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Action  string   `yaml:"action"` // strip (по умолчанию) - убрать адреса, refuse - отказать
+	Allow   []string `yaml:"allow"`  // домены, которым можно отвечать внутренними адресами
+}
+
+const (
+	RebindingStrip  = "strip"
+	RebindingRefuse = "refuse"
+)
+
+// Адрес для запросов клиентов
+type ListenerConfig struct {
+	Address    string   `yaml:"address"`
+	Protocols  []string `yaml:"protocols"`   // udp, tcp; по умолчанию оба
+	UDPSockets int      `yaml:"udp_sockets"` // сокетов с SO_REUSEPORT, ядро делит между ними пакеты
+}
+
+const (
+	ListenUDP = "udp"
+	ListenTCP = "tcp"
+)
+
+// NewListener - адрес со всеми протоколами и одним сокетом UDP
+func NewListener(addr string) ListenerConfig {
+	return ListenerConfig{Address: addr, Protocols: []string{ListenUDP, ListenTCP}, UDPSockets: 1}
+}
+
+// Соединения с апстримами по TCP и TLS: держатся открытыми и
+// используются несколькими запросами сразу (RFC 7766)
+type UpstreamPoolConfig struct {
+	Size        int           `yaml:"size"`         // соединений на апстрим
+	IdleTimeout time.Duration `yaml:"idle_timeout"` // закрыть после простоя
+}
+
+// Схемы адресов апстримов; без схемы - UDP с повтором по TCP
+const (
+	UpstreamTCP = "tcp"
+	UpstreamTLS = "tls"
+)
+
+const (
+	ModeForward   = "forward"
+	ModeRecursive = "recursive"
+)
+
+// Рекурсивный режим: разрешение имён от корневых серверов без апстримов
+type RecursiveConfig struct {
+	RootHints                []string `yaml:"root_hints"` // по умолчанию - корневые серверы IANA
+	DisableQnameMinimisation bool     `yaml:"disable_qname_minimisation"`
+}
+
+// Адреса корневых серверов a-m.root-servers.net
+var DefaultRootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13", "192.203.230.10",
+	"192.5.5.241", "192.112.36.4", "198.97.190.53", "192.36.148.17", "192.58.128.30",
+	"193.0.14.129", "199.7.83.42", "202.12.27.33",
+}
+
+// Защита кеша от отравления ответами апстримов
+type HardeningConfig struct {
+	// Не менять регистр имени в запросах (0x20) - для апстримов, которые его не сохраняют
+	Disable0x20 bool `yaml:"disable_0x20"`
+}
+
+// Синтез AAAA из A для IPv6-only клиентов за NAT64 (RFC 6147)
+type DNS64Config struct {
+	Enabled  bool     `yaml:"enabled"`
+	Prefix   string   `yaml:"prefix"`
+	Clients  []string `yaml:"clients"`   // пусто - все клиенты
+	Exclude  []string `yaml:"exclude"`   // AAAA из этих сетей считаются отсутствующими
+	ExcludeA []string `yaml:"exclude_a"` // A из этих сетей не синтезируются
+}
+
+// Регистрация сервисов через API: экземпляры публикуются как A/AAAA и SRV
+// в domain и пропадают, если перестают присылать heartbeat
+type ServicesConfig struct {
+	Domain     string        `yaml:"domain"`      // пусто - регистрация выключена
+	DefaultTTL time.Duration `yaml:"default_ttl"` // срок регистрации без heartbeat
+	RecordTTL  uint32        `yaml:"record_ttl"`  // TTL записей в ответах
+}
+
+// Статистика запросов за скользящее окно: частые имена, клиенты, коды ответа
+type QueryStatsConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Window  time.Duration `yaml:"window"`   // по умолчанию 10m
+	MaxKeys int           `yaml:"max_keys"` // имён и клиентов на долю окна, остальные - в (other)
+}
+
+// HTTP API для dnsctl. Пустой listen - API выключен
+type AdminConfig struct {
+	Listen string `yaml:"listen"`
+	Token  string `yaml:"token"`
+}
+
+// Фоновое обновление популярных записей кеша до их истечения
+type PrefetchConfig struct {
+	MinHits          uint32 `yaml:"min_hits"` // 0 - выключено
+	ThresholdPercent uint32 `yaml:"threshold_percent"`
+}
+
+// Ответы из просроченного кеша при недоступных апстримах (RFC 8767)
+type ServeStaleConfig struct {
+	MaxStale  time.Duration `yaml:"max_stale"` // 0 - выключено
+	AnswerTTL uint32        `yaml:"answer_ttl"`
+	// Сколько клиент ждёт апстрим, прежде чем получить просроченный ответ
+	ClientTimeout time.Duration `yaml:"client_timeout"`
+}
+
+// Зона, запросы в которую уходят на свои апстримы
+type ForwardZoneConfig struct {
+	Name     string    `yaml:"name"`
+	Upstream []string  `yaml:"upstream"`
+	ECS      ECSConfig `yaml:"ecs"`
+}
+
+// EDNS Client Subnet (RFC 7871). Выключен - ECS клиента вырезается
+type ECSConfig struct {
+	Enabled    bool  `yaml:"enabled"`
+	IPv4Prefix uint8 `yaml:"ipv4_prefix"`
+	IPv6Prefix uint8 `yaml:"ipv6_prefix"`
+}
+
+// Адреса для имени из records. В конфиге можно задать строкой, списком или
+// объектом с policy: round_robin (по умолчанию), weighted или fixed
+type RecordSet struct {
+	Policy      string             `yaml:"policy"`
+	Addresses   []RecordAddress    `yaml:"addresses"`
+	HealthCheck *HealthCheckConfig `yaml:"health_check"`
+}
+
+// Проверка доступности адресов записи: tcp (connect) или http (GET, ответ 2xx/3xx)
+type HealthCheckConfig struct {
+	Type     string        `yaml:"type"`
+	Port     uint16        `yaml:"port"`
+	Path     string        `yaml:"path"`
+	Host     string        `yaml:"host"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Rise     int           `yaml:"rise"`
+	Fall     int           `yaml:"fall"`
+}
+
+type RecordAddress struct {
+	IP     string `yaml:"ip"`
+	Weight uint32 `yaml:"weight"`
+}
+
+const (
+	PolicyRoundRobin = "round_robin"
+	PolicyWeighted   = "weighted"
+	PolicyFixed      = "fixed"
+)
+
+func (rs *RecordSet) UnmarshalYAML(unmarshal func(any) error) error {
+	var ip string
+	if err := unmarshal(&ip); err == nil {
+		rs.Addresses = []RecordAddress{{IP: ip}}
+		return nil
+	}
+	var list []RecordAddress
+	if err := unmarshal(&list); err == nil {
+		rs.Addresses = list
+		return nil
+	}
+	type plain RecordSet
+	return unmarshal((*plain)(rs))
+}
+
+func (ra *RecordAddress) UnmarshalYAML(unmarshal func(any) error) error {
+	var ip string
+	if err := unmarshal(&ip); err == nil {
+		ra.IP = ip
+		return nil
+	}
+	type plain RecordAddress
+	return unmarshal((*plain)(ra))
+}
+
+type DNSSECConfig struct {
+	Validate     bool     `yaml:"validate"`
+	TrustAnchors []string `yaml:"trust_anchors"`
+}
+
+// Якоря корневой зоны (KSK-2017 и KSK-2024), если свои не заданы
+var DefaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+type TSIGKey struct {
+	Algorithm string `yaml:"algorithm"`
+	Secret    string `yaml:"secret"`
+}
+
+// Локальная зона, которую сервер обслуживает авторитетно
+type ZoneConfig struct {
+	Name        string   `yaml:"name"`
+	File        string   `yaml:"file"`
+	NS          []string `yaml:"ns"`
+	Records     []string `yaml:"records"`
+	AllowUpdate []string `yaml:"allow_update"`
+
+	// Исходящие трансферы: ключи и (опционально) подсети вторичных серверов
+	AllowTransfer []string `yaml:"allow_transfer"`
+	TransferFrom  []string `yaml:"transfer_from"`
+	Notify        []string `yaml:"notify"`
+
+	DNSSEC *ZoneSigningConfig `yaml:"dnssec"`
+
+	// CNAME на вершине зоны отдаётся адресами его цели
+	FlattenCNAME bool `yaml:"flatten_cname"`
+}
+
+// Онлайн-подпись зоны. Ключи - пары файлов K<zone>+<alg>+<tag>.key/.private
+type ZoneSigningConfig struct {
+	Keys              []SigningKeyConfig `yaml:"keys"`
+	NSEC3             bool               `yaml:"nsec3"`
+	NSEC3Iterations   uint16             `yaml:"nsec3_iterations"`
+	NSEC3Salt         string             `yaml:"nsec3_salt"`
+	SignatureValidity time.Duration      `yaml:"signature_validity"`
+}
+
+// Временные метки ключа для ротации, пустые - без ограничения
+type SigningKeyConfig struct {
+	File     string    `yaml:"file"`
+	Publish  time.Time `yaml:"publish"`
+	Activate time.Time `yaml:"activate"`
+	Inactive time.Time `yaml:"inactive"`
+	Delete   time.Time `yaml:"delete"`
+}
+
+// Вторичная зона, которая забирается с первичного сервера по AXFR/IXFR
+type SecondaryZoneConfig struct {
+	Name      string   `yaml:"name"`
+	Primaries []string `yaml:"primaries"`
+	TSIGKey   string   `yaml:"tsig_key"`
+	File      string   `yaml:"file"`
+
+	DNSSEC *ZoneSigningConfig `yaml:"dnssec"`
+}
+
+// Overrides - значения флагов и переменных окружения. Подставляются вместо
+// значений из файла до проверки конфига, так что проверяются так же.
+type Overrides struct {
+	Listen   string // адреса через запятую, заменяют listen и listeners
+	Upstream []string
+	LogLevel string
 }
 
 func Load(path string) (*Config, error) {
+	return LoadWithOverrides(path, Overrides{})
+}
+
+func LoadWithOverrides(path string, o Overrides) (*Config, error) {
 	data, err := os.ReadFile(path)
 
 	if err != nil {
@@ -27,18 +368,500 @@ func Load(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
-	if cfg.Listen == "" {
-		cfg.Listen = ":53"
+	if o.Listen != "" {
+		cfg.Listen, cfg.Listeners = "", nil
+		for _, addr := range strings.Split(o.Listen, ",") {
+			cfg.Listeners = append(cfg.Listeners, NewListener(addr))
+		}
+	}
+	if len(o.Upstream) > 0 {
+		cfg.Upstream = o.Upstream
+	}
+	if o.LogLevel != "" {
+		cfg.LogLevel = o.LogLevel
+	}
+	if len(cfg.Listeners) == 0 {
+		if cfg.Listen == "" {
+			cfg.Listen = ":53"
+		}
+		cfg.Listeners = []ListenerConfig{NewListener(cfg.Listen)}
+	} else if cfg.Listen != "" {
+		return nil, errors.New("listen and listeners must not be used together")
+	}
+	listeners := make(map[string]bool)
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		if err := checkListener(l); err != nil {
+			return nil, err
+		}
+		if listeners[l.Address] {
+			return nil, errors.New("duplicate listener: " + l.Address)
+		}
+		listeners[l.Address] = true
 	}
 	if cfg.TTL == 0 {
 		cfg.TTL = 60
 	}
+	if cfg.QueryTimeout <= 0 {
+		cfg.QueryTimeout = 5 * time.Second
+	}
+	for _, addr := range cfg.Upstream {
+		if err := checkUpstream(addr); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.UpstreamPool.Size <= 0 {
+		cfg.UpstreamPool.Size = 2
+	}
+	if cfg.UpstreamPool.IdleTimeout <= 0 {
+		cfg.UpstreamPool.IdleTimeout = 10 * time.Second
+	}
+
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeForward
+	case ModeForward:
+	case ModeRecursive:
+		if len(cfg.Recursive.RootHints) == 0 {
+			cfg.Recursive.RootHints = append([]string(nil), DefaultRootHints...)
+		}
+		for i, hint := range cfg.Recursive.RootHints {
+			if net.ParseIP(hint) != nil {
+				hint = net.JoinHostPort(hint, "53")
+			}
+			if _, _, err := net.SplitHostPort(hint); err != nil {
+				return nil, errors.New("invalid root hint: " + cfg.Recursive.RootHints[i])
+			}
+			cfg.Recursive.RootHints[i] = hint
+		}
+	default:
+		return nil, errors.New("mode must be forward or recursive: " + cfg.Mode)
+	}
+
+	records := make(map[string]RecordSet, len(cfg.Records))
+	for name, rs := range cfg.Records {
+		if len(rs.Addresses) == 0 {
+			return nil, errors.New("no addresses for " + name)
+		}
+		for i, a := range rs.Addresses {
+			if net.ParseIP(a.IP) == nil {
+				return nil, errors.New("invalid IP for " + name + ": " + a.IP)
+			}
+			if a.Weight == 0 {
+				rs.Addresses[i].Weight = 1
+			}
+		}
+		switch rs.Policy {
+		case "":
+			rs.Policy = PolicyRoundRobin
+		case PolicyRoundRobin, PolicyWeighted, PolicyFixed:
+		default:
+			return nil, errors.New("unknown policy for " + name + ": " + rs.Policy)
+		}
+		if err := checkHealthCheck(rs.HealthCheck); err != nil {
+			return nil, errors.New(err.Error() + " for " + name)
+		}
+		records[miekg_dns.CanonicalName(name)] = rs
+	}
+	cfg.Records = records
+
+	keys := make(map[string]TSIGKey, len(cfg.TSIGKeys))
+	for name, key := range cfg.TSIGKeys {
+		if key.Algorithm == "" {
+			key.Algorithm = miekg_dns.HmacSHA256
+		}
+		key.Algorithm = miekg_dns.Fqdn(strings.ToLower(key.Algorithm))
+		switch key.Algorithm {
+		case miekg_dns.HmacSHA1, miekg_dns.HmacSHA224, miekg_dns.HmacSHA256, miekg_dns.HmacSHA384, miekg_dns.HmacSHA512:
+		default:
+			return nil, errors.New("unsupported TSIG algorithm for " + name + ": " + key.Algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil || key.Secret == "" {
+			return nil, errors.New("invalid TSIG secret for " + name)
+		}
+		keys[miekg_dns.CanonicalName(name)] = key
+	}
+	cfg.TSIGKeys = keys
+
+	seen := make(map[string]bool)
+	for i := range cfg.Zones {
+		z := &cfg.Zones[i]
+		if _, ok := miekg_dns.IsDomainName(z.Name); !ok || z.Name == "" {
+			return nil, errors.New("invalid zone name: " + z.Name)
+		}
+		z.Name = miekg_dns.CanonicalName(z.Name)
+		if seen[z.Name] {
+			return nil, errors.New("duplicate zone: " + z.Name)
+		}
+		seen[z.Name] = true
+
+		for j, key := range z.AllowUpdate {
+			key = miekg_dns.CanonicalName(key)
+			if _, ok := cfg.TSIGKeys[key]; !ok {
+				return nil, errors.New("unknown TSIG key " + key + " in zone " + z.Name)
+			}
+			z.AllowUpdate[j] = key
+		}
+		for j, key := range z.AllowTransfer {
+			key = miekg_dns.CanonicalName(key)
+			if _, ok := cfg.TSIGKeys[key]; !ok {
+				return nil, errors.New("unknown TSIG key " + key + " in zone " + z.Name)
+			}
+			z.AllowTransfer[j] = key
+		}
+		if err := checkSigning(z.Name, z.DNSSEC); err != nil {
+			return nil, err
+		}
+		for _, cidr := range z.TransferFrom {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return nil, errors.New("invalid transfer_from in zone " + z.Name + ": " + cidr)
+			}
+		}
+		for j, addr := range z.Notify {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "53")
+			}
+			z.Notify[j] = addr
+		}
+	}
+
+	for i := range cfg.SecondaryZones {
+		z := &cfg.SecondaryZones[i]
+		if _, ok := miekg_dns.IsDomainName(z.Name); !ok || z.Name == "" {
+			return nil, errors.New("invalid zone name: " + z.Name)
+		}
+		z.Name = miekg_dns.CanonicalName(z.Name)
+		if seen[z.Name] {
+			return nil, errors.New("duplicate zone: " + z.Name)
+		}
+		seen[z.Name] = true
+
+		if err := checkSigning(z.Name, z.DNSSEC); err != nil {
+			return nil, err
+		}
+		if len(z.Primaries) == 0 {
+			return nil, errors.New("no primaries for secondary zone " + z.Name)
+		}
+		for j, addr := range z.Primaries {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "53")
+			}
+			z.Primaries[j] = addr
+		}
+		if z.TSIGKey != "" {
+			z.TSIGKey = miekg_dns.CanonicalName(z.TSIGKey)
+			if _, ok := cfg.TSIGKeys[z.TSIGKey]; !ok {
+				return nil, errors.New("unknown TSIG key " + z.TSIGKey + " in zone " + z.Name)
+			}
+		}
+	}
+
+	if cfg.ServeStale.MaxStale < 0 {
+		return nil, errors.New("serve_stale.max_stale must not be negative")
+	}
+	if cfg.ServeStale.AnswerTTL == 0 {
+		cfg.ServeStale.AnswerTTL = 30
+	}
+	if cfg.ServeStale.ClientTimeout < 0 {
+		return nil, errors.New("serve_stale.client_timeout must not be negative")
+	}
+	if cfg.ServeStale.ClientTimeout == 0 {
+		cfg.ServeStale.ClientTimeout = 1800 * time.Millisecond
+	}
 
-	for name, ip := range cfg.Records {
-		if net.ParseIP(ip) == nil {
-			return nil, errors.New("invalid IP for" + name + ": " + ip)
+	if cfg.Prefetch.ThresholdPercent == 0 {
+		cfg.Prefetch.ThresholdPercent = 10
+	}
+	if cfg.Prefetch.ThresholdPercent > 100 {
+		return nil, errors.New("prefetch.threshold_percent must be at most 100")
+	}
+
+	if cfg.Services.Domain != "" {
+		if _, ok := miekg_dns.IsDomainName(cfg.Services.Domain); !ok || cfg.Services.Domain == "." {
+			return nil, errors.New("invalid services.domain: " + cfg.Services.Domain)
+		}
+		cfg.Services.Domain = miekg_dns.CanonicalName(cfg.Services.Domain)
+	}
+	if cfg.Services.DefaultTTL <= 0 {
+		cfg.Services.DefaultTTL = 30 * time.Second
+	}
+	if cfg.Services.RecordTTL == 0 {
+		cfg.Services.RecordTTL = 5
+	}
+
+	if cfg.QueryStats.Window == 0 {
+		cfg.QueryStats.Window = 10 * time.Minute
+	}
+	if cfg.QueryStats.Window < 10*time.Second {
+		return nil, errors.New("query_stats.window must be at least 10s")
+	}
+	if cfg.QueryStats.MaxKeys <= 0 {
+		cfg.QueryStats.MaxKeys = 10000
+	}
+
+	if err := checkDNS64(&cfg.DNS64); err != nil {
+		return nil, err
+	}
+	if err := checkRebinding(&cfg.Rebinding); err != nil {
+		return nil, err
+	}
+	if len(cfg.Plugins) == 0 {
+		cfg.Plugins = slices.Clone(DefaultPlugins)
+	}
+	plugins := make(map[string]bool)
+	for _, name := range cfg.Plugins {
+		if plugins[name] {
+			return nil, errors.New("duplicate plugin: " + name)
+		}
+		plugins[name] = true
+	}
+	for _, list := range [][]string{cfg.ACL.Allow, cfg.ACL.Deny} {
+		for _, cidr := range list {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return nil, errors.New("invalid network in acl: " + cidr)
+			}
+		}
+	}
+	switch cfg.Blocklist.Action {
+	case "":
+		cfg.Blocklist.Action = BlockNXDomain
+	case BlockNXDomain, BlockRefuse, BlockZero:
+	default:
+		return nil, errors.New("blocklist.action must be nxdomain, refuse or zero: " + cfg.Blocklist.Action)
+	}
+	for i := range cfg.Rewrite {
+		if err := checkRewrite(&cfg.Rewrite[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkECS(&cfg.ECS); err != nil {
+		return nil, err
+	}
+	forwards := make(map[string]bool)
+	for i := range cfg.ForwardZones {
+		fz := &cfg.ForwardZones[i]
+		if _, ok := miekg_dns.IsDomainName(fz.Name); !ok || fz.Name == "" {
+			return nil, errors.New("invalid forward zone name: " + fz.Name)
+		}
+		fz.Name = miekg_dns.CanonicalName(fz.Name)
+		if forwards[fz.Name] {
+			return nil, errors.New("duplicate forward zone: " + fz.Name)
+		}
+		forwards[fz.Name] = true
+		if err := checkECS(&fz.ECS); err != nil {
+			return nil, errors.New(err.Error() + " in forward zone " + fz.Name)
+		}
+		for _, addr := range fz.Upstream {
+			if err := checkUpstream(addr); err != nil {
+				return nil, errors.New(err.Error() + " in forward zone " + fz.Name)
+			}
+		}
+	}
+
+	if cfg.DNSSEC.Validate && len(cfg.DNSSEC.TrustAnchors) == 0 {
+		cfg.DNSSEC.TrustAnchors = DefaultTrustAnchors
+	}
+	for _, ta := range cfg.DNSSEC.TrustAnchors {
+		rr, err := miekg_dns.NewRR(ta)
+		if err != nil {
+			return nil, errors.New("invalid trust anchor: " + ta)
+		}
+		switch rr.(type) {
+		case *miekg_dns.DS, *miekg_dns.DNSKEY:
+		default:
+			return nil, errors.New("trust anchor must be DS or DNSKEY: " + ta)
 		}
 	}
 
 	return &cfg, nil
-}
\ No newline at end of file
+}
+
+func checkSigning(zone string, sc *ZoneSigningConfig) error {
+	if sc == nil {
+		return nil
+	}
+	if len(sc.Keys) == 0 {
+		return errors.New("no DNSSEC keys for zone " + zone)
+	}
+	for _, k := range sc.Keys {
+		if k.File == "" {
+			return errors.New("DNSSEC key without file in zone " + zone)
+		}
+	}
+	if sc.NSEC3Salt != "" {
+		if _, err := hex.DecodeString(sc.NSEC3Salt); err != nil {
+			return errors.New("invalid nsec3_salt in zone " + zone)
+		}
+	}
+	if sc.SignatureValidity == 0 {
+		sc.SignatureValidity = 7 * 24 * time.Hour
+	}
+	if sc.SignatureValidity < 2*time.Hour {
+		return errors.New("signature_validity is too short in zone " + zone)
+	}
+	return nil
+}
+
+func checkECS(ecs *ECSConfig) error {
+	// Рекомендации RFC 7871, 11.1
+	if ecs.IPv4Prefix == 0 {
+		ecs.IPv4Prefix = 24
+	}
+	if ecs.IPv6Prefix == 0 {
+		ecs.IPv6Prefix = 56
+	}
+	if ecs.IPv4Prefix > 32 || ecs.IPv6Prefix > 128 {
+		return errors.New("invalid ECS prefix length")
+	}
+	return nil
+}
+
+func checkHealthCheck(hc *HealthCheckConfig) error {
+	if hc == nil {
+		return nil
+	}
+	switch hc.Type {
+	case "tcp":
+	case "http":
+		if hc.Path == "" {
+			hc.Path = "/"
+		}
+		if hc.Port == 0 {
+			hc.Port = 80
+		}
+	default:
+		return errors.New("unknown health_check type " + hc.Type)
+	}
+	if hc.Port == 0 {
+		return errors.New("health_check port is required")
+	}
+	if hc.Interval == 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.Rise <= 0 {
+		hc.Rise = 2
+	}
+	if hc.Fall <= 0 {
+		hc.Fall = 3
+	}
+	return nil
+}
+
+func checkDNS64(c *DNS64Config) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Prefix == "" {
+		c.Prefix = "64:ff9b::/96"
+	}
+	ip, n, err := net.ParseCIDR(c.Prefix)
+	if err != nil || ip.To4() != nil {
+		return errors.New("invalid dns64 prefix: " + c.Prefix)
+	}
+	// Допустимые длины префикса по RFC 6052, 2.2
+	switch ones, _ := n.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return errors.New("dns64 prefix length must be 32, 40, 48, 56, 64 or 96: " + c.Prefix)
+	}
+	if c.Exclude == nil {
+		c.Exclude = []string{"::ffff:0:0/96"}
+	}
+	for _, list := range [][]string{c.Clients, c.Exclude, c.ExcludeA} {
+		for _, cidr := range list {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return errors.New("invalid network in dns64: " + cidr)
+			}
+		}
+	}
+	return nil
+}
+
+func checkListener(l *ListenerConfig) error {
+	host, _, err := net.SplitHostPort(l.Address)
+	if err != nil || host != "" && net.ParseIP(host) == nil {
+		return errors.New("invalid listener address: " + l.Address)
+	}
+	if len(l.Protocols) == 0 {
+		l.Protocols = []string{ListenUDP, ListenTCP}
+	}
+	seen := make(map[string]bool)
+	for _, p := range l.Protocols {
+		if p != ListenUDP && p != ListenTCP || seen[p] {
+			return errors.New("listener protocols must be udp and/or tcp: " + l.Address)
+		}
+		seen[p] = true
+	}
+	if l.UDPSockets == 0 {
+		l.UDPSockets = 1
+	}
+	if l.UDPSockets < 0 {
+		return errors.New("listener udp_sockets must be positive: " + l.Address)
+	}
+	return nil
+}
+
+func checkUpstream(addr string) error {
+	scheme, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		scheme, rest = "", addr
+	}
+	switch scheme {
+	case "", UpstreamTCP, UpstreamTLS:
+	default:
+		return errors.New("upstream scheme must be tcp or tls: " + addr)
+	}
+	if rest == "" || scheme != UpstreamTLS && strings.Contains(rest, "#") {
+		return errors.New("invalid upstream: " + addr)
+	}
+	return nil
+}
+
+func checkRebinding(c *RebindingConfig) error {
+	switch c.Action {
+	case "":
+		c.Action = RebindingStrip
+	case RebindingStrip, RebindingRefuse:
+	default:
+		return errors.New("rebinding.action must be strip or refuse: " + c.Action)
+	}
+	for i, name := range c.Allow {
+		if _, ok := miekg_dns.IsDomainName(name); !ok || name == "" {
+			return errors.New("invalid domain in rebinding.allow: " + name)
+		}
+		c.Allow[i] = miekg_dns.CanonicalName(name)
+	}
+	return nil
+}
+
+func checkRewrite(rw *RewriteRule) error {
+	if rw.From == "" || rw.To == "" {
+		return errors.New("rewrite rule needs from and to")
+	}
+	switch rw.Type {
+	case "", RewriteExact, RewriteSuffix:
+		if rw.Type == "" {
+			rw.Type = RewriteExact
+		}
+		for _, name := range []string{rw.From, rw.To} {
+			if _, ok := miekg_dns.IsDomainName(name); !ok {
+				return errors.New("invalid name in rewrite rule: " + name)
+			}
+		}
+		rw.From, rw.To = miekg_dns.CanonicalName(rw.From), miekg_dns.CanonicalName(rw.To)
+		if rw.Type == RewriteSuffix && rw.From == "." {
+			return errors.New("rewrite suffix must not be the root")
+		}
+	case RewriteRegex:
+		if _, err := regexp.Compile(rw.From); err != nil {
+			return errors.New("invalid rewrite regex " + rw.From + ": " + err.Error())
+		}
+	default:
+		return errors.New("rewrite type must be exact, suffix or regex: " + rw.Type)
+	}
+	return nil
+}
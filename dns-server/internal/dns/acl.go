@@ -0,0 +1,46 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/logging"
+	"net"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Плагин acl: отказ клиентам не из allow или из deny
+
+type acl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newACL(s *Server, _ map[string]any) (Plugin, error) {
+	return &acl{allow: parseNets(s.cfg.ACL.Allow), deny: parseNets(s.cfg.ACL.Deny)}, nil
+}
+
+func (a *acl) permits(ip net.IP) bool {
+	if ip == nil || inNets(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || inNets(a.allow, ip)
+}
+
+func (a *acl) ServeDNS(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler) {
+	if len(a.allow) == 0 && len(a.deny) == 0 {
+		next.ServeDNS(ctx, w, r)
+		return
+	}
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	if a.permits(net.ParseIP(host)) {
+		next.ServeDNS(ctx, w, r)
+		return
+	}
+	logging.Ctx(ctx).Warnf("query %s from %s refused: acl", r.Question[0].Name, host)
+	m := new(miekg_dns.Msg)
+	m.SetRcode(r, miekg_dns.RcodeRefused)
+	m.SetEdns0(ednsUDPSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &miekg_dns.EDNS0_EDE{InfoCode: miekg_dns.ExtendedErrorCodeProhibited})
+	writeMsg(w, r, m)
+}
@@ -0,0 +1,196 @@
+package dns
+
+import (
+	"context"
+	"crypto/subtle"
+	"dns-server/internal/config"
+	"dns-server/internal/logging"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// HTTP API для dnsctl: статистика и сброс кеша, статистика запросов,
+// перезагрузка конфига, регистрация сервисов
+
+// ErrReload - Run завершился, чтобы запустить сервер с новым конфигом (см. Next)
+var ErrReload = errors.New("reload requested")
+
+type stats struct {
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+	staleHits   atomic.Uint64
+	prefetches  atomic.Uint64
+}
+
+// SetReloader задаёт, откуда брать конфиг при перезагрузке через API
+func (s *Server) SetReloader(load func() (*config.Config, error)) {
+	s.reloader = load
+}
+
+// Next возвращает сервер, подготовленный перезагрузкой, и передаёт ему кеш,
+// зарегистрированные сервисы и счётчики.
+// Вызывать после того, как Run вернул ErrReload.
+func (s *Server) Next() *Server {
+	next := s.next
+	s.mu.RLock()
+	cache := s.cache
+	s.mu.RUnlock()
+	next.mu.Lock()
+	next.cache = cache
+	next.mu.Unlock()
+	next.services = s.services
+	// Окно статистики переносится, если его настройки не изменились
+	if next.queryStats != nil && s.queryStats != nil && next.cfg.QueryStats == s.cfg.QueryStats {
+		next.queryStats.mu.Lock()
+		s.queryStats.mu.Lock()
+		next.queryStats.buckets = s.queryStats.buckets
+		s.queryStats.mu.Unlock()
+		next.queryStats.mu.Unlock()
+	}
+
+	next.stats.cacheHits.Store(s.stats.cacheHits.Load())
+	next.stats.cacheMisses.Store(s.stats.cacheMisses.Load())
+	next.stats.staleHits.Store(s.stats.staleHits.Load())
+	next.stats.prefetches.Store(s.stats.prefetches.Load())
+	return next
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /cache/stats", s.handleCacheStats)
+	mux.HandleFunc("POST /cache/flush", s.handleCacheFlush)
+	mux.HandleFunc("GET /stats/queries", s.handleQueryStats)
+	mux.HandleFunc("POST /reload", s.handleReload)
+	mux.HandleFunc("GET /services", s.handleServices)
+	mux.HandleFunc("POST /services", s.handleRegister)
+	mux.HandleFunc("DELETE /services/{name}/{id}", s.handleDeregister)
+
+	token := s.cfg.Admin.Token
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var fresh, stale int
+	s.mu.RLock()
+	for _, e := range s.cache {
+		if now.Before(e.expiry) {
+			fresh++
+		} else {
+			stale++
+		}
+	}
+	s.mu.RUnlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"entries":       fresh + stale,
+		"expired":       stale,
+		"hits":          s.stats.cacheHits.Load(),
+		"misses":        s.stats.cacheMisses.Load(),
+		"stale_answers": s.stats.staleHits.Load(),
+		"prefetches":    s.stats.prefetches.Load(),
+	})
+}
+
+// handleCacheFlush сбрасывает весь кеш или записи для name (и типа type)
+func (s *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	// Ключ кеша: name:TYPE[:do][:ecs=...]
+	what := "all"
+	match := func(string) bool { return true }
+	if name := r.URL.Query().Get("name"); name != "" {
+		if _, ok := miekg_dns.IsDomainName(name); !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid name: " + name})
+			return
+		}
+		what = strings.ToLower(miekg_dns.Fqdn(name)) + ":"
+		if t := r.URL.Query().Get("type"); t != "" {
+			qtype, ok := miekg_dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown type: " + t})
+				return
+			}
+			what += miekg_dns.TypeToString[qtype]
+			match = func(key string) bool { return key == what || strings.HasPrefix(key, what+":") }
+		} else {
+			match = func(key string) bool { return strings.HasPrefix(key, what) }
+		}
+	}
+
+	removed := 0
+	s.mu.Lock()
+	for key := range s.cache {
+		if match(key) {
+			delete(s.cache, key)
+			removed++
+		}
+	}
+	s.mu.Unlock()
+
+	logging.Infof("cache flush (%s): %d entries", strings.TrimSuffix(what, ":"), removed)
+	writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if s.reloader == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "reload is not configured"})
+		return
+	}
+	cfg, err := s.reloader()
+	var next *Server
+	if err == nil {
+		next, err = NewServer(cfg)
+	}
+	if err != nil {
+		logging.Errorf("reload failed: %v", err)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	next.reloader = s.reloader
+
+	// Новый сервер передаётся в Run через канал: одновременные /reload
+	// не перезаписывают друг друга, выигрывает первый
+	select {
+	case s.reloadCh <- next:
+	default:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "reload already in progress"})
+		return
+	}
+	logging.Infof("reloading config")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloading"})
+}
+
+// runAdmin обслуживает API до отмены ctx
+func (s *Server) runAdmin(ctx context.Context) error {
+	srv := &http.Server{Addr: s.cfg.Admin.Listen, Handler: s.adminHandler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
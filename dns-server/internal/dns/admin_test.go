@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// newTestServer собирает сервер из конфига yaml и возвращает путь к файлу конфига
+func newTestServer(t *testing.T, yaml string) (*Server, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, path
+}
+
+func adminRequest(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestReloadHandoff(t *testing.T) {
+	s, path := newTestServer(t, `
+listen: 127.0.0.1:0
+upstream: ["127.0.0.1:1"]
+query_stats:
+  enabled: true
+services:
+  domain: svc.test
+`)
+	s.SetReloader(func() (*config.Config, error) { return config.Load(path) })
+
+	m := new(miekg_dns.Msg)
+	m.SetQuestion("cached.test.", miekg_dns.TypeA)
+	resp := m.Copy()
+	resp.Response = true
+	resp.Answer = []miekg_dns.RR{testRR("cached.test. 300 IN A 192.0.2.1")}
+	s.store("cached.test.:A", m, s.upstreamAddrs, resp)
+	s.services.register(&serviceInstance{Name: "api", ID: "one", ip: net.ParseIP("192.0.2.5"), Port: 80, Expires: time.Now().Add(time.Minute)})
+	s.queryStats.record("192.0.2.100", "cached.test.", miekg_dns.RcodeSuccess)
+	s.stats.cacheHits.Add(3)
+
+	if rec := adminRequest(s, http.MethodPost, "/reload", ""); rec.Code != http.StatusOK {
+		t.Fatalf("first /reload: %d %s", rec.Code, rec.Body)
+	}
+	// Пока Run не забрал новый сервер, второй /reload получает отказ
+	if rec := adminRequest(s, http.MethodPost, "/reload", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("concurrent /reload: %d %s, want 409", rec.Code, rec.Body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); !errors.Is(err, ErrReload) {
+		t.Fatalf("Run = %v, want ErrReload", err)
+	}
+
+	next := s.Next()
+	if next == s {
+		t.Fatal("Next returned the old server")
+	}
+	if _, ok := next.cache["cached.test.:A"]; !ok {
+		t.Error("cache entry lost on reload")
+	}
+	if got := next.services.live("api", time.Now()); len(got) != 1 {
+		t.Errorf("services after reload: %v", got)
+	}
+	if rep := next.queryStats.report(10); rep.Queries != 1 {
+		t.Errorf("query stats after reload: %d queries, want 1", rep.Queries)
+	}
+	if next.stats.cacheHits.Load() != 3 {
+		t.Errorf("cache hits after reload: %d, want 3", next.stats.cacheHits.Load())
+	}
+	if next.reloader == nil {
+		t.Error("reloader not carried over")
+	}
+}
@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"dns-server/internal/config"
+	"dns-server/internal/logging"
+	"net"
+	"os"
+	"strings"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Плагин blocklist: заблокированные домены (с поддоменами) получают NXDOMAIN,
+// REFUSED или нулевой адрес вместо ответа
+
+type blocklist struct {
+	domains map[string]bool
+	action  string
+	ttl     uint32
+	stats   *queryStats
+}
+
+func newBlocklist(s *Server, _ map[string]any) (Plugin, error) {
+	cfg := s.cfg.Blocklist
+	b := &blocklist{domains: make(map[string]bool), action: cfg.Action, ttl: s.cfg.TTL, stats: s.queryStats}
+	for _, d := range cfg.Domains {
+		b.add(d)
+	}
+	for _, path := range cfg.Files {
+		if err := b.load(path); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Files) > 0 {
+		logging.Infof("blocklist: %d domains", len(b.domains))
+	}
+	return b, nil
+}
+
+func (b *blocklist) add(name string) {
+	if _, ok := miekg_dns.IsDomainName(name); ok && name != "" && name != "." {
+		b.domains[miekg_dns.CanonicalName(name)] = true
+	}
+}
+
+// load читает файл со списком: домен на строку или строки hosts ("0.0.0.0 ads.example")
+func (b *blocklist) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			if name == "localhost" || net.ParseIP(name) != nil {
+				continue
+			}
+			b.add(name)
+		}
+	}
+	return sc.Err()
+}
+
+func (b *blocklist) blocked(name string) bool {
+	name = miekg_dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = miekg_dns.NextLabel(name, off) {
+		if b.domains[name[off:]] {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *blocklist) ServeDNS(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler) {
+	q := r.Question[0]
+	if len(b.domains) == 0 || !b.blocked(q.Name) {
+		next.ServeDNS(ctx, w, r)
+		return
+	}
+	logging.Ctx(ctx).Debugf("blocked %s", q.Name)
+	if b.stats != nil {
+		b.stats.recordBlocked(miekg_dns.CanonicalName(q.Name))
+	}
+
+	m := new(miekg_dns.Msg)
+	m.SetReply(r)
+	hdr := miekg_dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: miekg_dns.ClassINET, Ttl: b.ttl}
+	switch {
+	case b.action == config.BlockRefuse:
+		m.Rcode = miekg_dns.RcodeRefused
+	case b.action == config.BlockZero && q.Qtype == miekg_dns.TypeA:
+		m.Answer = []miekg_dns.RR{&miekg_dns.A{Hdr: hdr, A: net.IPv4zero}}
+	case b.action == config.BlockZero && q.Qtype == miekg_dns.TypeAAAA:
+		m.Answer = []miekg_dns.RR{&miekg_dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+	case b.action == config.BlockZero:
+		// Для остальных типов - пустой ответ
+	default:
+		m.Rcode = miekg_dns.RcodeNameError
+	}
+	m.SetEdns0(ednsUDPSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &miekg_dns.EDNS0_EDE{InfoCode: miekg_dns.ExtendedErrorCodeBlocked})
+	writeMsg(w, r, m)
+}
@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"bufio"
+	"dns-server/internal/logging"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Сохранение кеша между перезапусками: при остановке кеш пишется в cache_file,
+// при старте непросроченные записи читаются обратно
+
+type savedCache struct {
+	Saved   time.Time
+	Entries []savedEntry
+}
+
+type savedEntry struct {
+	Key       string
+	Msg       []byte
+	Expiry    time.Time
+	TTL       time.Duration
+	Query     []byte
+	Upstreams []string
+}
+
+func (s *Server) saveCache() error {
+	if s.cfg.CacheFile == "" {
+		return nil
+	}
+
+	s.mu.RLock()
+	entries := make([]savedEntry, 0, len(s.cache))
+	for key, e := range s.cache {
+		msg, err := e.msg.Pack()
+		if err != nil {
+			continue
+		}
+		se := savedEntry{Key: key, Msg: msg, Expiry: e.expiry, TTL: e.ttl, Upstreams: e.upstreams}
+		if e.query != nil {
+			se.Query, _ = e.query.Pack()
+		}
+		entries = append(entries, se)
+	}
+	s.mu.RUnlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.cfg.CacheFile), 0o755); err != nil {
+		return err
+	}
+	tmp := s.cfg.CacheFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	if err := gob.NewEncoder(bw).Encode(savedCache{Saved: time.Now(), Entries: entries}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.cfg.CacheFile); err != nil {
+		return err
+	}
+	logging.Infof("cache saved: %d entries", len(entries))
+	return nil
+}
+
+func (s *Server) loadCache() error {
+	if s.cfg.CacheFile == "" {
+		return nil
+	}
+	f, err := os.Open(s.cfg.CacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var saved savedCache
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&saved); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	loaded := 0
+	for _, se := range saved.Entries {
+		// Записи старше окна serve-stale уже не нужны
+		if !now.Before(se.Expiry.Add(s.cfg.ServeStale.MaxStale)) {
+			continue
+		}
+		msg := new(miekg_dns.Msg)
+		if err := msg.Unpack(se.Msg); err != nil {
+			continue
+		}
+		e := &cacheEntry{msg: msg, expiry: se.Expiry, ttl: se.TTL, upstreams: se.Upstreams}
+		if len(se.Query) > 0 {
+			e.query = new(miekg_dns.Msg)
+			if err := e.query.Unpack(se.Query); err != nil {
+				e.query = nil
+			}
+		}
+
+		// TTL в ответах не больше, чем записи осталось жить в кеше
+		left := uint32(max(se.Expiry.Sub(now), 0).Seconds())
+		for _, section := range [][]miekg_dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+			for _, rr := range section {
+				if h := rr.Header(); h.Rrtype != miekg_dns.TypeOPT {
+					h.Ttl = min(h.Ttl, left)
+				}
+			}
+		}
+
+		s.cache[se.Key] = e
+		loaded++
+	}
+	logging.Infof("cache loaded: %d entries", loaded)
+	return nil
+}
@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func cachedReply(name string, ttl uint32) *miekg_dns.Msg {
+	m := new(miekg_dns.Msg)
+	m.SetQuestion(name, miekg_dns.TypeA)
+	m.Response = true
+	m.Answer = []miekg_dns.RR{testRR("%s %d IN A 192.0.2.1", name, ttl)}
+	return m
+}
+
+func TestCacheFileRoundTrip(t *testing.T) {
+	yaml := fmt.Sprintf(`
+listen: 127.0.0.1:0
+ttl: 300
+cache_file: %s
+serve_stale:
+  max_stale: 1h
+`, filepath.Join(t.TempDir(), "cache.gob"))
+	s, _ := newTestServer(t, yaml)
+
+	now := time.Now()
+	entries := map[string]struct {
+		ttl    uint32
+		expiry time.Time
+	}{
+		"fresh.test.:A":     {ttl: 300, expiry: now.Add(100 * time.Second)},
+		"short.test.:A":     {ttl: 30, expiry: now.Add(100 * time.Second)},
+		"stale.test.:A":     {ttl: 300, expiry: now.Add(-10 * time.Minute)},
+		"too-stale.test.:A": {ttl: 300, expiry: now.Add(-2 * time.Hour)},
+	}
+	for key, e := range entries {
+		name := key[:len(key)-len(":A")]
+		s.cache[key] = &cacheEntry{msg: cachedReply(name, e.ttl), expiry: e.expiry, ttl: 300 * time.Second}
+	}
+	if err := s.saveCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _ := newTestServer(t, yaml)
+	if _, ok := loaded.cache["too-stale.test.:A"]; ok {
+		t.Error("entry beyond the stale window loaded")
+	}
+	tests := []struct {
+		key      string
+		min, max uint32
+	}{
+		{key: "fresh.test.:A", min: 95, max: 100},
+		{key: "short.test.:A", min: 30, max: 30},
+		{key: "stale.test.:A", min: 0, max: 0},
+	}
+	for _, tt := range tests {
+		e, ok := loaded.cache[tt.key]
+		if !ok {
+			t.Errorf("%s not loaded", tt.key)
+			continue
+		}
+		if !e.expiry.Equal(entries[tt.key].expiry) {
+			t.Errorf("%s: expiry %v, want %v", tt.key, e.expiry, entries[tt.key].expiry)
+		}
+		if ttl := e.msg.Answer[0].Header().Ttl; ttl < tt.min || ttl > tt.max {
+			t.Errorf("%s: TTL %d, want %d..%d", tt.key, ttl, tt.min, tt.max)
+		}
+	}
+}
+
+func TestCacheFileCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	if err := os.WriteFile(path, []byte("not a gob stream"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Испорченный файл не мешает старту, кеш просто пустой
+	s, _ := newTestServer(t, "listen: 127.0.0.1:0\ncache_file: "+path+"\n")
+	if len(s.cache) != 0 {
+		t.Errorf("%d entries from a corrupt file", len(s.cache))
+	}
+	if err := s.loadCache(); err == nil {
+		t.Error("loadCache accepted a corrupt file")
+	}
+
+	// Без файла загрузка - не ошибка
+	s.cfg.CacheFile = filepath.Join(t.TempDir(), "missing.gob")
+	if err := s.loadCache(); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestAttemptContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 900*time.Millisecond)
+	defer cancel()
+	parent, _ := ctx.Deadline()
+
+	tests := []struct {
+		attempts int
+		want     time.Duration // сколько остаётся попытке
+	}{
+		{attempts: 3, want: 300 * time.Millisecond},
+		{attempts: 2, want: 450 * time.Millisecond},
+		{attempts: 1, want: 900 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		actx, acancel := attemptContext(ctx, tt.attempts)
+		deadline, ok := actx.Deadline()
+		acancel()
+		if got := time.Until(deadline); !ok || got > tt.want || got < tt.want-50*time.Millisecond || deadline.After(parent) {
+			t.Errorf("%d attempts left: %v for the attempt, want %v", tt.attempts, got, tt.want)
+		}
+	}
+
+	actx, acancel := attemptContext(context.Background(), 3)
+	defer acancel()
+	if _, ok := actx.Deadline(); ok {
+		t.Error("deadline without a parent deadline")
+	}
+}
+
+// silentUpstream принимает запросы и не отвечает
+func silentUpstream(t *testing.T, queries *atomic.Int32) string {
+	return serveTest(t, miekg_dns.HandlerFunc(func(miekg_dns.ResponseWriter, *miekg_dns.Msg) {
+		queries.Add(1)
+	}), nil)
+}
+
+// Общий дедлайн query_timeout делится между апстримами, каждый получает свою попытку
+func TestQueryDeadline(t *testing.T) {
+	var first, second atomic.Int32
+	s, _ := newTestServer(t, "listen: 127.0.0.1:0\nquery_timeout: 300ms\n")
+	defer s.pools.close()
+	s.defaultForward.upstreams = []string{silentUpstream(t, &first), silentUpstream(t, &second)}
+
+	var logs bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&logs)
+	defer log.SetOutput(prev)
+
+	r := new(miekg_dns.Msg)
+	r.SetQuestion("slow.test.", miekg_dns.TypeA)
+	w := udpClient("192.0.2.10")
+	start := time.Now()
+	s.ServeDNS(w, r)
+	elapsed := time.Since(start)
+
+	if w.msg == nil || w.msg.Rcode != miekg_dns.RcodeServerFailure {
+		t.Fatalf("reply %v, want SERVFAIL", w.msg)
+	}
+	if elapsed > 450*time.Millisecond {
+		t.Errorf("answered after %v, query_timeout 300ms", elapsed)
+	}
+	if first.Load() == 0 || second.Load() == 0 {
+		t.Errorf("queries %d and %d, want both upstreams asked", first.Load(), second.Load())
+	}
+	// Логи запроса помечены его ID
+	if !regexp.MustCompile(`\[[0-9a-f]{8}\] upstream query failed: slow\.test\.`).Match(logs.Bytes()) {
+		t.Errorf("no tagged log line in %q", logs.String())
+	}
+}
+
+// Остановка сервера отменяет запросы в работе
+func TestShutdownCancelsQueries(t *testing.T) {
+	var queries atomic.Int32
+	s, _ := newTestServer(t, "listen: 127.0.0.1:0\nquery_timeout: 5s\n")
+	defer s.pools.close()
+	s.defaultForward.upstreams = []string{silentUpstream(t, &queries)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	r := new(miekg_dns.Msg)
+	r.SetQuestion("slow.test.", miekg_dns.TypeA)
+	w := udpClient("192.0.2.10")
+	start := time.Now()
+	s.ServeDNS(w, r)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("query ran %v after shutdown", elapsed)
+	}
+}
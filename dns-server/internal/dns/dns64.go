@@ -0,0 +1,195 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"net"
+	"slices"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// DNS64 (RFC 6147): если у имени нет AAAA, синтезируем их из A с префиксом NAT64
+
+type dns64 struct {
+	prefix   net.IP
+	bits     int
+	clients  []*net.IPNet
+	exclude  []*net.IPNet
+	excludeA []*net.IPNet
+}
+
+func newDNS64(c config.DNS64Config) *dns64 {
+	_, prefix, _ := net.ParseCIDR(c.Prefix)
+	bits, _ := prefix.Mask.Size()
+	return &dns64{
+		prefix:   prefix.IP.To16(),
+		bits:     bits,
+		clients:  parseNets(c.Clients),
+		exclude:  parseNets(c.Exclude),
+		excludeA: parseNets(c.ExcludeA),
+	}
+}
+
+func parseNets(list []string) []*net.IPNet {
+	var out []*net.IPNet
+	for _, cidr := range list {
+		_, n, _ := net.ParseCIDR(cidr)
+		out = append(out, n)
+	}
+	return out
+}
+
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// applies - нужен ли синтез для этого клиента. С битом CD клиент проверяет
+// DNSSEC сам, и синтезированные записи ему не подойдут (RFC 6147, 5.5)
+func (d *dns64) applies(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) bool {
+	if r.CheckingDisabled {
+		return false
+	}
+	if len(d.clients) == 0 {
+		return true
+	}
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	ip := net.ParseIP(host)
+	return ip != nil && inNets(d.clients, ip)
+}
+
+// synthesize встраивает IPv4 в префикс по RFC 6052, 2.2 (октет 64-71 пропускается)
+func (d *dns64) synthesize(v4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix)
+	i := d.bits / 8
+	for _, b := range v4.To4() {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// captureWriter перехватывает ответ обработчика вместо отправки клиенту
+type captureWriter struct {
+	miekg_dns.ResponseWriter
+	msg *miekg_dns.Msg
+}
+
+func (c *captureWriter) WriteMsg(m *miekg_dns.Msg) error {
+	c.msg = m
+	return nil
+}
+
+func (c *captureWriter) captured() *miekg_dns.Msg {
+	return c.msg
+}
+
+// capturer - writer, который перехватывает ответ. Обрезка и TSIG делаются,
+// когда перехвативший плагин отправит итоговый ответ через writeMsg.
+type capturer interface {
+	captured() *miekg_dns.Msg
+}
+
+// serveDNS64 - плагин dns64: AAAA запрашивается дальше по цепочке, а если
+// подходящих нет - запрашивается A и из неё синтезируются AAAA
+func (s *Server) serveDNS64(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler) {
+	d := s.dns64
+	if r.Question[0].Qtype != miekg_dns.TypeAAAA || d == nil || !d.applies(w, r) {
+		next.ServeDNS(ctx, w, r)
+		return
+	}
+	aaaa := &captureWriter{ResponseWriter: w}
+	next.ServeDNS(ctx, aaaa, r)
+	resp := aaaa.msg
+	if resp == nil {
+		return
+	}
+	if resp.Rcode != miekg_dns.RcodeSuccess {
+		writeMsg(w, r, resp)
+		return
+	}
+
+	// AAAA из исключённых сетей убираем в любом случае, даже если синтезировать
+	// не из чего (RFC 6147, 5.1.4). Подпись урезанного набора уже не сходится.
+	answer := resp.Answer[:0:0]
+	found, excluded := false, false
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*miekg_dns.AAAA); ok {
+			if inNets(d.exclude, a.AAAA) {
+				excluded = true
+				continue
+			}
+			found = true
+		}
+		answer = append(answer, rr)
+	}
+	if excluded {
+		answer = slices.DeleteFunc(answer, func(rr miekg_dns.RR) bool {
+			sig, ok := rr.(*miekg_dns.RRSIG)
+			return ok && sig.TypeCovered == miekg_dns.TypeAAAA
+		})
+		resp.AuthenticatedData = false
+	}
+	resp.Answer = answer
+	// Есть настоящие AAAA - отдаём их
+	if found {
+		writeMsg(w, r, resp)
+		return
+	}
+
+	// Запрашиваем A тем же путём и заменяем A на синтезированные AAAA
+	aq := r.Copy()
+	aq.Question[0].Qtype = miekg_dns.TypeA
+	a := &captureWriter{ResponseWriter: w}
+	next.ServeDNS(ctx, a, aq)
+	if a.msg == nil || a.msg.Rcode != miekg_dns.RcodeSuccess {
+		writeMsg(w, r, resp)
+		return
+	}
+
+	// TTL не больше negative TTL из ответа на AAAA (RFC 6147, 5.1.7)
+	maxTTL := ^uint32(0)
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*miekg_dns.SOA); ok {
+			maxTTL = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	out := a.msg.Copy()
+	out.Question = r.Question
+	out.Id = r.Id
+	out.AuthenticatedData = false
+	out.Answer = nil
+	synthesized := false
+	for _, rr := range a.msg.Answer {
+		switch v := rr.(type) {
+		case *miekg_dns.A:
+			if inNets(d.excludeA, v.A) {
+				continue
+			}
+			hdr := v.Hdr
+			hdr.Rrtype = miekg_dns.TypeAAAA
+			hdr.Ttl = min(hdr.Ttl, maxTTL)
+			out.Answer = append(out.Answer, &miekg_dns.AAAA{Hdr: hdr, AAAA: d.synthesize(v.A)})
+			synthesized = true
+		case *miekg_dns.RRSIG:
+			// Подписи к A для AAAA не годятся
+		default:
+			out.Answer = append(out.Answer, rr)
+		}
+	}
+	if !synthesized {
+		writeMsg(w, r, resp)
+		return
+	}
+	writeMsg(w, r, out)
+}
@@ -0,0 +1,206 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// testWriter запоминает ответ вместо отправки клиенту с адреса remote
+type testWriter struct {
+	remote net.Addr
+	msg    *miekg_dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr  { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *testWriter) WriteMsg(m *miekg_dns.Msg) error {
+	w.msg = m
+	return nil
+}
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+func udpClient(ip string) *testWriter {
+	return &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}}
+}
+
+// fakeChain отвечает записями из answers по типу запроса; rcodes - коды ответа по типу
+type fakeChain struct {
+	answers map[uint16][]string
+	rcodes  map[uint16]int
+	soa     string
+	asked   []uint16
+}
+
+func (f *fakeChain) ServeDNS(_ context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+	q := r.Question[0]
+	f.asked = append(f.asked, q.Qtype)
+	m := new(miekg_dns.Msg)
+	m.SetReply(r)
+	m.Rcode = f.rcodes[q.Qtype]
+	for _, s := range f.answers[q.Qtype] {
+		m.Answer = append(m.Answer, testRR("%s", s))
+	}
+	if len(m.Answer) == 0 && f.soa != "" {
+		m.Ns = []miekg_dns.RR{testRR("%s", f.soa)}
+	}
+	writeMsg(w, r, m)
+}
+
+func TestDNS64(t *testing.T) {
+	cfg := config.DNS64Config{
+		Prefix:   "64:ff9b::/96",
+		Clients:  []string{"192.0.2.0/24", "2001:db8::/32"},
+		Exclude:  []string{"::ffff:0:0/96"},
+		ExcludeA: []string{"10.0.0.0/8"},
+	}
+	const soa = "v6.test. 300 IN SOA ns.v6.test. hostmaster.v6.test. 1 3600 600 604800 60"
+
+	tests := []struct {
+		name   string
+		client string
+		cd     bool
+		chain  fakeChain
+		rcode  int
+		answer []string
+		asked  []uint16
+	}{
+		{
+			name:   "synthesized with TTL capped by negative TTL",
+			client: "192.0.2.10",
+			chain:  fakeChain{answers: map[uint16][]string{miekg_dns.TypeA: {"v6.test. 600 IN A 198.51.100.1"}}, soa: soa},
+			answer: []string{"v6.test.\t60\tIN\tAAAA\t64:ff9b::c633:6401"},
+			asked:  []uint16{miekg_dns.TypeAAAA, miekg_dns.TypeA},
+		},
+		{
+			name:   "TTL of A kept when lower",
+			client: "192.0.2.10",
+			chain:  fakeChain{answers: map[uint16][]string{miekg_dns.TypeA: {"v6.test. 20 IN A 198.51.100.1"}}, soa: soa},
+			answer: []string{"v6.test.\t20\tIN\tAAAA\t64:ff9b::c633:6401"},
+			asked:  []uint16{miekg_dns.TypeAAAA, miekg_dns.TypeA},
+		},
+		{
+			name:   "real AAAA",
+			client: "192.0.2.10",
+			chain:  fakeChain{answers: map[uint16][]string{miekg_dns.TypeAAAA: {"v6.test. 300 IN AAAA 2001:db8::1"}}},
+			answer: []string{"v6.test.\t300\tIN\tAAAA\t2001:db8::1"},
+			asked:  []uint16{miekg_dns.TypeAAAA},
+		},
+		{
+			name:   "excluded AAAA replaced by synthesis",
+			client: "192.0.2.10",
+			chain: fakeChain{answers: map[uint16][]string{
+				miekg_dns.TypeAAAA: {"v6.test. 300 IN AAAA ::ffff:198.51.100.1"},
+				miekg_dns.TypeA:    {"v6.test. 300 IN A 198.51.100.1"},
+			}},
+			answer: []string{"v6.test.\t300\tIN\tAAAA\t64:ff9b::c633:6401"},
+			asked:  []uint16{miekg_dns.TypeAAAA, miekg_dns.TypeA},
+		},
+		{
+			name:   "excluded AAAA dropped when A fails",
+			client: "192.0.2.10",
+			chain: fakeChain{
+				answers: map[uint16][]string{miekg_dns.TypeAAAA: {"v6.test. 300 IN AAAA ::ffff:198.51.100.1"}},
+				rcodes:  map[uint16]int{miekg_dns.TypeA: miekg_dns.RcodeServerFailure},
+			},
+			asked: []uint16{miekg_dns.TypeAAAA, miekg_dns.TypeA},
+		},
+		{
+			name:   "excluded AAAA dropped when A is excluded",
+			client: "192.0.2.10",
+			chain: fakeChain{answers: map[uint16][]string{
+				miekg_dns.TypeAAAA: {"v6.test. 300 IN AAAA ::ffff:10.0.0.1"},
+				miekg_dns.TypeA:    {"v6.test. 300 IN A 10.0.0.1"},
+			}},
+			asked: []uint16{miekg_dns.TypeAAAA, miekg_dns.TypeA},
+		},
+		{
+			name:   "only allowed A synthesized",
+			client: "2001:db8::5",
+			chain: fakeChain{answers: map[uint16][]string{miekg_dns.TypeA: {
+				"v6.test. 300 IN A 10.1.2.3",
+				"v6.test. 300 IN A 198.51.100.1",
+			}}},
+			answer: []string{"v6.test.\t300\tIN\tAAAA\t64:ff9b::c633:6401"},
+			asked:  []uint16{miekg_dns.TypeAAAA, miekg_dns.TypeA},
+		},
+		{
+			name:   "NXDOMAIN passed through",
+			client: "192.0.2.10",
+			chain:  fakeChain{rcodes: map[uint16]int{miekg_dns.TypeAAAA: miekg_dns.RcodeNameError}, soa: soa},
+			rcode:  miekg_dns.RcodeNameError,
+			asked:  []uint16{miekg_dns.TypeAAAA},
+		},
+		{
+			name:   "client not listed",
+			client: "203.0.113.1",
+			chain:  fakeChain{answers: map[uint16][]string{miekg_dns.TypeA: {"v6.test. 300 IN A 198.51.100.1"}}},
+			asked:  []uint16{miekg_dns.TypeAAAA},
+		},
+		{
+			name:   "checking disabled",
+			client: "192.0.2.10",
+			cd:     true,
+			chain:  fakeChain{answers: map[uint16][]string{miekg_dns.TypeA: {"v6.test. 300 IN A 198.51.100.1"}}},
+			asked:  []uint16{miekg_dns.TypeAAAA},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{dns64: newDNS64(cfg)}
+			w := udpClient(tt.client)
+			r := new(miekg_dns.Msg)
+			r.SetQuestion("v6.test.", miekg_dns.TypeAAAA)
+			r.CheckingDisabled = tt.cd
+			s.serveDNS64(context.Background(), w, r, &tt.chain)
+
+			if w.msg == nil {
+				t.Fatal("no reply")
+			}
+			var answer []string
+			for _, rr := range w.msg.Answer {
+				answer = append(answer, rr.String())
+			}
+			if w.msg.Rcode != tt.rcode || !slices.Equal(answer, tt.answer) {
+				t.Errorf("reply %s %v, want %s %v", miekg_dns.RcodeToString[w.msg.Rcode], answer,
+					miekg_dns.RcodeToString[tt.rcode], tt.answer)
+			}
+			if !slices.Equal(tt.chain.asked, tt.asked) {
+				t.Errorf("asked %v, want %v", tt.chain.asked, tt.asked)
+			}
+		})
+	}
+}
+
+// Синтезированный ответ обрезается для UDP, как и любой другой
+func TestDNS64Truncate(t *testing.T) {
+	var addrs []string
+	for i := range 40 {
+		addrs = append(addrs, fmt.Sprintf("big.v6.test. 300 IN A 198.51.100.%d", i+1))
+	}
+	chain := &fakeChain{answers: map[uint16][]string{miekg_dns.TypeA: addrs}}
+	s := &Server{dns64: newDNS64(config.DNS64Config{Prefix: "64:ff9b::/96"})}
+	r := new(miekg_dns.Msg)
+	r.SetQuestion("big.v6.test.", miekg_dns.TypeAAAA)
+
+	w := udpClient("192.0.2.10")
+	s.serveDNS64(context.Background(), w, r, chain)
+	if w.msg == nil || !w.msg.Truncated || w.msg.Len() > miekg_dns.MinMsgSize {
+		t.Fatalf("UDP reply not truncated: %d bytes", w.msg.Len())
+	}
+
+	tcp := &testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5353}}
+	s.serveDNS64(context.Background(), tcp, r, chain)
+	if tcp.msg == nil || tcp.msg.Truncated || len(tcp.msg.Answer) != len(addrs) {
+		t.Errorf("TCP reply: %d answers, want %d", len(tcp.msg.Answer), len(addrs))
+	}
+}
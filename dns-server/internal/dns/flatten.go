@@ -0,0 +1,100 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/logging"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// CNAME flattening: CNAME на вершине зоны (рядом с SOA и NS он недопустим,
+// RFC 1034, 3.6.2) отдаётся адресами своей цели, для остальных типов не виден
+
+const maxFlattenDepth = 4
+
+// flattenWriter перехватывает ответ при разрешении цели; depth защищает от циклов
+type flattenWriter struct {
+	captureWriter
+	depth int
+}
+
+func (s *Server) flattenApex(ctx context.Context, w miekg_dns.ResponseWriter, msg *miekg_dns.Msg, z *Zone, qtype uint16) {
+	msg.Answer, msg.Ns, msg.Rcode = z.lookup(z.name, qtype)
+	if len(msg.Answer) == 0 {
+		return
+	}
+	// В ANY наборы идут в произвольном порядке, CNAME может оказаться первым
+	if qtype == miekg_dns.TypeANY {
+		answer := msg.Answer[:0]
+		for _, rr := range msg.Answer {
+			if rr.Header().Rrtype != miekg_dns.TypeCNAME {
+				answer = append(answer, rr)
+			}
+		}
+		msg.Answer = answer
+		return
+	}
+	cname, ok := msg.Answer[0].(*miekg_dns.CNAME)
+	if !ok {
+		return
+	}
+
+	// Для остальных типов на вершине данных нет
+	msg.Answer, msg.Ns, msg.Rcode = nil, []miekg_dns.RR{z.negativeSOA()}, miekg_dns.RcodeSuccess
+	if qtype != miekg_dns.TypeA && qtype != miekg_dns.TypeAAAA {
+		return
+	}
+
+	depth := flattenDepth(w)
+	if depth >= maxFlattenDepth {
+		logging.Ctx(ctx).Warnf("CNAME flattening loop at %s", z.name)
+		msg.Ns, msg.Rcode = nil, miekg_dns.RcodeServerFailure
+		return
+	}
+
+	q := new(miekg_dns.Msg)
+	q.SetQuestion(cname.Target, qtype)
+	q.SetEdns0(ednsUDPSize, false)
+	fw := &flattenWriter{captureWriter: captureWriter{ResponseWriter: w}, depth: depth}
+	s.chain.ServeDNS(ctx, fw, q)
+	resp := fw.msg
+	switch {
+	case resp == nil:
+		msg.Ns, msg.Rcode = nil, miekg_dns.RcodeServerFailure
+		return
+	case resp.Rcode == miekg_dns.RcodeNameError:
+		// Цели нет - у вершины просто нет адресов
+		return
+	case resp.Rcode != miekg_dns.RcodeSuccess:
+		msg.Ns, msg.Rcode = nil, resp.Rcode
+		return
+	}
+
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		rr = miekg_dns.Copy(rr)
+		h := rr.Header()
+		h.Name = z.name
+		h.Ttl = min(h.Ttl, cname.Hdr.Ttl)
+		msg.Answer = append(msg.Answer, rr)
+	}
+	if len(msg.Answer) > 0 {
+		msg.Ns = nil
+	}
+}
+
+// flattenDepth - глубина вложенного разрешения; плагины могут обернуть writer
+func flattenDepth(w miekg_dns.ResponseWriter) int {
+	for {
+		switch v := w.(type) {
+		case *flattenWriter:
+			return v.depth + 1
+		case *captureWriter:
+			w = v.ResponseWriter
+		default:
+			return 0
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package dns
+
+import (
+	"testing"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestFlattenApex(t *testing.T) {
+	s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+zones:
+  - name: flat.test
+    flatten_cname: true
+    records:
+      - "@ 30 IN CNAME www.target.test."
+      - "@ IN MX 10 mail.flat.test."
+  - name: short.test
+    flatten_cname: true
+    records:
+      - "@ 600 IN CNAME www.target.test."
+  - name: gone.test
+    flatten_cname: true
+    records:
+      - "@ IN CNAME missing.target.test."
+  - name: target.test
+    records:
+      - "www 60 IN A 192.0.2.5"
+      - "www 60 IN A 192.0.2.6"
+  - name: loop-a.test
+    flatten_cname: true
+    records:
+      - "@ IN CNAME loop-b.test."
+  - name: loop-b.test
+    flatten_cname: true
+    records:
+      - "@ IN CNAME loop-a.test."
+`)
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		ttl     uint32
+	}{
+		// TTL не больше TTL CNAME
+		{name: "flat.test.", qtype: miekg_dns.TypeA, answers: 2, ttl: 30},
+		{name: "short.test.", qtype: miekg_dns.TypeA, answers: 2, ttl: 60},
+		{name: "flat.test.", qtype: miekg_dns.TypeAAAA},
+		{name: "flat.test.", qtype: miekg_dns.TypeMX, answers: 1},
+		{name: "flat.test.", qtype: miekg_dns.TypeTXT},
+		{name: "flat.test.", qtype: miekg_dns.TypeANY, answers: 3}, // SOA, NS и MX
+		{name: "gone.test.", qtype: miekg_dns.TypeA},
+		{name: "loop-a.test.", qtype: miekg_dns.TypeA, rcode: miekg_dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		r := new(miekg_dns.Msg)
+		r.SetQuestion(tt.name, tt.qtype)
+		w := udpClient("192.0.2.10")
+		s.ServeDNS(w, r)
+		resp := w.msg
+		label := tt.name + " " + miekg_dns.TypeToString[tt.qtype]
+		if resp == nil || resp.Rcode != tt.rcode || len(resp.Answer) != tt.answers {
+			t.Errorf("%s: reply %v, want %s with %d answers", label, resp, miekg_dns.RcodeToString[tt.rcode], tt.answers)
+			continue
+		}
+		for _, rr := range resp.Answer {
+			h := rr.Header()
+			if h.Rrtype == miekg_dns.TypeCNAME || h.Name != tt.name {
+				t.Errorf("%s: %v in answer", label, rr)
+			}
+			if tt.ttl > 0 && h.Ttl != tt.ttl {
+				t.Errorf("%s: TTL %d, want %d", label, h.Ttl, tt.ttl)
+			}
+		}
+		// Пустой ответ - NODATA с SOA зоны
+		if tt.answers == 0 && tt.rcode == miekg_dns.RcodeSuccess {
+			if len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != miekg_dns.TypeSOA {
+				t.Errorf("%s: authority %v, want SOA", label, resp.Ns)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package dns
+
+import (
+	"dns-server/internal/config"
+	"fmt"
+	"net"
+	"strings"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Forward-зоны: свои апстримы и настройки ECS (RFC 7871) для поддерева имён
+
+type forwardZone struct {
+	name      string
+	upstreams []string
+	ecs       config.ECSConfig
+}
+
+// findForward возвращает самую длинную подходящую forward-зону, иначе настройки по умолчанию
+func (s *Server) findForward(name string) *forwardZone {
+	name = strings.ToLower(miekg_dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = miekg_dns.NextLabel(name, off) {
+		if fz, ok := s.forwardZones[name[off:]]; ok {
+			return fz
+		}
+	}
+	if fz, ok := s.forwardZones["."]; ok {
+		return fz
+	}
+	return s.defaultForward
+}
+
+// clientSubnet - подсеть клиента для запроса к апстриму, обрезанная до префикса из конфига.
+// nil - ECS не отправляем.
+func (fz *forwardZone) clientSubnet(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) *miekg_dns.EDNS0_SUBNET {
+	if !fz.ecs.Enabled {
+		return nil
+	}
+
+	var ip net.IP
+	var prefix uint8
+	if ecs := ednsSubnet(r); ecs != nil {
+		// Нулевой префикс - клиент просит не раскрывать его подсеть (RFC 7871, 7.1.2)
+		if ecs.SourceNetmask == 0 {
+			return nil
+		}
+		ip, prefix = ecs.Address, ecs.SourceNetmask
+	} else {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		ip, prefix = net.ParseIP(host), 128
+		// Адреса из локальных сетей апстриму ничего не скажут
+		if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+			return nil
+		}
+	}
+
+	family, limit := uint16(2), fz.ecs.IPv6Prefix
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, family, limit = ip4, 1, fz.ecs.IPv4Prefix
+	}
+	prefix = min(prefix, limit, uint8(len(ip)*8))
+	return &miekg_dns.EDNS0_SUBNET{
+		Code:          miekg_dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: prefix,
+		Address:       ip.Mask(net.CIDRMask(int(prefix), len(ip)*8)),
+	}
+}
+
+func ednsSubnet(m *miekg_dns.Msg) *miekg_dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*miekg_dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// ecsCacheKey - часть ключа кеша для ответа, зависящего от подсети клиента
+func ecsCacheKey(ecs *miekg_dns.EDNS0_SUBNET) string {
+	return fmt.Sprintf(":ecs=%s/%d", ecs.Address, ecs.SourceNetmask)
+}
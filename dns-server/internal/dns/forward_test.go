@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"dns-server/internal/config"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestFindForward(t *testing.T) {
+	s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+upstream: ["127.0.0.1:1"]
+forward_zones:
+  - name: example.test
+    upstream: ["127.0.0.1:2"]
+  - name: cdn.example.test
+    upstream: ["127.0.0.1:3"]
+`)
+	tests := map[string]string{
+		"example.test.":         "example.test.",
+		"www.EXAMPLE.test":      "example.test.",
+		"a.b.cdn.example.test.": "cdn.example.test.",
+		"notexample.test.":      ".",
+		"other.test.":           ".",
+	}
+	for name, want := range tests {
+		if got := s.findForward(name).name; got != want {
+			t.Errorf("%s: forward zone %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	on := &forwardZone{ecs: config.ECSConfig{Enabled: true, IPv4Prefix: 24, IPv6Prefix: 56}}
+	tests := []struct {
+		name   string
+		fz     *forwardZone
+		client string
+		ecs    *miekg_dns.EDNS0_SUBNET // ECS в запросе клиента
+		want   string                  // "" - ECS не отправляем
+	}{
+		{name: "disabled", fz: &forwardZone{}, client: "203.0.113.77", want: ""},
+		{name: "client address", fz: on, client: "203.0.113.77", want: "203.0.113.0/24"},
+		{name: "IPv6 client", fz: on, client: "2001:db8:1:2:3::1", want: "2001:db8:1::/56"},
+		{name: "private client", fz: on, client: "192.168.1.5", want: ""},
+		{name: "loopback client", fz: on, client: "127.0.0.1", want: ""},
+		{name: "client ECS narrower", fz: on, client: "192.168.1.5",
+			ecs: &miekg_dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 16, Address: net.ParseIP("198.51.0.0").To4()}, want: "198.51.0.0/16"},
+		{name: "client ECS wider", fz: on, client: "192.168.1.5",
+			ecs: &miekg_dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 32, Address: net.ParseIP("198.51.100.9").To4()}, want: "198.51.100.0/24"},
+		{name: "client opted out", fz: on, client: "203.0.113.77",
+			ecs: &miekg_dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 0, Address: net.IPv4zero.To4()}, want: ""},
+	}
+	for _, tt := range tests {
+		r := new(miekg_dns.Msg)
+		r.SetQuestion("cdn.test.", miekg_dns.TypeA)
+		if tt.ecs != nil {
+			tt.ecs.Code = miekg_dns.EDNS0SUBNET
+			r.SetEdns0(1232, false)
+			r.IsEdns0().Option = append(r.IsEdns0().Option, tt.ecs)
+		}
+		got := tt.fz.clientSubnet(udpClient(tt.client), r)
+		text := ""
+		if got != nil {
+			text = (&net.IPNet{IP: got.Address, Mask: net.CIDRMask(int(got.SourceNetmask), len(got.Address)*8)}).String()
+		}
+		if text != tt.want {
+			t.Errorf("%s: ECS %q, want %q", tt.name, text, tt.want)
+		}
+	}
+}
+
+// Ответы со scope кешируются по подсетям, ECS клиента возвращается со scope ответа
+func TestForwardECS(t *testing.T) {
+	var queries atomic.Int32
+	addr := serveTest(t, miekg_dns.HandlerFunc(func(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+		queries.Add(1)
+		m := new(miekg_dns.Msg)
+		m.SetReply(r)
+		m.Answer = []miekg_dns.RR{testRR("%s 300 IN A 192.0.2.1", r.Question[0].Name)}
+		m.SetEdns0(1232, false)
+		if ecs := ednsSubnet(r); ecs != nil {
+			echo := *ecs
+			echo.SourceScope = 24
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &echo)
+		}
+		_ = w.WriteMsg(m)
+	}), nil)
+
+	s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+forward_zones:
+  - name: cdn.test
+    ecs:
+      enabled: true
+`)
+	// Апстрим на 127.0.0.1 конфиг отбросил бы как петлю
+	s.forwardZones["cdn.test."].upstreams = []string{addr}
+	defer s.pools.close()
+	ask := func(client string, ecs *miekg_dns.EDNS0_SUBNET) *miekg_dns.Msg {
+		r := new(miekg_dns.Msg)
+		r.SetQuestion("www.cdn.test.", miekg_dns.TypeA)
+		r.SetEdns0(1232, false)
+		if ecs != nil {
+			r.IsEdns0().Option = append(r.IsEdns0().Option, ecs)
+		}
+		w := udpClient(client)
+		s.ServeDNS(w, r)
+		return w.msg
+	}
+
+	ask("203.0.113.10", nil)
+	ask("203.0.113.20", nil)
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d upstream queries for one subnet, want 1", n)
+	}
+	ask("198.51.100.10", nil)
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d upstream queries for two subnets, want 2", n)
+	}
+
+	resp := ask("192.168.1.1", &miekg_dns.EDNS0_SUBNET{Code: miekg_dns.EDNS0SUBNET, Family: 1,
+		SourceNetmask: 16, Address: net.ParseIP("198.18.0.0").To4()})
+	ecs := ednsSubnet(resp)
+	if ecs == nil || ecs.SourceNetmask != 16 || ecs.SourceScope != 16 {
+		t.Errorf("echoed ECS %v, want source 16 and scope capped at 16", ecs)
+	}
+}
@@ -0,0 +1,195 @@
+package dns
+
+import (
+	"errors"
+	"math/rand/v2"
+	"strings"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Защита кеша от отравления: случайный регистр имени в запросе (0x20),
+// проверка вопроса в ответе и отбрасывание записей вне bailiwick
+
+var errQuestionMismatch = errors.New("response question does not match query")
+
+// randomizeCase случайно меняет регистр букв имени
+func randomizeCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if l := c | 0x20; 'a' <= l && l <= 'z' && rand.IntN(2) == 0 {
+			b[i] = c ^ 0x20
+		}
+	}
+	return string(b)
+}
+
+// checkQuestion сверяет ID и вопрос ответа с запросом. exact - с учётом регистра имени
+func checkQuestion(q, resp *miekg_dns.Msg, exact bool) error {
+	if resp.Id != q.Id || len(resp.Question) != 1 {
+		return errQuestionMismatch
+	}
+	want, got := q.Question[0], resp.Question[0]
+	if got.Qtype != want.Qtype || got.Qclass != want.Qclass {
+		return errQuestionMismatch
+	}
+	if got.Name == want.Name || !exact && strings.EqualFold(got.Name, want.Name) {
+		return nil
+	}
+	return errQuestionMismatch
+}
+
+// restoreQuestion возвращает ответу ID и имя из исходного запроса
+func restoreQuestion(m, resp *miekg_dns.Msg) {
+	resp.Id = m.Id
+	resp.Question = append([]miekg_dns.Question(nil), m.Question...)
+	name := m.Question[0].Name
+	for _, section := range [][]miekg_dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); strings.EqualFold(h.Name, name) {
+				h.Name = name
+			}
+		}
+	}
+}
+
+// scrub оставляет в ответе только записи, относящиеся к вопросу:
+// в answer - цепочку CNAME/DNAME от имени запроса, в authority - SOA/NS/DS
+// одной зоны (см. answerZone) и доказательства отсутствия, в additional -
+// адреса для NS/MX/SRV из ответа. Authority и additional ограничены зоной
+// bailiwick. Возвращает число отброшенных записей.
+func scrub(resp *miekg_dns.Msg, bailiwick string) int {
+	if len(resp.Question) != 1 {
+		return 0
+	}
+	bailiwick = strings.ToLower(bailiwick)
+	chain := map[string]bool{strings.ToLower(resp.Question[0].Name): true}
+	inChain := func(owner string) bool {
+		if chain[owner] {
+			return true
+		}
+		for name := range chain {
+			if miekg_dns.IsSubDomain(owner, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Answer: цепочка может идти не по порядку, проходим до стабилизации
+	keep := make([]bool, len(resp.Answer))
+	for changed := true; changed; {
+		changed = false
+		for i, rr := range resp.Answer {
+			if keep[i] {
+				continue
+			}
+			owner := strings.ToLower(rr.Header().Name)
+			ok := chain[owner]
+			if !ok && coveredType(rr) == miekg_dns.TypeDNAME {
+				ok = inChain(owner)
+			}
+			if !ok {
+				continue
+			}
+			keep[i], changed = true, true
+			if cname, isCNAME := rr.(*miekg_dns.CNAME); isCNAME {
+				chain[strings.ToLower(cname.Target)] = true
+			}
+		}
+	}
+	dropped := 0
+	answer := resp.Answer[:0]
+	for i, rr := range resp.Answer {
+		if keep[i] {
+			answer = append(answer, rr)
+		} else {
+			dropped++
+		}
+	}
+	resp.Answer = answer
+
+	targets := make(map[string]bool)
+	addTarget := func(rr miekg_dns.RR) {
+		switch rr := rr.(type) {
+		case *miekg_dns.NS:
+			targets[strings.ToLower(rr.Ns)] = true
+		case *miekg_dns.MX:
+			targets[strings.ToLower(rr.Mx)] = true
+		case *miekg_dns.SRV:
+			targets[strings.ToLower(rr.Target)] = true
+		}
+	}
+	for _, rr := range resp.Answer {
+		addTarget(rr)
+	}
+
+	zone := answerZone(resp, bailiwick)
+	ns := resp.Ns[:0]
+	for _, rr := range resp.Ns {
+		owner := strings.ToLower(rr.Header().Name)
+		var ok bool
+		switch coveredType(rr) {
+		case miekg_dns.TypeNSEC, miekg_dns.TypeNSEC3:
+			ok = miekg_dns.IsSubDomain(bailiwick, owner)
+		default:
+			ok = owner == zone
+		}
+		if !ok {
+			dropped++
+			continue
+		}
+		ns = append(ns, rr)
+		addTarget(rr)
+	}
+	resp.Ns = ns
+
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		owner := strings.ToLower(rr.Header().Name)
+		ok := false
+		switch coveredType(rr) {
+		case miekg_dns.TypeOPT:
+			ok = true
+		case miekg_dns.TypeA, miekg_dns.TypeAAAA:
+			ok = targets[owner] && miekg_dns.IsSubDomain(bailiwick, owner)
+		}
+		if !ok {
+			dropped++
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	resp.Extra = extra
+	return dropped
+}
+
+// answerZone - зона, к которой относится authority: самый глубокий владелец
+// SOA или NS над концом цепочки CNAME. При пересылке без forward-зон bailiwick
+// равен ".", и только так в кеш не попадут, например, NS для com. из ответа
+// про www.example.com. Пусто - в ответе нет подходящих SOA/NS.
+func answerZone(resp *miekg_dns.Msg, bailiwick string) string {
+	target := cnameTarget(miekg_dns.CanonicalName(resp.Question[0].Name), resp.Answer)
+	zone := ""
+	for _, rr := range resp.Ns {
+		if t := rr.Header().Rrtype; t != miekg_dns.TypeSOA && t != miekg_dns.TypeNS {
+			continue
+		}
+		owner := strings.ToLower(rr.Header().Name)
+		if !miekg_dns.IsSubDomain(bailiwick, owner) || !miekg_dns.IsSubDomain(owner, target) {
+			continue
+		}
+		if zone == "" || miekg_dns.CountLabel(owner) > miekg_dns.CountLabel(zone) {
+			zone = owner
+		}
+	}
+	return zone
+}
+
+// coveredType - тип записи, для RRSIG - тип подписанного набора
+func coveredType(rr miekg_dns.RR) uint16 {
+	if sig, ok := rr.(*miekg_dns.RRSIG); ok {
+		return sig.TypeCovered
+	}
+	return rr.Header().Rrtype
+}
@@ -0,0 +1,244 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	const name = "www.Example-1.test."
+	seen := make(map[string]bool)
+	for range 100 {
+		got := randomizeCase(name)
+		if !strings.EqualFold(got, name) || len(got) != len(name) {
+			t.Fatalf("randomizeCase(%s) = %s", name, got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 10 {
+		t.Errorf("only %d variants in 100 runs", len(seen))
+	}
+	if got := randomizeCase("123-._."); got != "123-._." {
+		t.Errorf("non-letters changed: %s", got)
+	}
+}
+
+func TestCheckQuestion(t *testing.T) {
+	q := new(miekg_dns.Msg)
+	q.SetQuestion("wWw.ExAmple.test.", miekg_dns.TypeA)
+	reply := func(edit func(r *miekg_dns.Msg)) *miekg_dns.Msg {
+		r := new(miekg_dns.Msg)
+		r.SetReply(q)
+		edit(r)
+		return r
+	}
+	tests := []struct {
+		name  string
+		resp  *miekg_dns.Msg
+		exact bool
+		ok    bool
+	}{
+		{name: "same", resp: reply(func(*miekg_dns.Msg) {}), exact: true, ok: true},
+		{name: "case differs", resp: reply(func(r *miekg_dns.Msg) { r.Question[0].Name = "www.example.test." }), exact: true},
+		{name: "case differs over TCP", resp: reply(func(r *miekg_dns.Msg) { r.Question[0].Name = "www.example.test." }), ok: true},
+		{name: "other ID", resp: reply(func(r *miekg_dns.Msg) { r.Id++ })},
+		{name: "other name", resp: reply(func(r *miekg_dns.Msg) { r.Question[0].Name = "evil.test." })},
+		{name: "other type", resp: reply(func(r *miekg_dns.Msg) { r.Question[0].Qtype = miekg_dns.TypeAAAA })},
+		{name: "other class", resp: reply(func(r *miekg_dns.Msg) { r.Question[0].Qclass = miekg_dns.ClassCHAOS })},
+		{name: "no question", resp: reply(func(r *miekg_dns.Msg) { r.Question = nil })},
+	}
+	for _, tt := range tests {
+		if err := checkQuestion(q, tt.resp, tt.exact); (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// Ответ с изменённым регистром по UDP отбрасывается, и запрос повторяется по TCP
+func TestExchangeCaseMismatch(t *testing.T) {
+	var tcpQueries atomic.Int32
+	handler := func(lower bool) miekg_dns.HandlerFunc {
+		return func(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+			m := new(miekg_dns.Msg)
+			m.SetReply(r)
+			if lower {
+				m.Question[0].Name = strings.ToLower(m.Question[0].Name)
+			} else {
+				tcpQueries.Add(1)
+			}
+			m.Answer = []miekg_dns.RR{testRR("%s 60 IN A 192.0.2.1", m.Question[0].Name)}
+			_ = w.WriteMsg(m)
+		}
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Skip("port taken for TCP: ", err)
+	}
+	for _, srv := range []*miekg_dns.Server{
+		{PacketConn: pc, Handler: handler(true)},
+		{Listener: l, Handler: handler(false)},
+	} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func() { _ = srv.ActivateAndServe() }()
+		<-started
+		t.Cleanup(func() { _ = srv.Shutdown() })
+	}
+
+	s, _ := newTestServer(t, "listen: 127.0.0.1:0\n")
+	defer s.pools.close()
+	m := new(miekg_dns.Msg)
+	m.SetQuestion("Mixed.Case.test.", miekg_dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := s.exchangeOne(ctx, m, pc.LocalAddr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcpQueries.Load() != 1 {
+		t.Errorf("%d TCP queries, want 1", tcpQueries.Load())
+	}
+	if resp.Id != m.Id || resp.Question[0].Name != "Mixed.Case.test." {
+		t.Errorf("question not restored: %d %s", resp.Id, resp.Question[0].Name)
+	}
+
+	// С выключенным 0x20 регистр не меняется и UDP-ответа достаточно
+	s.cfg.Hardening.Disable0x20 = true
+	m.Question[0].Name = "mixed.case.test."
+	if _, err := s.exchangeOne(ctx, m, pc.LocalAddr().String(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if tcpQueries.Load() != 1 {
+		t.Errorf("%d TCP queries with 0x20 disabled, want 1", tcpQueries.Load())
+	}
+	if err := checkQuestion(m, &miekg_dns.Msg{}, false); !errors.Is(err, errQuestionMismatch) {
+		t.Errorf("empty reply: %v", err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		name      string
+		qname     string
+		bailiwick string
+		answer    []string
+		ns        []string
+		extra     []string
+		want      []string // оставшиеся записи всех секций
+	}{
+		{
+			name:  "CNAME chain kept, unrelated answer dropped",
+			qname: "www.example.test.",
+			answer: []string{
+				"cdn.other.test. 60 IN A 192.0.2.2",
+				"www.example.test. 60 IN CNAME cdn.other.test.",
+				"evil.test. 60 IN A 203.0.113.66",
+			},
+			bailiwick: ".",
+			want:      []string{"cdn.other.test. A", "www.example.test. CNAME"},
+		},
+		{
+			name:      "DNAME and synthesized CNAME",
+			qname:     "a.old.test.",
+			bailiwick: ".",
+			answer: []string{
+				"old.test. 60 IN DNAME new.test.",
+				"a.old.test. 60 IN CNAME a.new.test.",
+				"a.new.test. 60 IN A 192.0.2.3",
+			},
+			want: []string{"a.new.test. A", "a.old.test. CNAME", "old.test. DNAME"},
+		},
+		{
+			name:      "NS of a parent zone dropped with root bailiwick",
+			qname:     "www.example.test.",
+			bailiwick: ".",
+			answer:    []string{"www.example.test. 60 IN A 192.0.2.1"},
+			ns: []string{
+				"example.test. 60 IN NS ns.example.test.",
+				"test. 60 IN NS ns.evil.",
+			},
+			extra: []string{
+				"ns.example.test. 60 IN A 192.0.2.53",
+				"ns.evil. 60 IN A 203.0.113.53",
+				"unrelated.test. 60 IN A 203.0.113.1",
+			},
+			want: []string{"example.test. NS", "ns.example.test. A", "www.example.test. A"},
+		},
+		{
+			name:      "SOA of the zone at the end of the chain",
+			qname:     "www.example.test.",
+			bailiwick: ".",
+			answer:    []string{"www.example.test. 60 IN CNAME gone.other.test."},
+			ns: []string{
+				"other.test. 60 IN SOA ns.other.test. hostmaster.other.test. 1 3600 600 604800 60",
+				"example.test. 60 IN SOA ns.example.test. hostmaster.example.test. 1 3600 600 604800 60",
+				"other.test. 60 IN NSEC zzz.other.test. SOA NS RRSIG NSEC",
+				"side.test. 60 IN NS ns.side.test.",
+			},
+			want: []string{"other.test. NSEC", "other.test. SOA", "www.example.test. CNAME"},
+		},
+		{
+			name:      "forward zone bailiwick",
+			qname:     "host.corp.test.",
+			bailiwick: "corp.test.",
+			answer:    []string{"host.corp.test. 60 IN CNAME www.public.test.", "www.public.test. 60 IN A 192.0.2.9"},
+			ns:        []string{"public.test. 60 IN NS ns.public.test.", "corp.test. 60 IN NS ns.corp.test."},
+			extra:     []string{"ns.corp.test. 60 IN A 10.0.0.53"},
+			want:      []string{"host.corp.test. CNAME", "www.public.test. A"},
+		},
+		{
+			name:      "unrelated NSEC outside bailiwick",
+			qname:     "x.corp.test.",
+			bailiwick: "corp.test.",
+			ns: []string{
+				"corp.test. 60 IN SOA ns.corp.test. hostmaster.corp.test. 1 3600 600 604800 60",
+				"corp.test. 60 IN NSEC y.corp.test. SOA NS RRSIG NSEC",
+				"evil.test. 60 IN NSEC zzz.evil.test. A RRSIG NSEC",
+			},
+			want: []string{"corp.test. NSEC", "corp.test. SOA"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(miekg_dns.Msg)
+			resp.SetQuestion(tt.qname, miekg_dns.TypeA)
+			total := 0
+			for _, section := range []struct {
+				to   *[]miekg_dns.RR
+				from []string
+			}{{&resp.Answer, tt.answer}, {&resp.Ns, tt.ns}, {&resp.Extra, tt.extra}} {
+				for _, s := range section.from {
+					*section.to = append(*section.to, testRR("%s", s))
+					total++
+				}
+			}
+			dropped := scrub(resp, tt.bailiwick)
+
+			var got []string
+			for _, rrs := range [][]miekg_dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+				for _, rr := range rrs {
+					got = append(got, rr.Header().Name+" "+miekg_dns.TypeToString[rr.Header().Rrtype])
+				}
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+			if dropped != total-len(got) {
+				t.Errorf("dropped %d, want %d", dropped, total-len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/logging"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Health check адресов из records: недоступные адреса убираются из ответов
+
+func (s *Server) runHealthChecks(ctx context.Context) {
+	for _, rs := range s.records {
+		if rs.check == nil {
+			continue
+		}
+		for _, t := range append(append([]*weightedIP{}, rs.v4...), rs.v6...) {
+			go rs.watch(ctx, t)
+		}
+	}
+}
+
+func (rs *recordSet) watch(ctx context.Context, t *weightedIP) {
+	ticker := time.NewTicker(rs.check.Interval)
+	defer ticker.Stop()
+	for {
+		rs.observe(t, rs.probe(ctx, t.ip))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// observe меняет состояние адреса после rise успешных или fall неудачных проверок подряд
+func (rs *recordSet) observe(t *weightedIP, err error) {
+	ok := err == nil
+	if ok == t.healthy.Load() {
+		t.streak = 0
+		return
+	}
+	t.streak++
+	need := rs.check.Fall
+	if ok {
+		need = rs.check.Rise
+	}
+	if t.streak < need {
+		return
+	}
+	t.streak = 0
+	t.healthy.Store(ok)
+	if ok {
+		logging.Infof("health check %s %s: up", rs.name, t.ip)
+	} else {
+		logging.Warnf("health check %s %s: down: %v", rs.name, t.ip, err)
+	}
+}
+
+func (rs *recordSet) probe(ctx context.Context, ip net.IP) error {
+	hc := rs.check
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(hc.Port)))
+
+	if hc.Type == "tcp" {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+	// Редиректы не проходим: 3xx тоже значит, что сервис жив
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.New("HTTP " + resp.Status)
+	}
+	return nil
+}
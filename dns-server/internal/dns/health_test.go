@@ -0,0 +1,165 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestHealthObserve(t *testing.T) {
+	rs := &recordSet{name: "edge.local", check: &config.HealthCheckConfig{Rise: 2, Fall: 3}}
+	ip := &weightedIP{ip: net.ParseIP("10.0.0.1")}
+	ip.healthy.Store(true)
+
+	down := errors.New("connection refused")
+	steps := []struct {
+		err     error
+		healthy bool
+	}{
+		{err: down, healthy: true},
+		{err: down, healthy: true},
+		{err: nil, healthy: true}, // успех сбрасывает счётчик
+		{err: down, healthy: true},
+		{err: down, healthy: true},
+		{err: down, healthy: false},
+		{err: nil, healthy: false},
+		{err: down, healthy: false},
+		{err: nil, healthy: false},
+		{err: nil, healthy: true},
+	}
+	for i, st := range steps {
+		rs.observe(ip, st.err)
+		if ip.healthy.Load() != st.healthy {
+			t.Fatalf("step %d: healthy %v, want %v", i, ip.healthy.Load(), st.healthy)
+		}
+	}
+}
+
+func TestHealthProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/host":
+			if r.Host != "edge.local" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	// Порт, на котором никто не слушает
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	tests := []struct {
+		name string
+		hc   config.HealthCheckConfig
+		ok   bool
+	}{
+		{name: "http 200", hc: config.HealthCheckConfig{Type: "http", Port: uint16(port), Path: "/"}, ok: true},
+		{name: "http redirect", hc: config.HealthCheckConfig{Type: "http", Port: uint16(port), Path: "/redirect"}, ok: true},
+		{name: "http 503", hc: config.HealthCheckConfig{Type: "http", Port: uint16(port), Path: "/fail"}},
+		{name: "http host header", hc: config.HealthCheckConfig{Type: "http", Port: uint16(port), Path: "/host", Host: "edge.local"}, ok: true},
+		{name: "http wrong host", hc: config.HealthCheckConfig{Type: "http", Port: uint16(port), Path: "/host"}},
+		{name: "tcp open", hc: config.HealthCheckConfig{Type: "tcp", Port: uint16(port)}, ok: true},
+		{name: "tcp closed", hc: config.HealthCheckConfig{Type: "tcp", Port: uint16(closed)}},
+	}
+	for _, tt := range tests {
+		tt.hc.Timeout = time.Second
+		rs := &recordSet{check: &tt.hc}
+		if err := rs.probe(context.Background(), net.ParseIP("127.0.0.1")); (err == nil) != tt.ok {
+			t.Errorf("%s: probe error %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestUnhealthyAddresses(t *testing.T) {
+	rs := newRecordSets(map[string]config.RecordSet{"edge.local.": {
+		Policy:    config.PolicyFixed,
+		Addresses: []config.RecordAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}, {IP: "10.0.0.3"}},
+	}})["edge.local."]
+	text := func() []string {
+		var out []string
+		for _, ip := range rs.addresses(miekg_dns.TypeA) {
+			out = append(out, ip.String())
+		}
+		return out
+	}
+
+	rs.v4[1].healthy.Store(false)
+	if got := text(); !slices.Equal(got, []string{"10.0.0.1", "10.0.0.3"}) {
+		t.Errorf("with one address down: %v", got)
+	}
+	// Недоступны все - отдаём все, это лучше пустого ответа
+	rs.v4[0].healthy.Store(false)
+	rs.v4[2].healthy.Store(false)
+	if got := text(); len(got) != 3 {
+		t.Errorf("with all addresses down: %v", got)
+	}
+}
+
+// Проверки в фоне убирают из ответов адрес, на котором не слушают
+func TestHealthChecks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+records:
+  edge.local:
+    policy: fixed
+    addresses: [127.0.0.2, 127.0.0.1]
+    health_check:
+      type: tcp
+      port: `+strconv.Itoa(l.Addr().(*net.TCPAddr).Port)+`
+      interval: 20ms
+      timeout: 200ms
+      fall: 1
+`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.runHealthChecks(ctx)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		got := recordsAnswer(t, s, "edge.local.", miekg_dns.TypeA)
+		if slices.Equal(got, []string{"127.0.0.1"}) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("answer %v, want only the listening address", got)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,99 @@
+package dns
+
+import (
+	"dns-server/internal/config"
+	"errors"
+	"net"
+	"sync"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Слушатели запускаются и останавливаются вместе: ошибка любого из них
+// останавливает остальные
+
+// dnsServers - по серверу на сокет. UDP-сокетов на адрес может быть несколько
+// с SO_REUSEPORT: ядро распределяет пакеты между ними, а значит и по ядрам.
+func (s *Server) dnsServers(secrets map[string]string) []*miekg_dns.Server {
+	var out []*miekg_dns.Server
+	for _, l := range s.cfg.Listeners {
+		family := ipFamily(l.Address)
+		for _, proto := range l.Protocols {
+			n := 1
+			if proto == config.ListenUDP {
+				n = l.UDPSockets
+			}
+			for range n {
+				srv := &miekg_dns.Server{
+					Addr:          l.Address,
+					Net:           proto + family,
+					Handler:       miekg_dns.HandlerFunc(s.ServeDNS),
+					TsigSecret:    secrets,
+					MsgAcceptFunc: acceptMsg,
+					ReusePort:     n > 1,
+				}
+				if proto == config.ListenUDP {
+					srv.UDPSize = miekg_dns.DefaultMsgSize
+				}
+				out = append(out, srv)
+			}
+		}
+	}
+	return out
+}
+
+// ipFamily - "4" или "6" для адреса с IP: сокет IPv6 тогда не принимает IPv4
+// и не мешает слушать тот же порт на 0.0.0.0. Без адреса - оба семейства.
+func ipFamily(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return "4"
+	default:
+		return "6"
+	}
+}
+
+// startServers запускает серверы и ждёт, пока каждый либо начнёт слушать,
+// либо не сможет: остановить ещё не запущенный сервер нельзя.
+// Ошибки после запуска уходят в errCh.
+func startServers(servers []*miekg_dns.Server, wg *sync.WaitGroup, done <-chan struct{}, errCh chan<- error) error {
+	up := make(chan error, len(servers))
+	for _, srv := range servers {
+		var once sync.Once
+		report := func(err error) { once.Do(func() { up <- err }) }
+		srv.NotifyStartedFunc = func() { report(nil) }
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := srv.ListenAndServe()
+			report(err)
+			select {
+			case <-done:
+			default:
+				if err == nil {
+					err = errors.New(srv.Net + " " + srv.Addr + ": stopped")
+				}
+				errCh <- err
+			}
+		}()
+	}
+
+	var err error
+	for range servers {
+		if e := <-up; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func shutdownServers(servers []*miekg_dns.Server) {
+	for _, srv := range servers {
+		// Не запустившиеся вернут ошибку "server not started"
+		_ = srv.Shutdown()
+	}
+}
@@ -0,0 +1,185 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestIPFamily(t *testing.T) {
+	tests := map[string]string{
+		"127.0.0.1:53": "4",
+		"0.0.0.0:53":   "4",
+		"[::1]:53":     "6",
+		"[::]:53":      "6",
+		":53":          "",
+	}
+	for addr, want := range tests {
+		if got := ipFamily(addr); got != want {
+			t.Errorf("%s: family %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestDNSServers(t *testing.T) {
+	s, _ := newTestServer(t, `
+listeners:
+  - address: 127.0.0.1:5300
+    udp_sockets: 3
+  - address: "[::1]:5300"
+    protocols: [tcp]
+  - address: ":5301"
+    protocols: [udp]
+`)
+	var got []string
+	for _, srv := range s.dnsServers(nil) {
+		got = append(got, fmt.Sprintf("%s %s %v", srv.Net, srv.Addr, srv.ReusePort))
+	}
+	want := []string{
+		"udp4 127.0.0.1:5300 true", "udp4 127.0.0.1:5300 true", "udp4 127.0.0.1:5300 true",
+		"tcp4 127.0.0.1:5300 false",
+		"tcp6 [::1]:5300 false",
+		"udp :5301 false",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("servers:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// freePort - порт, свободный сейчас и для UDP, и для TCP
+func freePort(t *testing.T) string {
+	t.Helper()
+	for range 10 {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := pc.LocalAddr().String()
+		l, err := net.Listen("tcp4", addr)
+		pc.Close()
+		if err == nil {
+			l.Close()
+			return addr
+		}
+	}
+	t.Skip("no free port for UDP and TCP")
+	return ""
+}
+
+func TestRunListeners(t *testing.T) {
+	a, b := freePort(t), freePort(t)
+	s, _ := newTestServer(t, fmt.Sprintf(`
+listeners:
+  - address: %s
+    udp_sockets: 2
+  - address: %s
+records:
+  host.local: 192.0.2.7
+`, a, b))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	// Все слушатели отвечают по обоим протоколам
+	for _, addr := range []string{a, b} {
+		for _, proto := range []string{"udp", "tcp"} {
+			m := new(miekg_dns.Msg)
+			m.SetQuestion("host.local.", miekg_dns.TypeA)
+			c := &miekg_dns.Client{Net: proto, Timeout: time.Second}
+			var resp *miekg_dns.Msg
+			var err error
+			for range 20 {
+				if resp, _, err = c.Exchange(m, addr); err == nil {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if err != nil || len(resp.Answer) != 1 {
+				t.Errorf("%s %s: %v %v", proto, addr, resp, err)
+			}
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run after cancel: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run did not stop")
+	}
+}
+
+// Занятый порт одного слушателя - ошибка запуска, остальные останавливаются
+func TestRunListenerBusy(t *testing.T) {
+	busy, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free := freePort(t)
+
+	s, _ := newTestServer(t, fmt.Sprintf(`
+listeners:
+  - address: %s
+  - address: %s
+    protocols: [tcp]
+`, free, busy.Addr()))
+	done := make(chan error, 1)
+	go func() { done <- s.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Run started with a busy port")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run did not fail")
+	}
+
+	// Порт запустившегося слушателя освобождён
+	l, err := net.Listen("tcp4", free)
+	if err != nil {
+		t.Errorf("port of the started listener still taken: %v", err)
+	} else {
+		l.Close()
+	}
+}
+
+// Неожиданно остановившийся сервер сообщает об этом в errCh
+func TestStartServersStopped(t *testing.T) {
+	servers := []*miekg_dns.Server{
+		{Addr: freePort(t), Net: "udp4", Handler: miekg_dns.HandlerFunc(func(miekg_dns.ResponseWriter, *miekg_dns.Msg) {})},
+		{Addr: freePort(t), Net: "tcp4", Handler: miekg_dns.HandlerFunc(func(miekg_dns.ResponseWriter, *miekg_dns.Msg) {})},
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errCh := make(chan error, len(servers))
+	if err := startServers(servers, &wg, done, errCh); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = servers[0].Shutdown()
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), servers[0].Addr) {
+			t.Errorf("error %v, want the stopped server's address", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no error after an unexpected stop")
+	}
+
+	// Штатная остановка ошибок не даёт
+	close(done)
+	shutdownServers(servers)
+	wg.Wait()
+	if len(errCh) != 0 {
+		t.Errorf("error after shutdown: %v", <-errCh)
+	}
+}
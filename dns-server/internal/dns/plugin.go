@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Цепочка плагинов: запрос проходит звенья в порядке из конфига (plugins),
+// каждое либо отвечает само, либо передаёт запрос дальше через next.
+// Свои плагины регистрируются через RegisterPlugin до создания сервера.
+
+// Handler - остаток цепочки. ctx несёт дедлайн запроса и его ID для логов.
+type Handler interface {
+	ServeDNS(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg)
+}
+
+type HandlerFunc func(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg)
+
+func (f HandlerFunc) ServeDNS(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+	f(ctx, w, r)
+}
+
+// Plugin - звено цепочки обработки запросов с одним вопросом
+type Plugin interface {
+	ServeDNS(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler)
+}
+
+// PluginFunc позволяет использовать функцию как Plugin
+type PluginFunc func(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler)
+
+func (f PluginFunc) ServeDNS(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler) {
+	f(ctx, w, r, next)
+}
+
+// PluginFactory создаёт плагин для сервера; options - раздел plugin_options.<имя> из конфига
+type PluginFactory func(s *Server, options map[string]any) (Plugin, error)
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   = map[string]PluginFactory{
+		"acl":       newACL,
+		"blocklist": newBlocklist,
+		"rewrite":   builtin((*Server).serveRewrite),
+		"dns64":     builtin((*Server).serveDNS64),
+		"services":  builtin((*Server).serveServices),
+		"local":     builtin((*Server).serveLocal),
+		"cache":     builtin((*Server).serveCache),
+		"forward":   builtin((*Server).serveForward),
+	}
+)
+
+// RegisterPlugin добавляет плагин, который можно указать в plugins по имени
+func RegisterPlugin(name string, f PluginFactory) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	plugins[name] = f
+}
+
+func builtin(f func(*Server, context.Context, miekg_dns.ResponseWriter, *miekg_dns.Msg, Handler)) PluginFactory {
+	return func(s *Server, _ map[string]any) (Plugin, error) {
+		return PluginFunc(func(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler) {
+			f(s, ctx, w, r, next)
+		}), nil
+	}
+}
+
+type link struct {
+	plugin Plugin
+	next   Handler
+}
+
+func (l *link) ServeDNS(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+	l.plugin.ServeDNS(ctx, w, r, l.next)
+}
+
+// buildChain собирает цепочку с конца. Запрос, на который не ответил
+// ни один плагин, получает REFUSED.
+func (s *Server) buildChain(names []string, options map[string]map[string]any) (Handler, error) {
+	var h Handler = HandlerFunc(refuse)
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	for i := len(names) - 1; i >= 0; i-- {
+		f, ok := plugins[names[i]]
+		if !ok {
+			return nil, errors.New("unknown plugin: " + names[i])
+		}
+		p, err := f(s, options[names[i]])
+		if err != nil {
+			return nil, errors.New("plugin " + names[i] + ": " + err.Error())
+		}
+		h = &link{plugin: p, next: h}
+	}
+	return h, nil
+}
+
+func refuse(_ context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+	m := new(miekg_dns.Msg)
+	m.SetRcode(r, miekg_dns.RcodeRefused)
+	writeMsg(w, r, m)
+}
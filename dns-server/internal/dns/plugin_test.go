@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// tracePlugin записывает своё имя в trace и передаёт запрос дальше
+func tracePlugin(name string, trace *[]string) PluginFactory {
+	return func(_ *Server, options map[string]any) (Plugin, error) {
+		return PluginFunc(func(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler) {
+			*trace = append(*trace, name)
+			if options["answer"] == true {
+				m := new(miekg_dns.Msg)
+				m.SetReply(r)
+				writeMsg(w, r, m)
+				return
+			}
+			next.ServeDNS(ctx, w, r)
+		}), nil
+	}
+}
+
+func TestPluginChain(t *testing.T) {
+	var trace []string
+	for _, name := range []string{"trace-a", "trace-b", "trace-c"} {
+		RegisterPlugin(name, tracePlugin(name, &trace))
+	}
+	tests := []struct {
+		name    string
+		plugins []string
+		options map[string]map[string]any
+		trace   []string
+		rcode   int
+	}{
+		{name: "config order", plugins: []string{"trace-c", "trace-a", "trace-b"},
+			trace: []string{"trace-c", "trace-a", "trace-b"}, rcode: miekg_dns.RcodeRefused},
+		{name: "answer stops chain", plugins: []string{"trace-a", "trace-b", "trace-c"},
+			options: map[string]map[string]any{"trace-b": {"answer": true}},
+			trace:   []string{"trace-a", "trace-b"}},
+		{name: "empty chain", rcode: miekg_dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trace = nil
+			s := &Server{}
+			h, err := s.buildChain(tt.plugins, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := udpClient("192.0.2.10")
+			r := new(miekg_dns.Msg)
+			r.SetQuestion("chain.test.", miekg_dns.TypeA)
+			h.ServeDNS(context.Background(), w, r)
+			if !slices.Equal(trace, tt.trace) {
+				t.Errorf("trace %v, want %v", trace, tt.trace)
+			}
+			if w.msg == nil || w.msg.Rcode != tt.rcode {
+				t.Errorf("reply %v, want %s", w.msg, miekg_dns.RcodeToString[tt.rcode])
+			}
+		})
+	}
+}
+
+func TestPluginConfig(t *testing.T) {
+	load := func(yaml string) (*config.Config, error) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return config.Load(path)
+	}
+
+	cfg, err := load("listen: 127.0.0.1:0\nplugins: [local, nope]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(cfg); err == nil || !strings.Contains(err.Error(), "unknown plugin: nope") {
+		t.Errorf("NewServer with unknown plugin: %v", err)
+	}
+	if _, err := load("listen: 127.0.0.1:0\nplugins: [local, local]\n"); err == nil {
+		t.Error("duplicate plugin accepted")
+	}
+
+	// Порядок по умолчанию - копия, правка конфига не меняет DefaultPlugins
+	cfg, err = load("listen: 127.0.0.1:0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := slices.Clone(config.DefaultPlugins)
+	cfg.Plugins[0] = "changed"
+	if !slices.Equal(config.DefaultPlugins, want) {
+		t.Errorf("DefaultPlugins changed to %v", config.DefaultPlugins)
+	}
+}
+
+// Без forward запросы вне локальных данных получают REFUSED, а без cache не кешируются
+func TestChainWithoutForward(t *testing.T) {
+	s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+upstream: ["127.0.0.1:1"]
+plugins: [local]
+records:
+  host.local: 192.0.2.7
+`)
+	if s.cacheEnabled {
+		t.Error("cache enabled without cache plugin")
+	}
+	tests := []struct {
+		name  string
+		rcode int
+		rrs   int
+	}{
+		{name: "host.local.", rrs: 1},
+		{name: "example.test.", rcode: miekg_dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		w := udpClient("192.0.2.10")
+		r := new(miekg_dns.Msg)
+		r.SetQuestion(tt.name, miekg_dns.TypeA)
+		s.ServeDNS(w, r)
+		if w.msg == nil || w.msg.Rcode != tt.rcode || len(w.msg.Answer) != tt.rrs {
+			t.Errorf("%s: reply %v, want %s with %d records", tt.name, w.msg, miekg_dns.RcodeToString[tt.rcode], tt.rrs)
+		}
+	}
+	if len(s.cache) != 0 {
+		t.Errorf("%d cache entries without cache plugin", len(s.cache))
+	}
+}
@@ -0,0 +1,60 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/logging"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Prefetch: популярные записи обновляются в фоне, пока ещё не истекли,
+// чтобы клиенты не ждали апстрим
+
+func (s *Server) maybePrefetch(key string, entry *cacheEntry, now time.Time) {
+	cfg := s.cfg.Prefetch
+	if cfg.MinHits == 0 || entry.query == nil {
+		return
+	}
+	if entry.hits.Add(1) < cfg.MinHits {
+		return
+	}
+	if entry.expiry.Sub(now) > entry.ttl*time.Duration(cfg.ThresholdPercent)/100 {
+		return
+	}
+	if !entry.prefetching.CompareAndSwap(false, true) {
+		return
+	}
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.prefetch(key, entry)
+	}()
+}
+
+// prefetch идёт в фоне после ответа клиенту, поэтому со своим дедлайном и ID
+func (s *Server) prefetch(key string, entry *cacheEntry) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.QueryTimeout)
+	defer cancel()
+	ctx = logging.WithID(ctx, newQueryID())
+	log := logging.Ctx(ctx)
+
+	query := entry.query.Copy()
+	query.Id = miekg_dns.Id()
+
+	resp, err := s.exchange(ctx, query, entry.upstreams)
+	if err != nil {
+		log.Warnf("prefetch %s failed: %v", key, err)
+		entry.prefetching.Store(false)
+		return
+	}
+	if ok, why := s.validate(ctx, query, resp); !ok {
+		log.Warnf("prefetch %s: DNSSEC bogus: %s", key, why)
+		entry.prefetching.Store(false)
+		return
+	}
+	s.filterRebinding(ctx, resp)
+	s.store(key, entry.query, entry.upstreams, resp)
+	s.stats.prefetches.Add(1)
+	log.Debugf("prefetched %s", key)
+}
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestPrefetch(t *testing.T) {
+	var queries atomic.Int32
+	var fail atomic.Bool
+	addr := serveTest(t, miekg_dns.HandlerFunc(func(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+		queries.Add(1)
+		if fail.Load() {
+			return // клиент не дождётся ответа
+		}
+		m := new(miekg_dns.Msg)
+		m.SetReply(r)
+		m.Answer = []miekg_dns.RR{testRR("%s 300 IN A 192.0.2.2", r.Question[0].Name)}
+		_ = w.WriteMsg(m)
+	}), nil)
+
+	tests := []struct {
+		name     string
+		minHits  uint32
+		hits     int           // обращений к записи
+		left     time.Duration // сколько записи осталось жить
+		inFlight bool
+		fail     bool
+		fetched  bool
+	}{
+		{name: "popular and expiring", minHits: 2, hits: 2, left: 20 * time.Second, fetched: true},
+		{name: "not enough hits", minHits: 2, hits: 1, left: 20 * time.Second},
+		{name: "far from expiry", minHits: 2, hits: 5, left: 200 * time.Second},
+		{name: "already prefetching", minHits: 2, hits: 2, left: 20 * time.Second, inFlight: true},
+		{name: "disabled", hits: 5, left: 20 * time.Second},
+		{name: "upstream failed", minHits: 1, hits: 1, left: 20 * time.Second, fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+ttl: 300
+query_timeout: 200ms
+prefetch:
+  min_hits: `+strconv.Itoa(int(tt.minHits))+`
+  threshold_percent: 10
+`)
+			defer s.pools.close()
+			queries.Store(0)
+			fail.Store(tt.fail)
+
+			r := new(miekg_dns.Msg)
+			r.SetQuestion("popular.test.", miekg_dns.TypeA)
+			key := s.cacheKey(r)
+			// Запрос без апстримов пошёл бы в рекурсию
+			s.store(key, r, []string{addr}, cachedReply("popular.test.", 300))
+			entry := s.cache[key]
+			now := time.Now()
+			entry.expiry = now.Add(tt.left)
+			entry.prefetching.Store(tt.inFlight)
+
+			for range tt.hits {
+				s.maybePrefetch(key, entry, now)
+			}
+			s.background.Wait()
+
+			if n := queries.Load(); (n > 0) != (tt.fetched || tt.fail) {
+				t.Errorf("%d upstream queries", n)
+			}
+			refreshed := s.cache[key] != entry
+			if refreshed != tt.fetched {
+				t.Errorf("entry refreshed %v, want %v", refreshed, tt.fetched)
+			}
+			if tt.fetched {
+				if s.stats.prefetches.Load() != 1 || time.Until(s.cache[key].expiry) < 250*time.Second {
+					t.Errorf("prefetches %d, new expiry %v", s.stats.prefetches.Load(), s.cache[key].expiry)
+				}
+				return
+			}
+			// После неудачи следующая попытка снова возможна
+			if entry.prefetching.Load() != tt.inFlight {
+				t.Errorf("prefetching flag %v, want %v", entry.prefetching.Load(), tt.inFlight)
+			}
+		})
+	}
+}
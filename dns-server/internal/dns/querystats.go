@@ -0,0 +1,200 @@
+package dns
+
+import (
+	"cmp"
+	"dns-server/internal/config"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Статистика запросов за скользящее окно для API /stats/queries: помогает
+// найти клиентов, засыпающих сервер запросами. Окно поделено на интервалы,
+// устаревший интервал обнуляется при первой записи в него.
+
+const (
+	statsBuckets = 10
+	otherKey     = "(other)"
+)
+
+type statsBucket struct {
+	epoch     int64 // номер интервала от начала эпохи Unix
+	total     uint64
+	rcodes    map[int]uint64
+	names     map[string]uint64
+	clients   map[string]uint64
+	nxClients map[string]uint64
+	blocked   map[string]uint64
+}
+
+type queryStats struct {
+	cfg      config.QueryStatsConfig
+	interval time.Duration
+
+	mu      sync.Mutex
+	buckets [statsBuckets]statsBucket
+}
+
+func newQueryStats(cfg config.QueryStatsConfig) *queryStats {
+	return &queryStats{cfg: cfg, interval: cfg.Window / statsBuckets}
+}
+
+// bucket - интервал для момента now; вызывать под mu
+func (qs *queryStats) bucket(now time.Time) *statsBucket {
+	epoch := now.UnixNano() / int64(qs.interval)
+	b := &qs.buckets[epoch%statsBuckets]
+	if b.epoch != epoch {
+		*b = statsBucket{
+			epoch:     epoch,
+			rcodes:    make(map[int]uint64),
+			names:     make(map[string]uint64),
+			clients:   make(map[string]uint64),
+			nxClients: make(map[string]uint64),
+			blocked:   make(map[string]uint64),
+		}
+	}
+	return b
+}
+
+// count увеличивает счётчик key; новые ключи сверх max_keys идут в (other),
+// чтобы поток случайных имён не раздувал память
+func (qs *queryStats) count(m map[string]uint64, key string) {
+	if _, ok := m[key]; !ok && len(m) >= qs.cfg.MaxKeys {
+		key = otherKey
+	}
+	m[key]++
+}
+
+func (qs *queryStats) record(client, name string, rcode int) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	b := qs.bucket(time.Now())
+	b.total++
+	b.rcodes[rcode]++
+	qs.count(b.names, name)
+	qs.count(b.clients, client)
+	if rcode == miekg_dns.RcodeNameError {
+		qs.count(b.nxClients, client)
+	}
+}
+
+func (qs *queryStats) recordBlocked(name string) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qs.count(qs.bucket(time.Now()).blocked, name)
+}
+
+type statsEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+type queryStatsReport struct {
+	Window      string            `json:"window"`
+	Queries     uint64            `json:"queries"`
+	Rcodes      map[string]uint64 `json:"rcodes"`
+	TopNames    []statsEntry      `json:"top_names"`
+	TopClients  []statsEntry      `json:"top_clients"`
+	TopNXDomain []statsEntry      `json:"top_nxdomain_clients"`
+	TopBlocked  []statsEntry      `json:"top_blocked"`
+}
+
+// report сводит интервалы окна и оставляет top самых частых ключей
+func (qs *queryStats) report(top int) queryStatsReport {
+	names := make(map[string]uint64)
+	clients := make(map[string]uint64)
+	nxClients := make(map[string]uint64)
+	blocked := make(map[string]uint64)
+	rep := queryStatsReport{Window: qs.cfg.Window.String(), Rcodes: make(map[string]uint64)}
+
+	qs.mu.Lock()
+	current := time.Now().UnixNano() / int64(qs.interval)
+	for i := range qs.buckets {
+		b := &qs.buckets[i]
+		if b.epoch <= current-statsBuckets || b.rcodes == nil {
+			continue
+		}
+		rep.Queries += b.total
+		for rcode, n := range b.rcodes {
+			rep.Rcodes[rcodeName(rcode)] += n
+		}
+		for _, pair := range []struct{ to, from map[string]uint64 }{
+			{names, b.names}, {clients, b.clients}, {nxClients, b.nxClients}, {blocked, b.blocked},
+		} {
+			for k, n := range pair.from {
+				pair.to[k] += n
+			}
+		}
+	}
+	qs.mu.Unlock()
+
+	rep.TopNames = topN(names, top)
+	rep.TopClients = topN(clients, top)
+	rep.TopNXDomain = topN(nxClients, top)
+	rep.TopBlocked = topN(blocked, top)
+	return rep
+}
+
+func rcodeName(rcode int) string {
+	if s, ok := miekg_dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return strconv.Itoa(rcode)
+}
+
+func topN(m map[string]uint64, n int) []statsEntry {
+	out := make([]statsEntry, 0, len(m))
+	for k, c := range m {
+		out = append(out, statsEntry{Key: k, Count: c})
+	}
+	slices.SortFunc(out, func(a, b statsEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return out[:min(n, len(out))]
+}
+
+// statsWriter запоминает код ответа, отправленного клиенту
+type statsWriter struct {
+	miekg_dns.ResponseWriter
+	rcode   int
+	written bool
+}
+
+func (sw *statsWriter) WriteMsg(m *miekg_dns.Msg) error {
+	sw.rcode, sw.written = m.Rcode, true
+	return sw.ResponseWriter.WriteMsg(m)
+}
+
+// clientIP - адрес клиента без порта
+func clientIP(w miekg_dns.ResponseWriter) string {
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return w.RemoteAddr().String()
+	}
+	return host
+}
+
+func (s *Server) handleQueryStats(w http.ResponseWriter, r *http.Request) {
+	if s.queryStats == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "query_stats is not enabled"})
+		return
+	}
+	top := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid top: " + v})
+			return
+		}
+		top = n
+	}
+	writeJSON(w, http.StatusOK, s.queryStats.report(top))
+}
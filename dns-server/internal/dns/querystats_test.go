@@ -0,0 +1,122 @@
+package dns
+
+import (
+	"dns-server/internal/config"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestQueryStatsReport(t *testing.T) {
+	qs := newQueryStats(config.QueryStatsConfig{Enabled: true, Window: 10 * time.Second, MaxKeys: 3})
+	for range 3 {
+		qs.record("192.0.2.1", "a.test.", miekg_dns.RcodeSuccess)
+	}
+	qs.record("192.0.2.2", "b.test.", miekg_dns.RcodeNameError)
+	qs.record("192.0.2.2", "c.test.", miekg_dns.RcodeNameError)
+	qs.record("192.0.2.3", "c.test.", miekg_dns.RcodeServerFailure)
+	// Новые ключи сверх max_keys идут в (other)
+	qs.record("192.0.2.4", "d.test.", miekg_dns.RcodeSuccess)
+	qs.record("192.0.2.5", "e.test.", 4000)
+	qs.recordBlocked("ads.test.")
+	qs.recordBlocked("ads.test.")
+
+	rep := qs.report(2)
+	if rep.Queries != 8 || rep.Window != "10s" {
+		t.Errorf("queries %d in %s, want 8 in 10s", rep.Queries, rep.Window)
+	}
+	wantRcodes := map[string]uint64{"NOERROR": 4, "NXDOMAIN": 2, "SERVFAIL": 1, "4000": 1}
+	for k, v := range wantRcodes {
+		if rep.Rcodes[k] != v {
+			t.Errorf("rcodes %v, want %v", rep.Rcodes, wantRcodes)
+			break
+		}
+	}
+	tests := []struct {
+		name string
+		got  []statsEntry
+		want []statsEntry
+	}{
+		// При равенстве счётчиков - по алфавиту, (other) раньше c.test. и 192.0.2.2
+		{name: "names", got: rep.TopNames, want: []statsEntry{{"a.test.", 3}, {otherKey, 2}}},
+		{name: "clients", got: rep.TopClients, want: []statsEntry{{"192.0.2.1", 3}, {otherKey, 2}}},
+		{name: "nxdomain clients", got: rep.TopNXDomain, want: []statsEntry{{"192.0.2.2", 2}}},
+		{name: "blocked", got: rep.TopBlocked, want: []statsEntry{{"ads.test.", 2}}},
+	}
+	for _, tt := range tests {
+		if !slices.Equal(tt.got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if all := qs.report(10).TopNames; !slices.Contains(all, statsEntry{otherKey, 2}) || len(all) != 4 {
+		t.Errorf("names beyond max_keys: %v, want 3 names and (other)", all)
+	}
+}
+
+func TestQueryStatsWindow(t *testing.T) {
+	qs := newQueryStats(config.QueryStatsConfig{Enabled: true, Window: 10 * time.Second, MaxKeys: 100})
+	now := time.Now()
+
+	// Интервал старше окна в отчёт не попадает
+	qs.mu.Lock()
+	old := qs.bucket(now.Add(-15 * time.Second))
+	old.total, old.names["old.test."] = 5, 5
+	qs.mu.Unlock()
+	qs.record("192.0.2.1", "new.test.", miekg_dns.RcodeSuccess)
+	if rep := qs.report(10); rep.Queries != 1 || len(rep.TopNames) != 1 {
+		t.Errorf("report %+v, want only the current query", rep)
+	}
+
+	// Тот же интервал через окно начинается с нуля
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	b := qs.bucket(now)
+	b.total = 7
+	if again := qs.bucket(now.Add(10 * time.Second)); again != b || again.total != 0 {
+		t.Errorf("bucket reused with %d queries, want a reset", again.total)
+	}
+}
+
+func TestQueryStatsAPI(t *testing.T) {
+	s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+query_stats:
+  enabled: true
+blocklist:
+  domains: [ads.test]
+records:
+  host.local: 192.0.2.7
+`)
+	for _, name := range []string{"host.local.", "host.local.", "ads.test."} {
+		r := new(miekg_dns.Msg)
+		r.SetQuestion(name, miekg_dns.TypeA)
+		s.ServeDNS(udpClient("192.0.2.10"), r)
+	}
+
+	rec := adminRequest(s, http.MethodGet, "/stats/queries?top=1", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/stats/queries: %d %s", rec.Code, rec.Body)
+	}
+	var rep queryStatsReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Queries != 3 || rep.Rcodes["NXDOMAIN"] != 1 ||
+		!slices.Equal(rep.TopNames, []statsEntry{{"host.local.", 2}}) ||
+		!slices.Equal(rep.TopClients, []statsEntry{{"192.0.2.10", 3}}) ||
+		!slices.Equal(rep.TopBlocked, []statsEntry{{"ads.test.", 1}}) {
+		t.Errorf("report %+v", rep)
+	}
+
+	if rec := adminRequest(s, http.MethodGet, "/stats/queries?top=0", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("top=0: %d, want 400", rec.Code)
+	}
+	off, _ := newTestServer(t, "listen: 127.0.0.1:0\n")
+	if rec := adminRequest(off, http.MethodGet, "/stats/queries", ""); rec.Code != http.StatusNotImplemented {
+		t.Errorf("disabled stats: %d, want 501", rec.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"dns-server/internal/logging"
+	"net"
+	"strings"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Защита от DNS rebinding: ответы апстримов, где публичное имя указывает
+// на внутренний адрес, очищаются от таких адресов или заменяются отказом
+
+// internalIP - адреса, недоступные из интернета: RFC 1918, fc00::/7,
+// loopback, link-local и неопределённый адрес
+func internalIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// rebindingAllowed - имя из домена, которому разрешены внутренние адреса
+func (s *Server) rebindingAllowed(name string) bool {
+	for _, domain := range s.cfg.Rebinding.Allow {
+		if miekg_dns.IsSubDomain(domain, strings.ToLower(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRebinding применяет защиту к ответу апстрима перед кешированием.
+// Записи проверяются по имени запроса: CNAME с публичного имени на разрешённое
+// внутреннее имя тоже считается попыткой rebinding.
+func (s *Server) filterRebinding(ctx context.Context, resp *miekg_dns.Msg) {
+	cfg := s.cfg.Rebinding
+	if !cfg.Enabled || len(resp.Question) != 1 || s.rebindingAllowed(resp.Question[0].Name) {
+		return
+	}
+
+	blocked := make(map[rrsetKey]bool)
+	answer := resp.Answer[:0]
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *miekg_dns.A:
+			ip = rr.A
+		case *miekg_dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip != nil && internalIP(ip) {
+			blocked[rrsetKey{miekg_dns.CanonicalName(rr.Header().Name), rr.Header().Rrtype}] = true
+			logging.Ctx(ctx).Warnf("rebinding: %s -> %s blocked", resp.Question[0].Name, ip)
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	if len(blocked) == 0 {
+		return
+	}
+
+	if cfg.Action == config.RebindingRefuse {
+		resp.Rcode = miekg_dns.RcodeRefused
+		resp.Answer, resp.Ns = nil, nil
+		resp.AuthenticatedData = false
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if opt, ok := rr.(*miekg_dns.OPT); ok {
+				extra = append(extra, opt)
+			}
+		}
+		resp.Extra = extra
+		if resp.IsEdns0() == nil {
+			resp.SetEdns0(ednsUDPSize, false)
+		}
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &miekg_dns.EDNS0_EDE{
+			InfoCode:  miekg_dns.ExtendedErrorCodeBlocked,
+			ExtraText: "DNS rebinding",
+		})
+		return
+	}
+
+	// Подписи урезанных наборов больше не сходятся, и ответ уже не тот,
+	// что проверил валидатор
+	resp.AuthenticatedData = false
+	resp.Answer = answer[:0]
+	for _, rr := range answer {
+		if sig, ok := rr.(*miekg_dns.RRSIG); ok && blocked[rrsetKey{miekg_dns.CanonicalName(sig.Hdr.Name), sig.TypeCovered}] {
+			continue
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+}
@@ -0,0 +1,29 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"testing"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestFilterRebindingStrip(t *testing.T) {
+	s := &Server{cfg: &config.Config{Rebinding: config.RebindingConfig{Enabled: true, Action: config.RebindingStrip}}}
+	resp := new(miekg_dns.Msg)
+	resp.SetQuestion("www.example.test.", miekg_dns.TypeA)
+	resp.AuthenticatedData = true
+	resp.Answer = []miekg_dns.RR{
+		testRR("www.example.test. 300 IN A 192.0.2.10"),
+		testRR("www.example.test. 300 IN A 10.0.0.1"),
+		testRR("www.example.test. 300 IN RRSIG A 13 3 300 20300101000000 20200101000000 1 example.test. AAAA"),
+	}
+	s.filterRebinding(context.Background(), resp)
+
+	if resp.AuthenticatedData {
+		t.Error("AD set on stripped answer")
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*miekg_dns.A).A.String() != "192.0.2.10" {
+		t.Errorf("answer %v, want only 192.0.2.10", resp.Answer)
+	}
+}
@@ -0,0 +1,118 @@
+package dns
+
+import (
+	"dns-server/internal/config"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Адреса из records: несколько IP на имя с ротацией порядка в ответах
+
+type weightedIP struct {
+	ip     net.IP
+	weight uint32
+
+	// Состояние health check, без проверки адрес всегда здоров
+	healthy atomic.Bool
+	streak  int
+}
+
+type recordSet struct {
+	name   string
+	policy string
+	v4, v6 []*weightedIP
+	next   atomic.Uint32
+
+	check *config.HealthCheckConfig
+}
+
+func newRecordSets(records map[string]config.RecordSet) map[string]*recordSet {
+	sets := make(map[string]*recordSet, len(records))
+	for name, rc := range records {
+		rs := &recordSet{name: name, policy: rc.Policy, check: rc.HealthCheck}
+		for _, a := range rc.Addresses {
+			t := &weightedIP{ip: net.ParseIP(a.IP), weight: a.Weight}
+			t.healthy.Store(true)
+			if ip4 := t.ip.To4(); ip4 != nil {
+				t.ip = ip4
+				rs.v4 = append(rs.v4, t)
+			} else {
+				rs.v6 = append(rs.v6, t)
+			}
+		}
+		sets[name] = rs
+	}
+	return sets
+}
+
+// addresses возвращает адреса нужного семейства в порядке для этого запроса
+func (rs *recordSet) addresses(qtype uint16) []net.IP {
+	addrs := rs.v4
+	if qtype == miekg_dns.TypeAAAA {
+		addrs = rs.v6
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	// Недоступные адреса не отдаём; если недоступны все - отдаём все
+	var up []*weightedIP
+	for _, a := range addrs {
+		if a.healthy.Load() {
+			up = append(up, a)
+		}
+	}
+	if len(up) > 0 {
+		addrs = up
+	}
+
+	out := make([]net.IP, 0, len(addrs))
+	switch rs.policy {
+	case config.PolicyFixed:
+		for _, a := range addrs {
+			out = append(out, a.ip)
+		}
+	case config.PolicyWeighted:
+		// Случайный порядок: шанс оказаться следующим пропорционален весу
+		left := append([]*weightedIP{}, addrs...)
+		for len(left) > 0 {
+			var total uint64
+			for _, a := range left {
+				total += uint64(a.weight)
+			}
+			n := rand.Uint64N(total)
+			i := 0
+			for ; n >= uint64(left[i].weight); i++ {
+				n -= uint64(left[i].weight)
+			}
+			out = append(out, left[i].ip)
+			left = append(left[:i], left[i+1:]...)
+		}
+	default:
+		start := int(rs.next.Add(1)-1) % len(addrs)
+		for i := range addrs {
+			out = append(out, addrs[(start+i)%len(addrs)].ip)
+		}
+	}
+	return out
+}
+
+func (s *Server) answerFromRecords(w miekg_dns.ResponseWriter, r *miekg_dns.Msg, ips []net.IP) {
+	q := r.Question[0]
+	msg := new(miekg_dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+
+	hdr := miekg_dns.RR_Header{Name: miekg_dns.CanonicalName(q.Name), Rrtype: q.Qtype, Class: miekg_dns.ClassINET, Ttl: s.cfg.TTL}
+	for _, ip := range ips {
+		if q.Qtype == miekg_dns.TypeAAAA {
+			msg.Answer = append(msg.Answer, &miekg_dns.AAAA{Hdr: hdr, AAAA: ip})
+		} else {
+			msg.Answer = append(msg.Answer, &miekg_dns.A{Hdr: hdr, A: ip})
+		}
+	}
+	writeMsg(w, r, msg)
+}
@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"slices"
+	"testing"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func newRecordsServer(t *testing.T) *Server {
+	t.Helper()
+	s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+records:
+  single.local: 10.0.0.1
+  rr.local:
+    - 10.0.0.11
+    - 10.0.0.12
+    - 10.0.0.13
+    - 2001:db8::11
+  fixed.local:
+    policy: fixed
+    addresses: [10.0.0.21, 10.0.0.22, 10.0.0.23]
+  weighted.local:
+    policy: weighted
+    addresses:
+      - ip: 10.0.0.31
+        weight: 9
+      - ip: 10.0.0.32
+`)
+	return s
+}
+
+// recordsAnswer возвращает адреса из ответа в порядке выдачи
+func recordsAnswer(t *testing.T, s *Server, name string, qtype uint16) []string {
+	t.Helper()
+	r := new(miekg_dns.Msg)
+	r.SetQuestion(name, qtype)
+	w := udpClient("192.0.2.10")
+	s.ServeDNS(w, r)
+	if w.msg == nil || w.msg.Rcode != miekg_dns.RcodeSuccess || !w.msg.Authoritative {
+		t.Fatalf("%s: reply %v", name, w.msg)
+	}
+	var out []string
+	for _, rr := range w.msg.Answer {
+		switch rr := rr.(type) {
+		case *miekg_dns.A:
+			out = append(out, rr.A.String())
+		case *miekg_dns.AAAA:
+			out = append(out, rr.AAAA.String())
+		}
+	}
+	return out
+}
+
+func TestRecordsFamilies(t *testing.T) {
+	s := newRecordsServer(t)
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  int
+	}{
+		{name: "single.local.", qtype: miekg_dns.TypeA, want: 1},
+		{name: "rr.local.", qtype: miekg_dns.TypeA, want: 3},
+		{name: "rr.local.", qtype: miekg_dns.TypeAAAA, want: 1},
+		// Нет адресов нужного семейства - NODATA, а не апстрим
+		{name: "single.local.", qtype: miekg_dns.TypeAAAA, want: 0},
+	}
+	for _, tt := range tests {
+		if got := recordsAnswer(t, s, tt.name, tt.qtype); len(got) != tt.want {
+			t.Errorf("%s %s: %v, want %d addresses", tt.name, miekg_dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	s := newRecordsServer(t)
+	var firsts []string
+	for range 4 {
+		got := recordsAnswer(t, s, "rr.local.", miekg_dns.TypeA)
+		if len(got) != 3 {
+			t.Fatalf("answer %v, want all 3 addresses", got)
+		}
+		firsts = append(firsts, got[0])
+	}
+	want := []string{"10.0.0.11", "10.0.0.12", "10.0.0.13", "10.0.0.11"}
+	if !slices.Equal(firsts, want) {
+		t.Errorf("first addresses %v, want %v", firsts, want)
+	}
+}
+
+func TestFixedOrder(t *testing.T) {
+	s := newRecordsServer(t)
+	want := []string{"10.0.0.21", "10.0.0.22", "10.0.0.23"}
+	for range 3 {
+		if got := recordsAnswer(t, s, "fixed.local.", miekg_dns.TypeA); !slices.Equal(got, want) {
+			t.Fatalf("answer %v, want %v", got, want)
+		}
+	}
+}
+
+func TestWeightedOrder(t *testing.T) {
+	s := newRecordsServer(t)
+	const runs = 2000
+	heavy := 0
+	for range runs {
+		got := recordsAnswer(t, s, "weighted.local.", miekg_dns.TypeA)
+		if len(got) != 2 {
+			t.Fatalf("answer %v, want both addresses", got)
+		}
+		if got[0] == "10.0.0.31" {
+			heavy++
+		}
+	}
+	// Вес 9 против 1: первым примерно в 90% ответов
+	if heavy < runs*80/100 || heavy > runs*97/100 {
+		t.Errorf("heavy address first in %d of %d answers, want about 90%%", heavy, runs)
+	}
+}
@@ -0,0 +1,341 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"dns-server/internal/logging"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Рекурсивный режим: итеративное разрешение от корневых серверов по
+// делегированиям, с минимизацией QNAME (RFC 9156) и своим кешем делегирований
+
+const (
+	maxSteps     = 40 // запросов к серверам на одно имя
+	maxMinimised = 10 // минимизированных запросов, дальше спрашиваем имя целиком
+	maxCNAMEs    = 10
+	maxDepth     = 4 // вложенность разрешения имён NS без glue
+
+	maxDelegations = 10000 // зон в кеше делегирований
+)
+
+var errNoServers = errors.New("no reachable name servers")
+
+// delegation - адреса серверов зоны из кеша делегирований
+type delegation struct {
+	servers []string
+	expiry  time.Time
+}
+
+type resolver struct {
+	s        *Server
+	hints    []string
+	minimise bool
+	nsPort   string // порт серверов из glue и имён NS
+
+	mu    sync.RWMutex
+	zones map[string]*delegation
+}
+
+func newResolver(s *Server, cfg config.RecursiveConfig) *resolver {
+	return &resolver{
+		s:        s,
+		hints:    cfg.RootHints,
+		minimise: !cfg.DisableQnameMinimisation,
+		nsPort:   "53",
+		zones:    make(map[string]*delegation),
+	}
+}
+
+// resolve отвечает на запрос m так, как ответил бы рекурсивный апстрим
+func (r *resolver) resolve(ctx context.Context, m *miekg_dns.Msg) (*miekg_dns.Msg, error) {
+	opt := m.IsEdns0()
+	do := opt != nil && opt.Do()
+	q := m.Question[0]
+	resp, err := r.lookup(ctx, q.Name, q.Qtype, do, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Id = m.Id
+	resp.Question = []miekg_dns.Question{q}
+	resp.RecursionDesired = m.RecursionDesired
+	resp.RecursionAvailable = true
+	resp.Authoritative = false
+	resp.AuthenticatedData = false
+	resp.Extra = nil
+	if opt != nil {
+		resp.SetEdns0(ednsUDPSize, do)
+	}
+	return resp, nil
+}
+
+// lookup разрешает имя, следуя по цепочке CNAME. Записи цепочки из чужой
+// зоны не принимаются - цель CNAME разрешается заново.
+func (r *resolver) lookup(ctx context.Context, name string, qtype uint16, do bool, depth int) (*miekg_dns.Msg, error) {
+	if depth > maxDepth {
+		return nil, errors.New("name server resolution too deep: " + name)
+	}
+	var chain []miekg_dns.RR
+	name = miekg_dns.CanonicalName(name)
+	for range maxCNAMEs {
+		resp, zone, err := r.iterate(ctx, name, qtype, do, depth)
+		if err != nil {
+			return nil, err
+		}
+		next, rrs := followChain(resp.Answer, name, qtype, zone)
+		chain = append(chain, rrs...)
+		if next == "" {
+			resp.Answer = chain
+			return resp, nil
+		}
+		name = next
+	}
+	return nil, errors.New("CNAME chain too long: " + name)
+}
+
+// iterate спрашивает серверы от ближайшего известного делегирования вниз,
+// пока не получит ответ не-делегирование на полное имя.
+// Возвращает ответ и зону, серверы которой его дали.
+func (r *resolver) iterate(ctx context.Context, name string, qtype uint16, do bool, depth int) (*miekg_dns.Msg, string, error) {
+	// DS хранится в родительской зоне (RFC 4035, 4.2)
+	from := name
+	if qtype == miekg_dns.TypeDS && name != "." {
+		idx, _ := miekg_dns.NextLabel(name, 0)
+		from = name[idx:]
+	}
+	zone, servers := r.closest(from)
+	minimise, minimised := r.minimise, 0
+	known := miekg_dns.CountLabel(zone) + 1
+	total := miekg_dns.CountLabel(name)
+
+	for range maxSteps {
+		qname, qt := name, qtype
+		if minimise && known < total {
+			// Раскрываем серверу зоны по одной метке сверх её имени
+			idx, _ := miekg_dns.PrevLabel(name, known)
+			qname, qt = name[idx:], miekg_dns.TypeNS
+			minimised++
+		}
+
+		resp, err := r.ask(ctx, servers, zone, qname, qt, do)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if child, ns, ttl := referral(resp, zone, qname); child != "" {
+			servers, err = r.delegate(ctx, child, ns, ttl, resp.Extra, depth)
+			if err != nil {
+				return nil, "", err
+			}
+			zone = child
+			known = miekg_dns.CountLabel(zone) + 1
+			continue
+		}
+
+		if qname != name {
+			// Серверы, отвечающие на промежуточные имена ошибкой, спрашиваем
+			// полным именем (RFC 9156, 2.3)
+			if resp.Rcode != miekg_dns.RcodeSuccess || minimised >= maxMinimised {
+				minimise = false
+			} else {
+				known++
+			}
+			continue
+		}
+		return resp, zone, nil
+	}
+	return nil, "", errors.New("too many referrals: " + name)
+}
+
+// closest - ближайшее известное делегирование для имени, иначе корень
+func (r *resolver) closest(name string) (string, []string) {
+	now := time.Now()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for off, end := 0, false; !end; off, end = miekg_dns.NextLabel(name, off) {
+		if d, ok := r.zones[name[off:]]; ok && now.Before(d.expiry) {
+			return name[off:], d.servers
+		}
+	}
+	return ".", r.hints
+}
+
+// ask отправляет нерекурсивный запрос серверам зоны по очереди.
+// Из ответа убираются записи вне зоны.
+func (r *resolver) ask(ctx context.Context, servers []string, zone, qname string, qtype uint16, do bool) (*miekg_dns.Msg, error) {
+	m := new(miekg_dns.Msg)
+	m.SetQuestion(qname, qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(ednsUDPSize, do)
+
+	err := errNoServers
+	for i, ns := range servers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var resp *miekg_dns.Msg
+		resp, err = r.s.exchangeOne(ctx, m, ns, len(servers)-i)
+		if err != nil {
+			continue
+		}
+		switch resp.Rcode {
+		case miekg_dns.RcodeSuccess, miekg_dns.RcodeNameError:
+		default:
+			err = errors.New(ns + ": " + miekg_dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		if n := scrub(resp, zone); n > 0 {
+			logging.Ctx(ctx).Debugf("%s: dropped %d out-of-bailiwick records: %s", ns, n, qname)
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// referral - дочерняя зона и её NS, если ответ - делегирование ниже zone
+// к qname. Делегирование в сторону от qname не принимается: иначе сервер
+// мог бы подсунуть в кеш серверы чужой зоны.
+func referral(resp *miekg_dns.Msg, zone, qname string) (string, []string, uint32) {
+	if resp.Rcode != miekg_dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return "", nil, 0
+	}
+	var child string
+	var names []string
+	var ttl uint32
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*miekg_dns.NS)
+		if !ok {
+			continue
+		}
+		owner := miekg_dns.CanonicalName(ns.Hdr.Name)
+		if owner == zone || !miekg_dns.IsSubDomain(zone, owner) || !miekg_dns.IsSubDomain(owner, qname) {
+			continue
+		}
+		if child == "" {
+			child, ttl = owner, ns.Hdr.Ttl
+		}
+		if owner == child {
+			names = append(names, miekg_dns.CanonicalName(ns.Ns))
+			ttl = min(ttl, ns.Hdr.Ttl)
+		}
+	}
+	return child, names, ttl
+}
+
+// delegate находит адреса серверов дочерней зоны (из glue или разрешая
+// имена NS) и запоминает их на TTL записей NS
+func (r *resolver) delegate(ctx context.Context, child string, names []string, ttl uint32, extra []miekg_dns.RR, depth int) ([]string, error) {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var servers []string
+	for _, rr := range extra {
+		if !wanted[miekg_dns.CanonicalName(rr.Header().Name)] {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *miekg_dns.A:
+			servers = append(servers, net.JoinHostPort(rr.A.String(), r.nsPort))
+		case *miekg_dns.AAAA:
+			servers = append(servers, net.JoinHostPort(rr.AAAA.String(), r.nsPort))
+		}
+	}
+
+	if len(servers) == 0 {
+		for _, name := range names {
+			// Имя NS внутри самой зоны без glue не разрешить
+			if miekg_dns.IsSubDomain(child, name) {
+				continue
+			}
+			resp, err := r.lookup(ctx, name, miekg_dns.TypeA, false, depth+1)
+			if err != nil {
+				continue
+			}
+			for _, rr := range resp.Answer {
+				if a, ok := rr.(*miekg_dns.A); ok {
+					servers = append(servers, net.JoinHostPort(a.A.String(), r.nsPort))
+				}
+			}
+			if len(servers) > 0 {
+				break
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no addresses for name servers of " + child)
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	if _, ok := r.zones[child]; !ok && len(r.zones) >= maxDelegations {
+		r.evict(now)
+	}
+	r.zones[child] = &delegation{servers: servers, expiry: now.Add(time.Duration(ttl) * time.Second)}
+	r.mu.Unlock()
+	return servers, nil
+}
+
+// evict освобождает место в кеше делегирований: убирает истёкшие записи,
+// а если их не нашлось - случайную четверть. Вызывать под mu.
+func (r *resolver) evict(now time.Time) {
+	for zone, d := range r.zones {
+		if !now.Before(d.expiry) {
+			delete(r.zones, zone)
+		}
+	}
+	if len(r.zones) < maxDelegations {
+		return
+	}
+	for zone := range r.zones {
+		if len(r.zones) < maxDelegations*3/4 {
+			break
+		}
+		delete(r.zones, zone)
+	}
+}
+
+// followChain выбирает из answer записи для name: сами данные или CNAME.
+// Цепочка продолжается по answer, пока цель CNAME в зоне zone.
+// next - цель CNAME, которую надо разрешать заново.
+func followChain(answer []miekg_dns.RR, name string, qtype uint16, zone string) (string, []miekg_dns.RR) {
+	var rrs []miekg_dns.RR
+	cur := name
+	for range len(answer) + 1 {
+		var target string
+		found := false
+		for _, rr := range answer {
+			if miekg_dns.CanonicalName(rr.Header().Name) != cur {
+				continue
+			}
+			switch t := coveredType(rr); {
+			case t == qtype || qtype == miekg_dns.TypeANY:
+				rrs = append(rrs, rr)
+				found = true
+			case t == miekg_dns.TypeCNAME:
+				rrs = append(rrs, rr)
+				if cname, ok := rr.(*miekg_dns.CNAME); ok {
+					target = miekg_dns.CanonicalName(cname.Target)
+				}
+			}
+		}
+		if found || target == "" {
+			// Цели CNAME в ответе нет - разрешаем её отдельно
+			if !found && target == "" && cur != name {
+				return cur, rrs
+			}
+			return "", rrs
+		}
+		if !miekg_dns.IsSubDomain(zone, target) {
+			return target, rrs
+		}
+		cur = target
+	}
+	return "", rrs
+}
@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Поддельная иерархия на адресах 127.0.0.x с общим портом:
+//
+//	127.0.0.2  .              делегирует test.
+//	127.0.0.3  test.          делегирует example.test. и other.test.,
+//	                          на victim.test. отвечает делегированием evil.test.
+//	127.0.0.4  example.test.
+//	127.0.0.5  other.test.
+//	127.0.0.6  evil.test.     отвечает на всё подменённым адресом
+
+// fakeAuth - авторитетный сервер одной зоны
+type fakeAuth struct {
+	zone        string
+	delegations map[string]string // дочерняя зона -> адрес её сервера (ns.<зона>)
+	records     []string
+	hijack      func(qname string) *miekg_dns.Msg
+}
+
+func (f *fakeAuth) ServeDNS(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+	q := r.Question[0]
+	qname := miekg_dns.CanonicalName(q.Name)
+	if f.hijack != nil {
+		if m := f.hijack(qname); m != nil {
+			m.SetReply(r)
+			_ = w.WriteMsg(m)
+			return
+		}
+	}
+
+	m := new(miekg_dns.Msg)
+	m.SetReply(r)
+	for child, addr := range f.delegations {
+		if !miekg_dns.IsSubDomain(child, qname) || qname == child && q.Qtype == miekg_dns.TypeDS {
+			continue
+		}
+		m.Ns = append(m.Ns, testRR("%s 300 IN NS ns.%s", child, child))
+		m.Extra = append(m.Extra, testRR("ns.%s 300 IN A %s", child, addr))
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	m.Authoritative = true
+	exists := false
+	for _, s := range f.records {
+		rr := testRR("%s", s)
+		owner := miekg_dns.CanonicalName(rr.Header().Name)
+		if miekg_dns.IsSubDomain(qname, owner) {
+			exists = true
+		}
+		if owner == qname && (rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == miekg_dns.TypeCNAME) {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if !exists {
+		m.Rcode = miekg_dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []miekg_dns.RR{testRR("%s 300 IN SOA ns.%s hostmaster.%s 1 3600 600 604800 300", f.zone, strings.TrimPrefix(f.zone, "."), strings.TrimPrefix(f.zone, "."))}
+	}
+	_ = w.WriteMsg(m)
+}
+
+func testRR(format string, args ...any) miekg_dns.RR {
+	rr, err := miekg_dns.NewRR(fmt.Sprintf(format, args...))
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// testHierarchy запускает серверы иерархии и возвращает резолвер, который
+// начинает с корня на 127.0.0.2
+func testHierarchy(t *testing.T) *resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("no loopback aliases: ", err)
+	}
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	evil := "127.0.0.6"
+	servers := map[string]*fakeAuth{
+		"127.0.0.2": {zone: ".", delegations: map[string]string{"test.": "127.0.0.3"}},
+		"127.0.0.3": {
+			zone:        "test.",
+			delegations: map[string]string{"example.test.": "127.0.0.4", "other.test.": "127.0.0.5"},
+			hijack: func(qname string) *miekg_dns.Msg {
+				if !miekg_dns.IsSubDomain("victim.test.", qname) {
+					return nil
+				}
+				m := new(miekg_dns.Msg)
+				m.Ns = []miekg_dns.RR{testRR("evil.test. 300 IN NS ns.evil.test.")}
+				m.Extra = []miekg_dns.RR{testRR("ns.evil.test. 300 IN A %s", evil)}
+				return m
+			},
+		},
+		"127.0.0.4": {zone: "example.test.", records: []string{
+			"www.example.test. 300 IN A 192.0.2.10",
+			"alias.example.test. 300 IN CNAME www.other.test.",
+		}},
+		"127.0.0.5": {zone: "other.test.", records: []string{"www.other.test. 300 IN A 192.0.2.20"}},
+		evil: {zone: "evil.test.", hijack: func(qname string) *miekg_dns.Msg {
+			m := new(miekg_dns.Msg)
+			m.Authoritative = true
+			m.Answer = []miekg_dns.RR{testRR("%s 300 IN A 203.0.113.66", qname)}
+			return m
+		}},
+	}
+	for addr, auth := range servers {
+		pc := conn
+		if addr != "127.0.0.2" {
+			if pc, err = net.ListenPacket("udp", net.JoinHostPort(addr, port)); err != nil {
+				t.Skip("no loopback aliases: ", err)
+			}
+		}
+		srv := &miekg_dns.Server{PacketConn: pc, Handler: auth}
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func() { _ = srv.ActivateAndServe() }()
+		<-started
+		t.Cleanup(func() { _ = srv.Shutdown() })
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "listen: 127.0.0.1:0\nmode: recursive\nrecursive:\n  root_hints: [\"127.0.0.2:" + port + "\"]\n"
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.resolver.nsPort = port
+	return s.resolver
+}
+
+func resolveA(t *testing.T, r *resolver, name string) *miekg_dns.Msg {
+	t.Helper()
+	m := new(miekg_dns.Msg)
+	m.SetQuestion(name, miekg_dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := r.resolve(ctx, m)
+	if err != nil {
+		t.Fatalf("resolve %s: %v", name, err)
+	}
+	return resp
+}
+
+func addresses(resp *miekg_dns.Msg) []string {
+	var out []string
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*miekg_dns.A); ok {
+			out = append(out, a.A.String())
+		}
+	}
+	return out
+}
+
+func TestResolver(t *testing.T) {
+	for _, minimise := range []bool{true, false} {
+		t.Run("minimise="+strconv.FormatBool(minimise), func(t *testing.T) {
+			r := testHierarchy(t)
+			r.minimise = minimise
+
+			tests := []struct {
+				name  string
+				rcode int
+				want  []string
+			}{
+				{name: "www.example.test.", want: []string{"192.0.2.10"}},
+				{name: "alias.example.test.", want: []string{"192.0.2.20"}},
+				{name: "missing.example.test.", rcode: miekg_dns.RcodeNameError},
+				// Делегирование evil.test. не ведёт к имени - не следуем ему
+				{name: "www.victim.test."},
+			}
+			for _, tt := range tests {
+				resp := resolveA(t, r, tt.name)
+				if resp.Rcode != tt.rcode || strings.Join(addresses(resp), ",") != strings.Join(tt.want, ",") {
+					t.Errorf("%s: %s %v, want %s %v", tt.name, miekg_dns.RcodeToString[resp.Rcode], addresses(resp),
+						miekg_dns.RcodeToString[tt.rcode], tt.want)
+				}
+			}
+
+			for _, zone := range []string{"test.", "example.test.", "other.test."} {
+				if _, ok := r.zones[zone]; !ok {
+					t.Errorf("delegation %s is not cached", zone)
+				}
+			}
+			if _, ok := r.zones["evil.test."]; ok {
+				t.Error("unrelated delegation evil.test. is cached")
+			}
+		})
+	}
+}
+
+func TestReferralAncestor(t *testing.T) {
+	resp := new(miekg_dns.Msg)
+	resp.Ns = []miekg_dns.RR{testRR("evil.test. 300 IN NS ns.evil.test.")}
+	if child, _, _ := referral(resp, "test.", "www.victim.test."); child != "" {
+		t.Errorf("referral to %s accepted for www.victim.test.", child)
+	}
+	if child, _, _ := referral(resp, "test.", "www.evil.test."); child != "evil.test." {
+		t.Errorf("referral = %q, want evil.test.", child)
+	}
+}
+
+func TestDelegationCacheBounded(t *testing.T) {
+	r := &resolver{nsPort: "53", zones: make(map[string]*delegation)}
+	glue := func(zone string) []miekg_dns.RR {
+		return []miekg_dns.RR{testRR("ns.%s 300 IN A 192.0.2.53", zone)}
+	}
+	expired := "expired.test."
+	if _, err := r.delegate(context.Background(), expired, []string{"ns." + expired}, 0, glue(expired), 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := range maxDelegations + 100 {
+		zone := "z" + strconv.Itoa(i) + ".test."
+		if _, err := r.delegate(context.Background(), zone, []string{"ns." + zone}, 300, glue(zone), 0); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.zones) > maxDelegations {
+			t.Fatalf("%d delegations cached, limit %d", len(r.zones), maxDelegations)
+		}
+	}
+	if _, ok := r.zones[expired]; ok {
+		t.Error("expired delegation survived eviction")
+	}
+}
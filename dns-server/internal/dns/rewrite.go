@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"regexp"
+	"strings"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Переписывание имён: запрос разрешается под другим именем, а в ответе
+// клиент видит то имя, которое спрашивал
+
+type rewriteRule struct {
+	kind string
+	from string
+	to   string
+	re   *regexp.Regexp
+}
+
+func newRewriteRules(rules []config.RewriteRule) []rewriteRule {
+	out := make([]rewriteRule, 0, len(rules))
+	for _, rc := range rules {
+		rule := rewriteRule{kind: rc.Type, from: rc.From, to: rc.To}
+		if rc.Type == config.RewriteRegex {
+			// Проверено при загрузке конфига
+			rule.re = regexp.MustCompile(rc.From)
+		}
+		out = append(out, rule)
+	}
+	return out
+}
+
+// apply возвращает новое имя, если правило подходит
+func (rule *rewriteRule) apply(name string) (string, bool) {
+	switch rule.kind {
+	case config.RewriteExact:
+		if name == rule.from {
+			return rule.to, true
+		}
+	case config.RewriteSuffix:
+		if miekg_dns.IsSubDomain(rule.from, name) {
+			return name[:len(name)-len(rule.from)] + rule.to, true
+		}
+	case config.RewriteRegex:
+		if rule.re.MatchString(name) {
+			to := miekg_dns.CanonicalName(rule.re.ReplaceAllString(name, rule.to))
+			if _, ok := miekg_dns.IsDomainName(to); ok {
+				return to, true
+			}
+		}
+	}
+	return "", false
+}
+
+// rewrite - имя после первого подходящего правила
+func (s *Server) rewrite(name string) (string, bool) {
+	name = miekg_dns.CanonicalName(name)
+	for i := range s.rewrites {
+		if to, ok := s.rewrites[i].apply(name); ok && to != name {
+			return to, true
+		}
+	}
+	return "", false
+}
+
+// serveRewrite - плагин rewrite: запрос идёт дальше по цепочке под новым
+// именем, а в ответе возвращается исходное. Подписи переименованных записей
+// недействительны и убираются. Трансферы не переписываются.
+func (s *Server) serveRewrite(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler) {
+	qtype := r.Question[0].Qtype
+	to, ok := s.rewrite(r.Question[0].Name)
+	if !ok || qtype == miekg_dns.TypeAXFR || qtype == miekg_dns.TypeIXFR {
+		next.ServeDNS(ctx, w, r)
+		return
+	}
+
+	q := r.Copy()
+	q.Question[0].Name = to
+	capture := &captureWriter{ResponseWriter: w}
+	next.ServeDNS(ctx, capture, q)
+	resp := capture.msg
+	if resp == nil {
+		return
+	}
+
+	name := r.Question[0].Name
+	resp.Question = []miekg_dns.Question{r.Question[0]}
+	for _, section := range [][]miekg_dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range section {
+			if h := rr.Header(); strings.EqualFold(h.Name, to) {
+				h.Name = name
+			}
+		}
+	}
+	resp.Answer = dropSignatures(resp.Answer, name)
+	resp.Ns = dropSignatures(resp.Ns, name)
+	resp.AuthenticatedData = false
+
+	// TSIG ответа на переписанный запрос заменит writeMsg
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != miekg_dns.TypeTSIG {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+	writeMsg(w, r, resp)
+}
+
+func dropSignatures(rrs []miekg_dns.RR, name string) []miekg_dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if sig, ok := rr.(*miekg_dns.RRSIG); ok && sig.Hdr.Name == name {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
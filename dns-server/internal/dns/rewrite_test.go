@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"testing"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func newRewriteServer(t *testing.T) *Server {
+	t.Helper()
+	s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+rewrite:
+  - type: suffix
+    from: svc.local
+    to: mesh
+  - type: exact
+    from: old.example
+    to: www.mesh
+  - type: regex
+    from: '^old-(.+)\.example\.$'
+    to: 'new-${1}.mesh.'
+  - type: suffix
+    from: mesh.svc.local
+    to: never.mesh
+zones:
+  - name: mesh
+    records:
+      - "api IN A 10.0.0.1"
+      - "www IN A 10.0.0.2"
+      - "new-web IN A 10.0.0.3"
+`)
+	return s
+}
+
+func TestRewriteRules(t *testing.T) {
+	s := newRewriteServer(t)
+	tests := []struct {
+		name string
+		want string // "" - имя не переписывается
+	}{
+		{name: "api.svc.local.", want: "api.mesh."},
+		{name: "API.Svc.Local.", want: "api.mesh."},
+		{name: "svc.local.", want: "mesh."},
+		{name: "xsvc.local.", want: ""},
+		{name: "old.example.", want: "www.mesh."},
+		{name: "a.old.example.", want: ""},
+		{name: "old-web.example.", want: "new-web.mesh."},
+		// Срабатывает первое подходящее правило
+		{name: "x.mesh.svc.local.", want: "x.mesh.mesh."},
+		{name: "other.test.", want: ""},
+	}
+	for _, tt := range tests {
+		got, ok := s.rewrite(tt.name)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("%s: rewritten to %q (%v), want %q", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestServeRewrite(t *testing.T) {
+	s := newRewriteServer(t)
+	tests := []struct {
+		name  string
+		rcode int
+		ip    string
+	}{
+		{name: "api.svc.local.", ip: "10.0.0.1"},
+		{name: "Old.Example.", ip: "10.0.0.2"},
+		{name: "old-web.example.", ip: "10.0.0.3"},
+		{name: "missing.svc.local.", rcode: miekg_dns.RcodeNameError},
+	}
+	for _, tt := range tests {
+		r := new(miekg_dns.Msg)
+		r.SetQuestion(tt.name, miekg_dns.TypeA)
+		w := udpClient("192.0.2.10")
+		s.ServeDNS(w, r)
+		resp := w.msg
+		if resp == nil || resp.Rcode != tt.rcode {
+			t.Errorf("%s: reply %v, want %s", tt.name, resp, miekg_dns.RcodeToString[tt.rcode])
+			continue
+		}
+		// Клиент видит тот вопрос и то имя, которые спрашивал
+		if resp.Question[0] != r.Question[0] || resp.Id != r.Id {
+			t.Errorf("%s: question %v, want %v", tt.name, resp.Question[0], r.Question[0])
+		}
+		if tt.ip == "" {
+			continue
+		}
+		a, ok := resp.Answer[0].(*miekg_dns.A)
+		if len(resp.Answer) != 1 || !ok || a.Hdr.Name != tt.name || a.A.String() != tt.ip {
+			t.Errorf("%s: answer %v, want %s under the queried name", tt.name, resp.Answer, tt.ip)
+		}
+	}
+}
+
+func TestDropSignatures(t *testing.T) {
+	rrs := []miekg_dns.RR{
+		testRR("a.test. 300 IN A 192.0.2.1"),
+		testRR("a.test. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 test. AAAA"),
+		testRR("b.test. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 test. AAAA"),
+	}
+	got := dropSignatures(rrs, "a.test.")
+	if len(got) != 2 || got[0].Header().Rrtype != miekg_dns.TypeA || got[1].Header().Name != "b.test." {
+		t.Errorf("after dropSignatures: %v", got)
+	}
+}
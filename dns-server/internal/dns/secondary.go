@@ -0,0 +1,384 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/config"
+	"dns-server/internal/logging"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Вторичные зоны: забираем с первичного сервера и обновляем по таймерам SOA
+
+func newSecondaryZone(zc config.SecondaryZoneConfig) (*Zone, error) {
+	z := &Zone{
+		name:          zc.Name,
+		file:          zc.File,
+		allowUpdate:   make(map[string]bool),
+		allowTransfer: make(map[string]bool),
+		rrs:           make(map[string]map[uint16][]miekg_dns.RR),
+
+		primaries: zc.Primaries,
+		xfrKey:    zc.TSIGKey,
+		refreshCh: make(chan struct{}, 1),
+	}
+	z.resolvePrimaries()
+	if zc.DNSSEC != nil {
+		sg, err := newSigner(z.name, zc.DNSSEC)
+		if err != nil {
+			return nil, err
+		}
+		z.signer = sg
+	}
+
+	if z.file != "" {
+		if st, err := os.Stat(z.file); err == nil {
+			if err := z.load(); err != nil {
+				return nil, err
+			}
+			// Время последней успешной проверки хранится как mtime файла
+			z.lastRefresh = st.ModTime()
+		}
+	}
+	return z, nil
+}
+
+func (z *Zone) secondary() bool {
+	return len(z.primaries) > 0
+}
+
+// serving - есть ли у зоны данные, которые ещё не истекли (SOA expire)
+func (z *Zone) serving() bool {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	if z.soa == nil {
+		return false
+	}
+	if !z.secondary() {
+		return true
+	}
+	return time.Since(z.lastRefresh) < time.Duration(z.soa.Expire)*time.Second
+}
+
+func (s *Server) runSecondary(ctx context.Context, z *Zone) {
+	for {
+		wait := 30 * time.Second
+		err := s.refreshZone(z)
+
+		z.mu.RLock()
+		if z.soa != nil {
+			if err == nil {
+				wait = time.Duration(z.soa.Refresh) * time.Second
+			} else {
+				wait = time.Duration(z.soa.Retry) * time.Second
+			}
+		}
+		z.mu.RUnlock()
+		if err != nil {
+			logging.Warnf("secondary %s: refresh failed: %v", z.name, err)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-z.refreshCh:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *Server) refreshZone(z *Zone) error {
+	// Адреса первичных, заданных именами, могли смениться
+	z.resolvePrimaries()
+	var errs []error
+	for _, primary := range z.primaries {
+		err := s.refreshFrom(z, primary)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", primary, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) tsigFor(key string) map[string]string {
+	if key == "" {
+		return nil
+	}
+	return map[string]string{key: s.cfg.TSIGKeys[key].Secret}
+}
+
+func (s *Server) signRequest(m *miekg_dns.Msg, key string) {
+	if key != "" {
+		m.SetTsig(key, s.cfg.TSIGKeys[key].Algorithm, 300, time.Now().Unix())
+	}
+}
+
+func (s *Server) refreshFrom(z *Zone, primary string) error {
+	z.mu.RLock()
+	var current *miekg_dns.SOA
+	if z.soa != nil {
+		current = miekg_dns.Copy(z.soa).(*miekg_dns.SOA)
+	}
+	z.mu.RUnlock()
+
+	// Сначала сравниваем серийные номера
+	q := new(miekg_dns.Msg)
+	q.SetQuestion(z.name, miekg_dns.TypeSOA)
+	s.signRequest(q, z.xfrKey)
+	c := &miekg_dns.Client{Net: "tcp", Timeout: 5 * time.Second, TsigSecret: s.tsigFor(z.xfrKey)}
+	resp, _, err := c.Exchange(q, primary)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != miekg_dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return errors.New("bad SOA response: " + miekg_dns.RcodeToString[resp.Rcode])
+	}
+	remote, ok := resp.Answer[0].(*miekg_dns.SOA)
+	if !ok {
+		return errors.New("bad SOA response")
+	}
+
+	if current != nil && !serialGreater(remote.Serial, current.Serial) {
+		z.touch()
+		return nil
+	}
+
+	m := new(miekg_dns.Msg)
+	if current != nil {
+		m.SetIxfr(z.name, current.Serial, current.Ns, current.Mbox)
+	} else {
+		m.SetAxfr(z.name)
+	}
+	s.signRequest(m, z.xfrKey)
+
+	tr := &miekg_dns.Transfer{DialTimeout: 5 * time.Second, ReadTimeout: 10 * time.Second, TsigSecret: s.tsigFor(z.xfrKey)}
+	env, err := tr.In(m, primary)
+	if err != nil {
+		return err
+	}
+	var rrs []miekg_dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	if len(rrs) == 0 {
+		return errors.New("empty transfer")
+	}
+
+	if err := z.applyTransfer(rrs); err != nil {
+		return err
+	}
+
+	z.mu.RLock()
+	serial := z.soa.Serial
+	z.mu.RUnlock()
+	logging.Infof("secondary %s: transferred from %s, serial %d", z.name, primary, serial)
+	return nil
+}
+
+// applyTransfer применяет ответ AXFR или IXFR (полный или инкрементальный)
+func (z *Zone) applyTransfer(rrs []miekg_dns.RR) error {
+	newSOA, ok := rrs[0].(*miekg_dns.SOA)
+	if !ok {
+		return errors.New("transfer does not start with SOA")
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if len(rrs) == 1 {
+		z.lastRefresh = time.Now()
+		return nil
+	}
+	if _, ok := rrs[len(rrs)-1].(*miekg_dns.SOA); !ok {
+		return errors.New("transfer does not end with SOA")
+	}
+
+	var before []miekg_dns.RR
+	if z.soa != nil {
+		before = z.records()
+	}
+
+	// Изменения собираются на копии и заменяют данные зоны, только если
+	// применились все последовательности IXFR
+	work := &Zone{name: z.name, rrs: make(map[string]map[uint16][]miekg_dns.RR)}
+	if _, incremental := rrs[1].(*miekg_dns.SOA); incremental && z.soa != nil {
+		work.soa = z.soa
+		for name, types := range z.rrs {
+			work.rrs[name] = make(map[uint16][]miekg_dns.RR, len(types))
+			for t, rrset := range types {
+				// Без запаса ёмкости put не допишет в массив живой зоны
+				work.rrs[name][t] = slices.Clip(rrset)
+			}
+		}
+		// Последовательности: SOA(старый) удалённые... SOA(новый) добавленные...
+		i := 1
+		for i < len(rrs)-1 {
+			from, ok := rrs[i].(*miekg_dns.SOA)
+			if !ok {
+				return errors.New("malformed IXFR")
+			}
+			if from.Serial != work.soa.Serial {
+				return fmt.Errorf("IXFR sequence starts at %d, have %d", from.Serial, work.soa.Serial)
+			}
+			for i++; i < len(rrs)-1; i++ {
+				if _, ok := rrs[i].(*miekg_dns.SOA); ok {
+					break
+				}
+				work.remove(rrs[i])
+			}
+			to, ok := rrs[i].(*miekg_dns.SOA)
+			if !ok {
+				return errors.New("malformed IXFR")
+			}
+			for i++; i < len(rrs)-1; i++ {
+				if _, ok := rrs[i].(*miekg_dns.SOA); ok {
+					break
+				}
+				work.put(rrs[i])
+			}
+			work.put(to)
+		}
+		if work.soa.Serial != newSOA.Serial {
+			return fmt.Errorf("IXFR ends at %d, expected %d", work.soa.Serial, newSOA.Serial)
+		}
+	} else {
+		for _, rr := range rrs[:len(rrs)-1] {
+			if work.contains(rr.Header().Name) {
+				work.put(rr)
+			}
+		}
+	}
+	work.put(newSOA)
+	z.rrs, z.soa = work.rrs, work.soa
+	z.lastRefresh = time.Now()
+
+	if before != nil {
+		z.commit(before)
+	}
+	return z.save()
+}
+
+func (z *Zone) remove(rr miekg_dns.RR) {
+	h := rr.Header()
+	name := miekg_dns.CanonicalName(h.Name)
+	rrset := z.rrs[name][h.Rrtype]
+	for i, old := range rrset {
+		if miekg_dns.IsDuplicate(old, rr) {
+			z.set(name, h.Rrtype, append(append([]miekg_dns.RR{}, rrset[:i]...), rrset[i+1:]...))
+			return
+		}
+	}
+}
+
+// touch отмечает успешную проверку SOA без изменений
+func (z *Zone) touch() {
+	now := time.Now()
+	z.mu.Lock()
+	z.lastRefresh = now
+	z.mu.Unlock()
+	if z.file != "" {
+		_ = os.Chtimes(z.file, now, now)
+	}
+}
+
+// handleNotify принимает NOTIFY от первичных серверов и запускает внеочередную проверку
+func (s *Server) handleNotify(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+	m := new(miekg_dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if len(r.Question) != 1 {
+		m.Rcode = miekg_dns.RcodeFormatError
+		writeMsg(w, r, m)
+		return
+	}
+	z, ok := s.zones[miekg_dns.CanonicalName(r.Question[0].Name)]
+	if !ok || !z.secondary() {
+		m.Rcode = miekg_dns.RcodeNotAuth
+		writeMsg(w, r, m)
+		return
+	}
+
+	if !z.fromPrimary(w.RemoteAddr()) {
+		logging.Warnf("NOTIFY %s from unknown host %s ignored", z.name, w.RemoteAddr())
+		m.Rcode = miekg_dns.RcodeRefused
+		writeMsg(w, r, m)
+		return
+	}
+	if z.xfrKey != "" {
+		if rcode := s.checkTSIG(w, r, map[string]bool{z.xfrKey: true}); rcode != miekg_dns.RcodeSuccess {
+			m.Rcode = rcode
+			writeMsg(w, r, m)
+			return
+		}
+	}
+
+	select {
+	case z.refreshCh <- struct{}{}:
+	default:
+	}
+	writeMsg(w, r, m)
+}
+
+func (z *Zone) fromPrimary(addr net.Addr) bool {
+	host, _, _ := net.SplitHostPort(addr.String())
+	ip := net.ParseIP(host)
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	for _, pip := range z.primaryIPs {
+		if pip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePrimaries запоминает адреса первичных серверов для проверки NOTIFY.
+// Имена разрешаются при загрузке конфига и перед каждой проверкой зоны,
+// а не в обработчике NOTIFY. Если имя не разрешилось, остаются старые адреса.
+func (z *Zone) resolvePrimaries() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	z.mu.RLock()
+	known := z.primaryIPs
+	z.mu.RUnlock()
+
+	var ips []net.IP
+	for _, p := range z.primaries {
+		ph, _, _ := net.SplitHostPort(p)
+		if pip := net.ParseIP(ph); pip != nil {
+			ips = append(ips, pip)
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", ph)
+		if err != nil {
+			logging.Warnf("secondary %s: resolve primary %s: %v", z.name, ph, err)
+			continue
+		}
+		ips = append(ips, addrs...)
+	}
+	for _, ip := range known {
+		if !slices.ContainsFunc(ips, ip.Equal) {
+			ips = append(ips, ip)
+		}
+	}
+
+	z.mu.Lock()
+	z.primaryIPs = ips
+	z.mu.Unlock()
+}
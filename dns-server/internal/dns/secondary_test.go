@@ -0,0 +1,251 @@
+package dns
+
+import (
+	"dns-server/internal/config"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func testSecondary(t *testing.T) *Zone {
+	t.Helper()
+	z, err := newSecondaryZone(config.SecondaryZoneConfig{Name: "example.test.", Primaries: []string{"192.0.2.1:53"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	soa := "example.test. 300 IN SOA ns.example.test. hostmaster.example.test. %d 3600 600 604800 300"
+	axfr := []miekg_dns.RR{
+		testRR(soa, 1),
+		testRR("www.example.test. 300 IN A 192.0.2.10"),
+		testRR("mail.example.test. 300 IN A 192.0.2.20"),
+		testRR(soa, 1),
+	}
+	if err := z.applyTransfer(axfr); err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func zoneText(z *Zone) []string {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	var out []string
+	for _, rr := range z.records() {
+		out = append(out, rr.String())
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestApplyIXFR(t *testing.T) {
+	soa := "example.test. 300 IN SOA ns.example.test. hostmaster.example.test. %d 3600 600 604800 300"
+	tests := []struct {
+		name   string
+		rrs    []miekg_dns.RR
+		ok     bool
+		serial uint32
+	}{
+		{
+			name: "two sequences",
+			rrs: []miekg_dns.RR{
+				testRR(soa, 3),
+				testRR(soa, 1), testRR("www.example.test. 300 IN A 192.0.2.10"),
+				testRR(soa, 2), testRR("www.example.test. 300 IN A 192.0.2.11"),
+				testRR(soa, 2), testRR("mail.example.test. 300 IN A 192.0.2.20"),
+				testRR(soa, 3),
+				testRR(soa, 3),
+			},
+			ok:     true,
+			serial: 3,
+		},
+		{
+			// Вторая последовательность не стыкуется с первой - зона не меняется
+			name: "broken second sequence",
+			rrs: []miekg_dns.RR{
+				testRR(soa, 3),
+				testRR(soa, 1), testRR("www.example.test. 300 IN A 192.0.2.10"),
+				testRR(soa, 2), testRR("www.example.test. 300 IN A 192.0.2.11"),
+				testRR(soa, 5), testRR("mail.example.test. 300 IN A 192.0.2.20"),
+				testRR(soa, 3),
+				testRR(soa, 3),
+			},
+			serial: 1,
+		},
+		{
+			name: "ends before announced serial",
+			rrs: []miekg_dns.RR{
+				testRR(soa, 3),
+				testRR(soa, 1), testRR("www.example.test. 300 IN A 192.0.2.10"),
+				testRR(soa, 2), testRR("www.example.test. 300 IN A 192.0.2.11"),
+				testRR(soa, 3),
+			},
+			serial: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := testSecondary(t)
+			before := zoneText(z)
+			err := z.applyTransfer(tt.rrs)
+			if (err == nil) != tt.ok {
+				t.Fatalf("applyTransfer: %v, want ok=%v", err, tt.ok)
+			}
+			if z.soa.Serial != tt.serial {
+				t.Errorf("serial %d, want %d", z.soa.Serial, tt.serial)
+			}
+			if !tt.ok && !slices.Equal(zoneText(z), before) {
+				t.Errorf("zone changed by failed IXFR:\n%v\nwas\n%v", zoneText(z), before)
+			}
+			if tt.ok && !slices.Contains(zoneText(z), "www.example.test.\t300\tIN\tA\t192.0.2.11") {
+				t.Errorf("IXFR not applied: %v", zoneText(z))
+			}
+		})
+	}
+}
+
+func TestFromPrimary(t *testing.T) {
+	z := testSecondary(t)
+	if !z.fromPrimary(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}) {
+		t.Error("NOTIFY from primary rejected")
+	}
+	if z.fromPrimary(&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}) {
+		t.Error("NOTIFY from unknown host accepted")
+	}
+}
+
+// Вторичная зона забирает xfr.test с первичного, получает изменения через IXFR
+// и перестаёт обслуживаться после SOA expire
+func TestRefreshZone(t *testing.T) {
+	primary, addr := newTransferServer(t, "127.0.0.1:1")
+	pz := primary.zones["xfr.test."]
+	pz.notify = nil
+
+	file := filepath.Join(t.TempDir(), "xfr.test.zone")
+	s, _ := newTestServer(t, fmt.Sprintf(`
+listen: 127.0.0.1:0
+tsig_keys:
+  xfr-key:
+    secret: %q
+secondary_zones:
+  - name: xfr.test
+    primaries: [%q]
+    tsig_key: xfr-key
+    file: %s
+`, xfrSecret, addr, file))
+	z := s.zones["xfr.test."]
+
+	query := func(name string) *miekg_dns.Msg {
+		w := udpClient("192.0.2.10")
+		r := new(miekg_dns.Msg)
+		r.SetQuestion(name, miekg_dns.TypeA)
+		s.ServeDNS(w, r)
+		return w.msg
+	}
+	if resp := query("www.xfr.test."); resp.Rcode != miekg_dns.RcodeServerFailure {
+		t.Fatalf("before transfer: %s, want SERVFAIL", miekg_dns.RcodeToString[resp.Rcode])
+	}
+
+	if err := s.refreshZone(z); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(zoneText(z), zoneText(pz)) {
+		t.Fatalf("AXFR: %v, want %v", zoneText(z), zoneText(pz))
+	}
+	if resp := query("www.xfr.test."); resp.Rcode != miekg_dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("after transfer: %v", resp)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("zone file not saved: %v", err)
+	}
+
+	// Серийный номер не изменился - зона та же, журнал пуст
+	if err := s.refreshZone(z); err != nil || len(z.journal) != 0 {
+		t.Errorf("refresh without changes: %v, journal %d", err, len(z.journal))
+	}
+
+	if rcode, _ := pz.update(nil, []miekg_dns.RR{testRR("new.xfr.test. 300 IN A 192.0.2.3")}); rcode != miekg_dns.RcodeSuccess {
+		t.Fatal(miekg_dns.RcodeToString[rcode])
+	}
+	if err := s.refreshZone(z); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(zoneText(z), zoneText(pz)) || len(z.journal) != 1 {
+		t.Errorf("IXFR: %v, journal %d", zoneText(z), len(z.journal))
+	}
+
+	// Первичный недоступен: данные остаются до SOA expire
+	z.primaries = []string{"127.0.0.1:1"}
+	if err := s.refreshZone(z); err == nil {
+		t.Error("refresh from unreachable primary succeeded")
+	}
+	if resp := query("new.xfr.test."); resp.Rcode != miekg_dns.RcodeSuccess {
+		t.Errorf("zone dropped after failed refresh: %s", miekg_dns.RcodeToString[resp.Rcode])
+	}
+	z.mu.Lock()
+	z.lastRefresh = time.Now().Add(-time.Duration(z.soa.Expire+1) * time.Second)
+	z.mu.Unlock()
+	if resp := query("new.xfr.test."); resp.Rcode != miekg_dns.RcodeServerFailure {
+		t.Errorf("expired zone: %s, want SERVFAIL", miekg_dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestHandleNotify(t *testing.T) {
+	s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+tsig_keys:
+  xfr-key:
+    secret: "eGZyc2VjcmV0eGZyc2VjcmV0"
+zones:
+  - name: local.test
+secondary_zones:
+  - name: open.test
+    primaries: ["192.0.2.1:53"]
+  - name: signed.test
+    primaries: ["192.0.2.1:53"]
+    tsig_key: xfr-key
+`)
+	tests := []struct {
+		name    string
+		zone    string
+		from    string
+		sign    bool
+		rcode   int
+		refresh bool
+	}{
+		{name: "from primary", zone: "open.test.", from: "192.0.2.1", refresh: true},
+		{name: "from unknown host", zone: "open.test.", from: "192.0.2.2", rcode: miekg_dns.RcodeRefused},
+		{name: "primary zone", zone: "local.test.", from: "192.0.2.1", rcode: miekg_dns.RcodeNotAuth},
+		{name: "unsigned for TSIG zone", zone: "signed.test.", from: "192.0.2.1", rcode: miekg_dns.RcodeRefused},
+		{name: "signed", zone: "signed.test.", from: "192.0.2.1", sign: true, refresh: true},
+	}
+	for _, tt := range tests {
+		r := new(miekg_dns.Msg)
+		r.SetNotify(tt.zone)
+		if tt.sign {
+			r.SetTsig("xfr-key.", miekg_dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		w := udpClient(tt.from)
+		s.handleNotify(w, r)
+		if w.msg.Rcode != tt.rcode {
+			t.Errorf("%s: %s, want %s", tt.name, miekg_dns.RcodeToString[w.msg.Rcode], miekg_dns.RcodeToString[tt.rcode])
+		}
+		if z := s.zones[tt.zone]; z.secondary() {
+			select {
+			case <-z.refreshCh:
+				if !tt.refresh {
+					t.Errorf("%s: refresh triggered", tt.name)
+				}
+			default:
+				if tt.refresh {
+					t.Errorf("%s: refresh not triggered", tt.name)
+				}
+			}
+		}
+	}
+}
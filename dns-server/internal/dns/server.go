@@ -3,95 +3,259 @@ package dns
 import (
 	"context"
 	"dns-server/internal/config"
-	"log"
+	"dns-server/internal/logging"
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"net"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	miekg_dns "github.com/miekg/dns"
 )
 
+// Размер буфера EDNS, который мы объявляем клиентам и апстримам (DNS Flag Day 2020)
+const ednsUDPSize = 1232
+
 type cacheEntry struct {
 	msg *miekg_dns.Msg
 	expiry time.Time
+
+	// Для prefetch: как повторить запрос и насколько запись популярна
+	ttl         time.Duration
+	query       *miekg_dns.Msg
+	upstreams   []string
+	hits        atomic.Uint32
+	prefetching atomic.Bool
 }
 
 type Server struct {
 	cfg           *config.Config
 	client        *miekg_dns.Client
+	pools         *connPools
 	upstreamAddrs []string
 
-	cache map[string]cacheEntry
+	cache map[string]*cacheEntry
 	mu sync.RWMutex
+	// Фоновые задачи, которые пишут в кеш (очистка и prefetch). Run ждёт их,
+	// прежде чем отдать кеш новому серверу через Next.
+	background sync.WaitGroup
+
+	records map[string]*recordSet
+	zones   map[string]*Zone
+
+	forwardZones   map[string]*forwardZone
+	defaultForward *forwardZone
+	resolver       *resolver
+	rewrites       []rewriteRule
+
+	chain        Handler
+	cacheEnabled bool
+
+	// Контекст работы сервера: отменяется при остановке, от него считаются дедлайны запросов
+	ctx context.Context
+
+	validator *validator
+	dns64     *dns64
+	services  *serviceRegistry
+
+	queryStats *queryStats // nil - статистика запросов выключена
+
+	stats    stats
+	reloader func() (*config.Config, error)
+	reloadCh chan *Server // сервер с новым конфигом от /reload
+	next     *Server
 }
 
 func NewServer(cfg *config.Config) (*Server, error) {
 	s := &Server{
 		cfg:    cfg,
-		client: &miekg_dns.Client{Net: "udp", Timeout: 3 * time.Second},
-		cache: make(map[string]cacheEntry),
+		client: &miekg_dns.Client{Net: "udp", Timeout: 3 * time.Second, UDPSize: ednsUDPSize},
+		pools: newConnPools(cfg.UpstreamPool, cfg.QueryTimeout),
+		cache: make(map[string]*cacheEntry),
+		zones: make(map[string]*Zone),
+		reloadCh: make(chan *Server, 1),
+		ctx: context.Background(),
+		records: newRecordSets(cfg.Records),
+		rewrites: newRewriteRules(cfg.Rewrite),
+		services: newServiceRegistry(),
 	}
 
-	if len(cfg.Upstream) > 0 {
+	for _, zc := range cfg.Zones {
+		z, err := newZone(zc, cfg.TTL)
+		if err != nil {
+			return nil, err
+		}
+		if len(zc.AllowUpdate) > 0 && zc.File == "" {
+			logging.Warnf("zone %s has allow_update but no file, updates will be refused", z.name)
+		}
+		s.zones[z.name] = z
+	}
+	for _, zc := range cfg.SecondaryZones {
+		z, err := newSecondaryZone(zc)
+		if err != nil {
+			return nil, err
+		}
+		s.zones[z.name] = z
+	}
+
+	if cfg.Mode == config.ModeRecursive {
+		// Без апстримов запросы разрешаются от корня
+		s.resolver = newResolver(s, cfg.Recursive)
+	} else if len(cfg.Upstream) > 0 {
 		s.upstreamAddrs = cfg.Upstream
 	} else {
 		s.upstreamAddrs = []string{"8.8.8.8:53", "1.1.1.1:53"}
 	}
 
-	s.upstreamAddrs = sanitizeUpstreams(cfg.Listen, s.upstreamAddrs)
+	s.upstreamAddrs = sanitizeUpstreams(cfg.Listeners, s.upstreamAddrs)
+
+	s.defaultForward = &forwardZone{name: ".", upstreams: s.upstreamAddrs, ecs: cfg.ECS}
+	s.forwardZones = make(map[string]*forwardZone)
+	for _, fc := range cfg.ForwardZones {
+		fz := &forwardZone{name: fc.Name, upstreams: s.upstreamAddrs, ecs: fc.ECS}
+		if len(fc.Upstream) > 0 {
+			fz.upstreams = sanitizeUpstreams(cfg.Listeners, fc.Upstream)
+		}
+		s.forwardZones[fz.name] = fz
+	}
+
+	if cfg.DNS64.Enabled {
+		s.dns64 = newDNS64(cfg.DNS64)
+	}
+
+	if err := s.loadCache(); err != nil {
+		logging.Errorf("failed to load cache: %v", err)
+	}
+
+	if cfg.DNSSEC.Validate {
+		v, err := newValidator(cfg.DNSSEC.TrustAnchors, s.queryUpstream)
+		if err != nil {
+			return nil, err
+		}
+		s.validator = v
+	}
+
+	if cfg.QueryStats.Enabled {
+		s.queryStats = newQueryStats(cfg.QueryStats)
+	}
+
+	chain, err := s.buildChain(cfg.Plugins, cfg.PluginOptions)
+	if err != nil {
+		return nil, err
+	}
+	s.chain = chain
+	s.cacheEnabled = slices.Contains(cfg.Plugins, "cache")
 	return s, nil
 }
 
 func (s *Server) ServeDNS(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+	// Общий дедлайн на все попытки запроса и ID для его логов
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.QueryTimeout)
+	defer cancel()
+	ctx = logging.WithID(ctx, newQueryID())
+
+	if r.Opcode == miekg_dns.OpcodeUpdate {
+		s.handleUpdate(w, r)
+		return
+	}
+	if r.Opcode == miekg_dns.OpcodeNotify {
+		s.handleNotify(w, r)
+		return
+	}
+	// Запрос без вопроса или с несколькими не пройдёт acl и blocklist,
+	// поэтому не обслуживается вовсе (RFC 9619)
 	if len(r.Question) != 1 {
-		s.forward(w, r)
+		m := new(miekg_dns.Msg)
+		m.SetRcode(r, miekg_dns.RcodeFormatError)
+		writeMsg(w, r, m)
+		return
+	}
+	// Поддерживаем только EDNS версии 0 (RFC 6891, 6.1.3)
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		m := new(miekg_dns.Msg)
+		m.SetRcode(r, miekg_dns.RcodeBadVers)
+		writeMsg(w, r, m)
 		return
 	}
-	q := r.Question[0]
 
-	name := strings.ToLower(miekg_dns.Fqdn(q.Name))
+	if s.queryStats == nil {
+		s.chain.ServeDNS(ctx, w, r)
+		return
+	}
+	sw := &statsWriter{ResponseWriter: w}
+	s.chain.ServeDNS(ctx, sw, r)
+	if sw.written {
+		s.queryStats.record(clientIP(w), miekg_dns.CanonicalName(r.Question[0].Name), sw.rcode)
+	}
+}
 
-	switch q.Qtype {
-	case miekg_dns.TypeA:
-		ip, ok := s.lookupA(name)
-		if ok {
-			msg := new(miekg_dns.Msg)
-			msg.SetReply(r)
-			msg.Authoritative = true
-
-			rr := &miekg_dns.A{
-				Hdr: miekg_dns.RR_Header{
-					Name:   name,
-					Rrtype: miekg_dns.TypeA,
-					Class:  miekg_dns.ClassINET,
-					Ttl:    s.cfg.TTL,
-				},
-				A: net.ParseIP(ip),
-			}
+func newQueryID() string {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
 
-			msg.Answer = append(msg.Answer, rr)
-			_ = w.WriteMsg(msg)
+// serveLocal - плагин local: трансферы, records и локальные зоны
+func (s *Server) serveLocal(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler) {
+	q := r.Question[0]
+	name := strings.ToLower(miekg_dns.Fqdn(q.Name))
+
+	if q.Qtype == miekg_dns.TypeAXFR || q.Qtype == miekg_dns.TypeIXFR {
+		if z := s.findZone(name); z != nil {
+			s.handleTransfer(w, r, z)
 			return
 		}
+		m := new(miekg_dns.Msg)
+		m.SetRcode(r, miekg_dns.RcodeRefused)
+		_ = w.WriteMsg(m)
+		return
+	}
 
-		s.forward(w, r)
+	if q.Qtype == miekg_dns.TypeA || q.Qtype == miekg_dns.TypeAAAA {
+		// Имя из records без адресов нужного семейства - пустой ответ (NODATA), а не апстрим
+		if rs, ok := s.records[name]; ok {
+			s.answerFromRecords(w, r, rs.addresses(q.Qtype))
+			return
+		}
+	}
 
-	default:
-		s.forward(w, r)
+	if z := s.findZone(name); z != nil {
+		s.answerFromZone(ctx, w, r, z, name)
+		return
 	}
+
+	next.ServeDNS(ctx, w, r)
 }
 
-func (s *Server) lookupA(name string) (string, bool) {
-	// Ищем имя в конфиге, поддерживает и с точкой и без на конце
-	n := strings.TrimSuffix(name, ".")
-	if ip, ok := s.cfg.Records[n]; ok {
-		return ip, true
+func (s *Server) answerFromZone(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, z *Zone, name string) {
+	msg := new(miekg_dns.Msg)
+	msg.SetReply(r)
+	if !z.serving() {
+		msg.Rcode = miekg_dns.RcodeServerFailure
+		writeMsg(w, r, msg)
+		return
 	}
-	if ip, ok := s.cfg.Records[name]; ok {
-		return ip, true
+	msg.Authoritative = true
+
+	qtype := r.Question[0].Qtype
+	opt := r.IsEdns0()
+	if z.signer != nil && name == z.name && (qtype == miekg_dns.TypeDNSKEY || qtype == miekg_dns.TypeNSEC3PARAM) {
+		z.mu.RLock()
+		ttl := z.soa.Hdr.Ttl
+		z.mu.RUnlock()
+		msg.Answer = z.signer.apexRRset(qtype, ttl)
 	}
-	return "", false
+	if len(msg.Answer) == 0 && z.flatten && name == z.name {
+		s.flattenApex(ctx, w, msg, z, qtype)
+	} else if len(msg.Answer) == 0 {
+		msg.Answer, msg.Ns, msg.Rcode = z.lookup(name, qtype)
+	}
+	if z.signer != nil && opt != nil && opt.Do() {
+		z.signer.signResponse(z, msg, name, qtype)
+	}
+	writeMsg(w, r, msg)
 }
 
 func (s *Server) cacheKey(r *miekg_dns.Msg) string {
@@ -99,69 +263,423 @@ func (s *Server) cacheKey(r *miekg_dns.Msg) string {
 		return ""
 	}
 	q := r.Question[0]
-	return strings.ToLower(miekg_dns.Fqdn(q.Name)) + ":" + miekg_dns.TypeToString[q.Qtype]
+	key := strings.ToLower(miekg_dns.Fqdn(q.Name)) + ":" + miekg_dns.TypeToString[q.Qtype]
+	// Ответы с подписями и без храним отдельно
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		key += ":do"
+	}
+	return key
 }
 
-func (s *Server) forward(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+// serveCache - плагин cache: ответ из кеша, при промахе - дальше по цепочке
+// (ответ апстрима кеширует forward). Если дальше не ответили, отдаём
+// просроченный ответ (RFC 8767).
+func (s *Server) serveCache(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler) {
+	fz := s.findForward(r.Question[0].Name)
+	ecs := fz.clientSubnet(w, r)
 	key := s.cacheKey(r)
 
+	// Сначала ответ для подсети клиента, потом общий.
+	// Просроченный запоминаем на случай, если апстримы не ответят.
+	keys := []string{key}
+	if ecs != nil {
+		keys = []string{key + ecsCacheKey(ecs), key}
+	}
+	now := time.Now()
+	var stale *miekg_dns.Msg
 	s.mu.RLock()
-	entry, ok := s.cache[key]
+	for _, k := range keys {
+		entry, ok := s.cache[k]
+		if !ok {
+			continue
+		}
+		if now.Before(entry.expiry) {
+			s.mu.RUnlock()
+			logging.Ctx(ctx).Debugf("used cache: %s", key)
+			s.stats.cacheHits.Add(1)
+			s.maybePrefetch(k, entry, now)
+			s.writeCached(w, r, entry.msg)
+			return
+		}
+		if stale == nil && now.Before(entry.expiry.Add(s.cfg.ServeStale.MaxStale)) {
+			stale = entry.msg
+		}
+	}
 	s.mu.RUnlock()
 
-	if ok && time.Now().Before(entry.expiry) {
-		log.Printf("used cache: %s", key)
-		cached := entry.msg.Copy()
-		cached.SetReply(r)
-		_ = w.WriteMsg(cached)
+	s.stats.cacheMisses.Add(1)
+	if stale == nil {
+		next.ServeDNS(ctx, w, r)
 		return
 	}
+	// Клиент ждёт апстрим не дольше client_timeout (RFC 8767, 5), а запрос
+	// продолжается в фоне до своего дедлайна, чтобы обновить кеш
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(s.cfg.QueryTimeout)
+	}
+	bg, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	capture := &captureWriter{ResponseWriter: w}
+	done := make(chan struct{})
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		defer cancel()
+		defer close(done)
+		next.ServeDNS(bg, capture, r)
+	}()
+	timer := time.NewTimer(s.cfg.ServeStale.ClientTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		if capture.msg != nil && capture.msg.Rcode != miekg_dns.RcodeServerFailure {
+			writeMsg(w, r, capture.msg)
+			return
+		}
+	case <-timer.C:
+	}
+	logging.Ctx(ctx).Infof("used stale cache: %s", key)
+	s.stats.staleHits.Add(1)
+	s.writeStale(w, r, stale)
+}
+
+// serveForward - плагин forward: запрос к апстримам (или рекурсия)
+func (s *Server) serveForward(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, _ Handler) {
+	s.forward(ctx, w, r)
+}
+
+func (s *Server) forward(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+	log := logging.Ctx(ctx)
+	fz := s.findForward(r.Question[0].Name)
+	ecs := fz.clientSubnet(w, r)
 
 	// Ищем в апстрим
-	for _, ns := range s.upstreamAddrs {
-		resp, _, err := s.client.Exchange(r, ns)
-		if err == nil && resp != nil {
-			// Кешируем
-			s.mu.Lock()
-			s.cache[key] = cacheEntry{
-				msg: resp.Copy(),
-				expiry: time.Now().Add(time.Duration(s.cfg.TTL) * time.Second),
+	query := s.upstreamQuery(r, ecs)
+	resp, err := s.exchange(ctx, query, fz.upstreams)
+	if err == nil {
+		if ok, why := s.validate(ctx, query, resp); !ok {
+			log.Warnf("DNSSEC bogus: %s: %s", s.cacheKey(r), why)
+			if r.CheckingDisabled {
+				s.writeForwarded(w, r, resp)
+				return
 			}
-			s.mu.Unlock()
-
-			_ = w.WriteMsg(resp)
+			m := new(miekg_dns.Msg)
+			m.SetRcode(r, miekg_dns.RcodeServerFailure)
+			writeMsg(w, r, m)
 			return
 		}
+
+		s.filterRebinding(ctx, resp)
+
+		// Кешируем; ответ с ненулевым scope годится только для этой подсети
+		if key := s.cacheKey(r); s.cacheEnabled && key != "" {
+			if got := ednsSubnet(resp); ecs != nil && got != nil && got.SourceScope > 0 {
+				key += ecsCacheKey(ecs)
+			}
+			s.store(key, query, fz.upstreams, resp)
+		}
+
+		s.writeForwarded(w, r, resp)
+		return
 	}
 
 	// SERVFAIL
+	log.Warnf("upstream query failed: %s: %v", s.cacheKey(r), err)
 	m := new(miekg_dns.Msg)
 	m.SetReply(r)
 	m.Rcode = miekg_dns.RcodeServerFailure
-	_ = w.WriteMsg(m)
+	writeMsg(w, r, m)
 }
 
-func sanitizeUpstreams(listen string, ns []string) []string {
-	/// Защита от петли
-	listenHost, _, _ := net.SplitHostPort(listen)
-	if listenHost == "" {
-		listenHost = "0.0.0.0"
+// validate проверяет DNSSEC ответа и выставляет AD. false - ответ поддельный (bogus).
+func (s *Server) validate(ctx context.Context, query, resp *miekg_dns.Msg) (bool, string) {
+	if s.validator == nil || len(query.Question) != 1 {
+		return true, ""
 	}
+	status, why := s.validator.validate(ctx, query.Question[0], resp)
+	resp.AuthenticatedData = status == statusSecure &&
+		(resp.Rcode == miekg_dns.RcodeSuccess || resp.Rcode == miekg_dns.RcodeNameError)
+	return status != statusBogus, why
+}
 
+func (s *Server) store(key string, query *miekg_dns.Msg, upstreams []string, resp *miekg_dns.Msg) {
+	ttl := time.Duration(s.cfg.TTL) * time.Second
+	entry := &cacheEntry{
+		msg:       resp.Copy(),
+		expiry:    time.Now().Add(ttl),
+		ttl:       ttl,
+		query:     query,
+		upstreams: upstreams,
+	}
+	s.mu.Lock()
+	s.cache[key] = entry
+	s.mu.Unlock()
+}
+
+func (s *Server) writeCached(w miekg_dns.ResponseWriter, r, msg *miekg_dns.Msg) {
+	cached := msg.Copy()
+	rcode := cached.Rcode
+	cached.SetReply(r)
+	cached.Rcode = rcode
+	s.writeForwarded(w, r, cached)
+}
+
+// writeStale отдаёт просроченный ответ с коротким TTL и EDE "Stale Answer" (RFC 8767, RFC 8914)
+func (s *Server) writeStale(w miekg_dns.ResponseWriter, r, msg *miekg_dns.Msg) {
+	stale := msg.Copy()
+	for _, section := range [][]miekg_dns.RR{stale.Answer, stale.Ns, stale.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != miekg_dns.TypeOPT {
+				h.Ttl = s.cfg.ServeStale.AnswerTTL
+			}
+		}
+	}
+	if stale.IsEdns0() == nil {
+		stale.SetEdns0(ednsUDPSize, false)
+	}
+	opt := stale.IsEdns0()
+	opt.Option = append(opt.Option, &miekg_dns.EDNS0_EDE{InfoCode: miekg_dns.ExtendedErrorCodeStaleAnswer})
+	s.writeCached(w, r, stale)
+}
+
+// exchange отправляет запрос апстримам по очереди до первого подходящего ответа
+// и отбрасывает из него записи вне bailiwick. Без апстримов в рекурсивном
+// режиме запрос разрешается самим сервером. Время до дедлайна ctx делится
+// между оставшимися апстримами, чтобы медленный первый не съел его целиком.
+func (s *Server) exchange(ctx context.Context, m *miekg_dns.Msg, upstreams []string) (*miekg_dns.Msg, error) {
+	if len(upstreams) == 0 && s.resolver != nil && len(m.Question) == 1 {
+		return s.resolver.resolve(ctx, m)
+	}
+	if len(m.Question) != 1 {
+		return s.exchangeRaw(ctx, m, upstreams)
+	}
+
+	err := errors.New("no upstreams")
+	for i, ns := range upstreams {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var resp *miekg_dns.Msg
+		resp, err = s.exchangeOne(ctx, m, ns, len(upstreams)-i)
+		if err != nil {
+			logging.Ctx(ctx).Debugf("%s: %s: %v", ns, m.Question[0].Name, err)
+			continue
+		}
+		if n := scrub(resp, s.findForward(m.Question[0].Name).name); n > 0 {
+			logging.Ctx(ctx).Warnf("%s: dropped %d out-of-bailiwick records: %s", ns, n, m.Question[0].Name)
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// attemptContext отводит попытке равную долю времени, оставшегося до дедлайна
+func attemptContext(ctx context.Context, attemptsLeft int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || attemptsLeft <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(attemptsLeft))
+}
+
+// exchangeOne отправляет запрос одному серверу. Имя уходит со случайным
+// регистром (0x20) и новым ID, вопрос ответа должен совпасть точно.
+// Обрезанный (TC) ответ и ответ с другим регистром запрашиваются повторно
+// по TCP: сервер мог не сохранить регистр, а подделать ответ по TCP сложнее.
+// attemptsLeft - сколько серверов ещё можно спросить, включая этот.
+func (s *Server) exchangeOne(ctx context.Context, m *miekg_dns.Msg, ns string, attemptsLeft int) (*miekg_dns.Msg, error) {
+	ctx, cancel := attemptContext(ctx, attemptsLeft)
+	defer cancel()
+
+	q := m.Copy()
+	q.Id = miekg_dns.Id()
+	if !s.cfg.Hardening.Disable0x20 {
+		q.Question[0].Name = randomizeCase(q.Question[0].Name)
+	}
+
+	u := parseUpstream(ns)
+	var resp *miekg_dns.Msg
+	var err error
+	if u.proto == "" {
+		resp, err = s.exchangeUDP(ctx, q, u.addr)
+		if err == nil {
+			err = checkQuestion(q, resp, true)
+		}
+	}
+	if u.proto != "" || errors.Is(err, errQuestionMismatch) || err == nil && resp.Truncated {
+		resp, err = s.pools.exchange(ctx, u, q)
+		if err == nil {
+			err = checkQuestion(q, resp, false)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, errQuestionMismatch) {
+			logging.Ctx(ctx).Warnf("%s: %v: %s", ns, err, m.Question[0].Name)
+		}
+		return nil, err
+	}
+	restoreQuestion(m, resp)
+	return resp, nil
+}
+
+// exchangeUDP - запрос по UDP, прерываемый отменой ctx: miekg/dns
+// учитывает только дедлайн, а при остановке сервера ждать его не нужно
+func (s *Server) exchangeUDP(ctx context.Context, m *miekg_dns.Msg, addr string) (*miekg_dns.Msg, error) {
+	co, err := s.client.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+	stop := context.AfterFunc(ctx, func() { co.Close() })
+	defer stop()
+
+	resp, _, err := s.client.ExchangeWithConnContext(ctx, m, co)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// exchangeRaw - запрос без единственного вопроса пересылается как есть
+func (s *Server) exchangeRaw(ctx context.Context, m *miekg_dns.Msg, upstreams []string) (*miekg_dns.Msg, error) {
+	err := errors.New("no upstreams")
+	for i, ns := range upstreams {
+		actx, cancel := attemptContext(ctx, len(upstreams)-i)
+		u := parseUpstream(ns)
+		var resp *miekg_dns.Msg
+		if u.proto == "" {
+			resp, err = s.exchangeUDP(actx, m, u.addr)
+		}
+		if u.proto != "" || err == nil && resp != nil && resp.Truncated {
+			resp, err = s.pools.exchange(actx, u, m)
+		}
+		cancel()
+		if err == nil && resp != nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// queryUpstream - служебный запрос (для валидатора): с DO и CD, без кеша.
+// Идёт в счёт дедлайна клиентского запроса и получает половину оставшегося
+// времени: после него могут понадобиться другие звенья цепочки доверия.
+func (s *Server) queryUpstream(ctx context.Context, name string, qtype uint16) (*miekg_dns.Msg, error) {
+	ctx, cancel := attemptContext(ctx, 2)
+	defer cancel()
+	m := new(miekg_dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(ednsUDPSize, true)
+	m.CheckingDisabled = true
+	return s.exchange(ctx, m, s.findForward(name).upstreams)
+}
+
+// upstreamQuery собирает запрос к апстриму со своим OPT: размер буфера клиента
+// к апстриму отношения не имеет. При валидации просим подписи и отключаем его
+// собственную проверку. ECS клиента заменяется на ecs (или убирается).
+func (s *Server) upstreamQuery(r *miekg_dns.Msg, ecs *miekg_dns.EDNS0_SUBNET) *miekg_dns.Msg {
+	q := r.Copy()
+	q.Extra = nil
+	for _, rr := range r.Extra {
+		if t := rr.Header().Rrtype; t != miekg_dns.TypeOPT && t != miekg_dns.TypeTSIG {
+			q.Extra = append(q.Extra, rr)
+		}
+	}
+
+	opt := r.IsEdns0()
+	do := opt != nil && opt.Do()
+	if s.validator != nil {
+		do = true
+		q.CheckingDisabled = true
+	}
+	q.SetEdns0(ednsUDPSize, do)
+	if ecs != nil {
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, ecs)
+	}
+	return q
+}
+
+// writeForwarded отдаёт клиенту ответ апстрима с учётом его EDNS и бита DO
+func (s *Server) writeForwarded(w miekg_dns.ResponseWriter, r, resp *miekg_dns.Msg) {
+	resp.CheckingDisabled = r.CheckingDisabled
+	if opt := r.IsEdns0(); len(r.Question) == 1 && (opt == nil || !opt.Do()) {
+		stripDNSSEC(resp, r.Question[0].Qtype)
+		resp.AuthenticatedData = resp.AuthenticatedData && r.AuthenticatedData
+	}
+	writeMsg(w, r, resp)
+}
+
+// setEdns заменяет OPT ответа на свой, если клиент прислал OPT (RFC 6891, 6.1.1)
+func setEdns(r, m *miekg_dns.Msg) {
+	var scope uint8
+	if ecs := ednsSubnet(m); ecs != nil {
+		scope = ecs.SourceScope
+	}
+	var ede []miekg_dns.EDNS0
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == miekg_dns.EDNS0EDE {
+				ede = append(ede, o)
+			}
+		}
+	}
+
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != miekg_dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(ednsUDPSize, opt.Do())
+		// ECS клиента возвращаем с scope ответа (RFC 7871, 7.2.1)
+		if ecs := ednsSubnet(r); ecs != nil {
+			echo := *ecs
+			echo.SourceScope = min(scope, ecs.SourceNetmask)
+			reply := m.IsEdns0()
+			reply.Option = append(reply.Option, &echo)
+		}
+		reply := m.IsEdns0()
+		reply.Option = append(reply.Option, ede...)
+	}
+}
+
+// truncate обрезает ответ по UDP до размера буфера клиента и выставляет TC
+func truncate(w miekg_dns.ResponseWriter, r, m *miekg_dns.Msg) {
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); !udp {
+		return
+	}
+	size := miekg_dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+	m.Compress = true
+	m.Truncate(size)
+}
+
+func sanitizeUpstreams(listeners []config.ListenerConfig, ns []string) []string {
+	/// Защита от петли
 	bad := map[string]bool{
 		"127.0.0.1": true, "::1": true, "127.0.0.53": true,
-		listenHost: true,
+	}
+	for _, l := range listeners {
+		listenHost, _, _ := net.SplitHostPort(l.Address)
+		if listenHost == "" {
+			listenHost = "0.0.0.0"
+		}
+		bad[listenHost] = true
 	}
 
 	var out []string
 	for _, s := range ns {
-		host, port, _ := net.SplitHostPort(s)
-		if host == "" {
-			host = s
-			port = "53"
-		}
-		if !bad[host] {
-			out = append(out, net.JoinHostPort(host, port))
+		u := parseUpstream(s)
+		host, _, _ := net.SplitHostPort(u.addr)
+		// DoT сами не обслуживаем, петли быть не может
+		if !bad[host] || u.proto == config.UpstreamTLS {
+			out = append(out, u.String())
 		}
 	}
 	return out
@@ -177,7 +695,8 @@ func (s *Server) startCacheCleaner(ctx context.Context) {
 			return
 
 		case <- ticker.C:
-		now := time.Now()
+		// Просроченные записи держим ещё max_stale для serve-stale
+		now := time.Now().Add(-s.cfg.ServeStale.MaxStale)
 		s.mu.Lock()
 			for k, v := range s.cache {
 				if now.After(v.expiry) {
@@ -189,22 +708,88 @@ func (s *Server) startCacheCleaner(ctx context.Context) {
 	}
 }
 
+// acceptMsg дополнительно пропускает UPDATE: в нём секции могут содержать много записей
+func acceptMsg(dh miekg_dns.Header) miekg_dns.MsgAcceptAction {
+	isResponse := dh.Bits&(1<<15) != 0
+	opcode := int(dh.Bits>>11) & 0xF
+	if !isResponse && opcode == miekg_dns.OpcodeUpdate {
+		return miekg_dns.MsgAccept
+	}
+	return miekg_dns.DefaultMsgAcceptFunc(dh)
+}
+
 func (s *Server) Run(ctx context.Context) error {
-	go s.startCacheCleaner(ctx)
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Запросы в работе отменяются вместе с сервером
+	s.ctx = ctx
+	defer s.pools.close()
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.startCacheCleaner(ctx)
+	}()
+	if s.cfg.Services.Domain != "" {
+		go s.expireServices(ctx)
+	}
+	s.runHealthChecks(ctx)
+
+	for _, z := range s.zones {
+		if z.secondary() {
+			go s.runSecondary(ctx, z)
+		} else {
+			s.sendNotify(z)
+		}
+	}
 
-	udp := &miekg_dns.Server{Addr: s.cfg.Listen, Net: "udp", Handler: miekg_dns.HandlerFunc(s.ServeDNS)}
-	tcp := &miekg_dns.Server{Addr: s.cfg.Listen, Net: "tcp", Handler: miekg_dns.HandlerFunc(s.ServeDNS)}
+	secrets := make(map[string]string, len(s.cfg.TSIGKeys))
+	for name, key := range s.cfg.TSIGKeys {
+		secrets[name] = key.Secret
+	}
 
-	errCh := make(chan error, 2)
+	servers := s.dnsServers(secrets)
+	errCh := make(chan error, len(servers)+1)
+	var wg sync.WaitGroup
+	stop := func() {
+		cancel()
+		shutdownServers(servers)
+		wg.Wait()
+		// Обработчики завершились, новых prefetch не будет
+		s.background.Wait()
+	}
 
-	go func() { errCh <- udp.ListenAndServe() }()
-	go func() { errCh <- tcp.ListenAndServe() }()
+	if err := startServers(servers, &wg, ctx.Done(), errCh); err != nil {
+		stop()
+		return err
+	}
+	if s.cfg.Admin.Listen != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.runAdmin(ctx); err != nil || ctx.Err() == nil {
+				errCh <- err
+			}
+		}()
+	}
 
-	go func() {
-		<-ctx.Done()
-		_ = udp.Shutdown()
-		_ = tcp.Shutdown()
-	}()
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+	case s.next = <-s.reloadCh:
+		// Освобождаем порты для нового сервера, кеш он заберёт через Next
+		stop()
+		return ErrReload
+	}
+	stop()
 
-	return <-errCh
+	// Сохраняем кеш только при штатной остановке, чтобы не затереть файл при ошибке запуска
+	if parent.Err() != nil {
+		if err := s.saveCache(); err != nil {
+			logging.Errorf("failed to save cache: %v", err)
+		}
+	}
+	return err
 }
@@ -0,0 +1,227 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestServeStale(t *testing.T) {
+	servfail := HandlerFunc(func(_ context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+		m := new(miekg_dns.Msg)
+		m.SetRcode(r, miekg_dns.RcodeServerFailure)
+		writeMsg(w, r, m)
+	})
+	fresh := HandlerFunc(func(_ context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+		writeMsg(w, r, cachedReply("stale.test.", 300))
+	})
+	slow := HandlerFunc(func(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+		}
+		fresh(ctx, w, r)
+	})
+
+	tests := []struct {
+		name     string
+		maxStale string
+		expired  time.Duration // сколько назад истекла запись
+		next     Handler
+		stale    bool
+		rcode    int
+	}{
+		{name: "upstream failed", maxStale: "1h", expired: time.Minute, next: servfail, stale: true},
+		{name: "upstream slow", maxStale: "1h", expired: time.Minute, next: slow, stale: true},
+		{name: "upstream answered", maxStale: "1h", expired: time.Minute, next: fresh},
+		{name: "beyond stale window", maxStale: "1h", expired: 2 * time.Hour, next: servfail, rcode: miekg_dns.RcodeServerFailure},
+		{name: "serve-stale disabled", maxStale: "0s", expired: time.Second, next: servfail, rcode: miekg_dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, `
+listen: 127.0.0.1:0
+serve_stale:
+  max_stale: `+tt.maxStale+`
+  answer_ttl: 7
+  client_timeout: 50ms
+`)
+			r := new(miekg_dns.Msg)
+			r.SetQuestion("stale.test.", miekg_dns.TypeA)
+			r.SetEdns0(1232, false)
+			s.cache[s.cacheKey(r)] = &cacheEntry{msg: cachedReply("stale.test.", 300), expiry: time.Now().Add(-tt.expired)}
+
+			w := udpClient("192.0.2.10")
+			start := time.Now()
+			s.serveCache(context.Background(), w, r, tt.next)
+			elapsed := time.Since(start)
+			s.background.Wait()
+
+			if w.msg == nil {
+				t.Fatal("no reply")
+			}
+			if w.msg.Rcode != tt.rcode {
+				t.Fatalf("rcode %s, want %s", miekg_dns.RcodeToString[w.msg.Rcode], miekg_dns.RcodeToString[tt.rcode])
+			}
+			if elapsed > 400*time.Millisecond {
+				t.Errorf("stale answer after %v, client_timeout ignored", elapsed)
+			}
+			var ede *miekg_dns.EDNS0_EDE
+			if opt := w.msg.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if e, ok := o.(*miekg_dns.EDNS0_EDE); ok {
+						ede = e
+					}
+				}
+			}
+			if !tt.stale {
+				if ede != nil {
+					t.Errorf("unexpected EDE %d", ede.InfoCode)
+				}
+				return
+			}
+			if ede == nil || ede.InfoCode != miekg_dns.ExtendedErrorCodeStaleAnswer {
+				t.Errorf("EDE %v, want Stale Answer", ede)
+			}
+			if len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Ttl != 7 {
+				t.Errorf("stale answer %v, want TTL 7", w.msg.Answer)
+			}
+		})
+	}
+}
+
+func bigReply(r *miekg_dns.Msg, n int) *miekg_dns.Msg {
+	m := new(miekg_dns.Msg)
+	m.SetReply(r)
+	for i := range n {
+		m.Answer = append(m.Answer, testRR("%s 300 IN A 198.51.100.%d", r.Question[0].Name, i+1))
+	}
+	return m
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name      string
+		edns      uint16 // 0 - без OPT
+		tcp       bool
+		truncated bool
+		maxSize   int
+	}{
+		{name: "UDP without EDNS", truncated: true, maxSize: miekg_dns.MinMsgSize},
+		{name: "UDP with small buffer", edns: 1232, truncated: true, maxSize: 1232},
+		{name: "UDP with large buffer", edns: 4096, maxSize: 4096},
+		{name: "TCP", tcp: true, maxSize: miekg_dns.MaxMsgSize},
+	}
+	for _, tt := range tests {
+		r := new(miekg_dns.Msg)
+		r.SetQuestion("big.test.", miekg_dns.TypeA)
+		if tt.edns > 0 {
+			r.SetEdns0(tt.edns, false)
+		}
+		w := udpClient("192.0.2.10")
+		if tt.tcp {
+			w = &testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5353}}
+		}
+		// 100 записей A - около 1700 байт со сжатием
+		writeMsg(w, r, bigReply(r, 100))
+		if w.msg.Truncated != tt.truncated || w.msg.Len() > tt.maxSize {
+			t.Errorf("%s: TC=%v, %d bytes, want TC=%v and at most %d", tt.name, w.msg.Truncated, w.msg.Len(), tt.truncated, tt.maxSize)
+		}
+		if !tt.truncated && len(w.msg.Answer) != 100 {
+			t.Errorf("%s: %d records, want 100", tt.name, len(w.msg.Answer))
+		}
+	}
+}
+
+func TestSetEdns(t *testing.T) {
+	upstream := func() *miekg_dns.Msg {
+		m := new(miekg_dns.Msg)
+		m.SetEdns0(4096, true)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option,
+			&miekg_dns.EDNS0_NSID{Code: miekg_dns.EDNS0NSID, Nsid: "6e73"},
+			&miekg_dns.EDNS0_EDE{InfoCode: miekg_dns.ExtendedErrorCodeStaleAnswer})
+		return m
+	}
+
+	// Клиент без OPT получает ответ без OPT
+	m := upstream()
+	setEdns(new(miekg_dns.Msg), m)
+	if m.IsEdns0() != nil {
+		t.Error("OPT sent to a client without EDNS")
+	}
+
+	r := new(miekg_dns.Msg)
+	r.SetEdns0(512, true)
+	m = upstream()
+	setEdns(r, m)
+	opt := m.IsEdns0()
+	if opt == nil || opt.UDPSize() != ednsUDPSize || !opt.Do() {
+		t.Fatalf("OPT %v, want our buffer size and DO", opt)
+	}
+	if len(opt.Option) != 1 || opt.Option[0].Option() != miekg_dns.EDNS0EDE {
+		t.Errorf("options %v, want only EDE", opt.Option)
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	s, _ := newTestServer(t, "listen: 127.0.0.1:0\n")
+	r := new(miekg_dns.Msg)
+	r.SetQuestion("example.test.", miekg_dns.TypeA)
+	r.SetEdns0(1232, false)
+	r.IsEdns0().SetVersion(1)
+	w := udpClient("192.0.2.10")
+	s.ServeDNS(w, r)
+	if w.msg.Rcode != miekg_dns.RcodeBadVers || w.msg.IsEdns0() == nil {
+		t.Errorf("reply %s, want BADVERS with OPT", miekg_dns.RcodeToString[w.msg.Rcode])
+	}
+}
+
+func TestUpstreamQuery(t *testing.T) {
+	s, _ := newTestServer(t, "listen: 127.0.0.1:0\n")
+	r := new(miekg_dns.Msg)
+	r.SetQuestion("example.test.", miekg_dns.TypeA)
+	r.SetEdns0(512, true)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &miekg_dns.EDNS0_COOKIE{Code: miekg_dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	r.SetTsig("key.", miekg_dns.HmacSHA256, 300, time.Now().Unix())
+
+	q := s.upstreamQuery(r, nil)
+	opt := q.IsEdns0()
+	if opt == nil || opt.UDPSize() != ednsUDPSize || !opt.Do() || len(opt.Option) != 0 {
+		t.Errorf("upstream OPT %v, want our size, DO and no client options", opt)
+	}
+	if q.IsTsig() != nil {
+		t.Error("client TSIG forwarded upstream")
+	}
+	if r.IsEdns0().UDPSize() != 512 {
+		t.Error("client query modified")
+	}
+}
+
+// Ответ апстрима с TC повторяется по TCP
+func TestExchangeTruncatedRetry(t *testing.T) {
+	addr := serveTest(t, miekg_dns.HandlerFunc(func(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+		m := bigReply(r, 100)
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			m.Answer = nil
+			m.Truncated = true
+		}
+		_ = w.WriteMsg(m)
+	}), nil)
+
+	s, _ := newTestServer(t, "listen: 127.0.0.1:0\n")
+	defer s.pools.close()
+	m := new(miekg_dns.Msg)
+	m.SetQuestion("big.test.", miekg_dns.TypeA)
+	m.SetEdns0(ednsUDPSize, false)
+	resp, err := s.exchangeOne(context.Background(), m, addr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Truncated || len(resp.Answer) != 100 {
+		t.Errorf("TC=%v with %d records, want full answer over TCP", resp.Truncated, len(resp.Answer))
+	}
+}
@@ -0,0 +1,377 @@
+package dns
+
+import (
+	"context"
+	"dns-server/internal/logging"
+	"encoding/json"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Реестр сервисов: экземпляры регистрируются через API (POST /services)
+// и публикуются в services.domain:
+//
+//	<сервис>.<domain>            A/AAAA всех живых экземпляров
+//	<id>.<сервис>.<domain>       A/AAAA одного экземпляра
+//	_<сервис>._<proto>.<domain>  SRV на экземпляры
+//
+// Повторная регистрация того же экземпляра - heartbeat: продлевает его на ttl.
+// Экземпляр, не приславший heartbeat вовремя, пропадает из ответов.
+
+// Наибольший ttl регистрации: сутки. Больше - скорее ошибка клиента, да и
+// time.Duration от огромного ttl переполнился бы
+const maxServiceTTL = 86400
+
+type serviceInstance struct {
+	Name     string    `json:"name"`
+	ID       string    `json:"id"`
+	Address  string    `json:"address"`
+	Port     uint16    `json:"port"`
+	Protocol string    `json:"protocol"`
+	TTL      int       `json:"ttl"` // секунды
+	Expires  time.Time `json:"expires"`
+
+	ip net.IP
+}
+
+type serviceRegistry struct {
+	mu       sync.RWMutex
+	services map[string]map[string]*serviceInstance // сервис -> id -> экземпляр
+	serial   atomic.Uint32                          // для SOA, растёт при изменениях
+}
+
+func newServiceRegistry() *serviceRegistry {
+	sr := &serviceRegistry{services: make(map[string]map[string]*serviceInstance)}
+	sr.serial.Store(uint32(time.Now().Unix()))
+	return sr
+}
+
+// register добавляет или продлевает экземпляр; true - экземпляр новый или изменился
+func (sr *serviceRegistry) register(inst *serviceInstance) bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	instances, ok := sr.services[inst.Name]
+	if !ok {
+		instances = make(map[string]*serviceInstance)
+		sr.services[inst.Name] = instances
+	}
+	old, ok := instances[inst.ID]
+	instances[inst.ID] = inst
+	changed := !ok || !old.ip.Equal(inst.ip) || old.Port != inst.Port || old.Protocol != inst.Protocol
+	if changed {
+		sr.serial.Add(1)
+	}
+	return changed
+}
+
+func (sr *serviceRegistry) deregister(name, id string) bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if _, ok := sr.services[name][id]; !ok {
+		return false
+	}
+	delete(sr.services[name], id)
+	if len(sr.services[name]) == 0 {
+		delete(sr.services, name)
+	}
+	sr.serial.Add(1)
+	return true
+}
+
+// expire удаляет просроченные экземпляры и возвращает их
+func (sr *serviceRegistry) expire(now time.Time) []*serviceInstance {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	var expired []*serviceInstance
+	for name, instances := range sr.services {
+		for id, inst := range instances {
+			if now.After(inst.Expires) {
+				expired = append(expired, inst)
+				delete(instances, id)
+			}
+		}
+		if len(instances) == 0 {
+			delete(sr.services, name)
+		}
+	}
+	if len(expired) > 0 {
+		sr.serial.Add(1)
+	}
+	return expired
+}
+
+// live - неистёкшие экземпляры сервиса (все сервисы, если name пусто), по id
+func (sr *serviceRegistry) live(name string, now time.Time) []serviceInstance {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	var out []serviceInstance
+	for svc, instances := range sr.services {
+		if name != "" && svc != name {
+			continue
+		}
+		for _, inst := range instances {
+			if now.Before(inst.Expires) {
+				out = append(out, *inst)
+			}
+		}
+	}
+	slices.SortFunc(out, func(a, b serviceInstance) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return out
+}
+
+// hasProtocol - есть ли сервисы с таким протоколом (имя _<proto>.<domain> существует)
+func (sr *serviceRegistry) hasProtocol(proto string, now time.Time) bool {
+	for _, inst := range sr.live("", now) {
+		if inst.Protocol == proto {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) expireServices(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, inst := range s.services.expire(now) {
+				logging.Infof("service %s/%s expired", inst.Name, inst.ID)
+			}
+		}
+	}
+}
+
+// serveServices - плагин services: ответы на имена в services.domain
+func (s *Server) serveServices(ctx context.Context, w miekg_dns.ResponseWriter, r *miekg_dns.Msg, next Handler) {
+	domain := s.cfg.Services.Domain
+	q := r.Question[0]
+	name := miekg_dns.CanonicalName(q.Name)
+	if domain == "" || !miekg_dns.IsSubDomain(domain, name) || q.Qtype == miekg_dns.TypeAXFR || q.Qtype == miekg_dns.TypeIXFR {
+		next.ServeDNS(ctx, w, r)
+		return
+	}
+
+	msg := new(miekg_dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+	msg.Answer, msg.Extra, msg.Rcode = s.lookupService(name, q.Qtype)
+	if len(msg.Answer) == 0 {
+		msg.Ns = []miekg_dns.RR{s.servicesSOA()}
+	}
+	writeMsg(w, r, msg)
+}
+
+func (s *Server) lookupService(name string, qtype uint16) ([]miekg_dns.RR, []miekg_dns.RR, int) {
+	domain := s.cfg.Services.Domain
+	labels := miekg_dns.SplitDomainName(strings.TrimSuffix(name, domain))
+	if name == domain {
+		labels = nil
+	}
+	now := time.Now()
+
+	switch {
+	case len(labels) == 0:
+		if qtype == miekg_dns.TypeSOA || qtype == miekg_dns.TypeANY {
+			return []miekg_dns.RR{s.servicesSOA()}, nil, miekg_dns.RcodeSuccess
+		}
+		return nil, nil, miekg_dns.RcodeSuccess
+
+	case len(labels) == 1 && strings.HasPrefix(labels[0], "_"):
+		// _<proto>.<domain> - промежуточное имя для SRV, своих данных нет
+		if s.services.hasProtocol(labels[0][1:], now) {
+			return nil, nil, miekg_dns.RcodeSuccess
+		}
+
+	case len(labels) == 1:
+		if instances := s.services.live(labels[0], now); len(instances) > 0 {
+			return s.serviceAddresses(name, qtype, instances), nil, miekg_dns.RcodeSuccess
+		}
+
+	case len(labels) == 2 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_"):
+		var instances []serviceInstance
+		for _, inst := range s.services.live(labels[0][1:], now) {
+			if inst.Protocol == labels[1][1:] {
+				instances = append(instances, inst)
+			}
+		}
+		if len(instances) == 0 {
+			break
+		}
+		if qtype != miekg_dns.TypeSRV && qtype != miekg_dns.TypeANY {
+			return nil, nil, miekg_dns.RcodeSuccess
+		}
+		rand.Shuffle(len(instances), func(i, j int) { instances[i], instances[j] = instances[j], instances[i] })
+		var answer, extra []miekg_dns.RR
+		for _, inst := range instances {
+			target := inst.ID + "." + inst.Name + "." + domain
+			answer = append(answer, &miekg_dns.SRV{
+				Hdr:      miekg_dns.RR_Header{Name: name, Rrtype: miekg_dns.TypeSRV, Class: miekg_dns.ClassINET, Ttl: s.cfg.Services.RecordTTL},
+				Priority: 0,
+				Weight:   10,
+				Port:     inst.Port,
+				Target:   target,
+			})
+			extra = append(extra, s.serviceAddresses(target, miekg_dns.TypeANY, []serviceInstance{inst})...)
+		}
+		return answer, extra, miekg_dns.RcodeSuccess
+
+	case len(labels) == 2:
+		for _, inst := range s.services.live(labels[1], now) {
+			if inst.ID == labels[0] {
+				return s.serviceAddresses(name, qtype, []serviceInstance{inst}), nil, miekg_dns.RcodeSuccess
+			}
+		}
+	}
+	return nil, nil, miekg_dns.RcodeNameError
+}
+
+// serviceAddresses - A/AAAA экземпляров в случайном порядке, чтобы клиенты
+// распределялись между ними
+func (s *Server) serviceAddresses(name string, qtype uint16, instances []serviceInstance) []miekg_dns.RR {
+	var out []miekg_dns.RR
+	for _, inst := range instances {
+		ip4 := inst.ip.To4()
+		hdr := miekg_dns.RR_Header{Name: name, Class: miekg_dns.ClassINET, Ttl: s.cfg.Services.RecordTTL}
+		switch {
+		case ip4 != nil && (qtype == miekg_dns.TypeA || qtype == miekg_dns.TypeANY):
+			hdr.Rrtype = miekg_dns.TypeA
+			out = append(out, &miekg_dns.A{Hdr: hdr, A: ip4})
+		case ip4 == nil && (qtype == miekg_dns.TypeAAAA || qtype == miekg_dns.TypeANY):
+			hdr.Rrtype = miekg_dns.TypeAAAA
+			out = append(out, &miekg_dns.AAAA{Hdr: hdr, AAAA: inst.ip})
+		}
+	}
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	return out
+}
+
+func (s *Server) servicesSOA() *miekg_dns.SOA {
+	domain := s.cfg.Services.Domain
+	ttl := s.cfg.Services.RecordTTL
+	return &miekg_dns.SOA{
+		Hdr:     miekg_dns.RR_Header{Name: domain, Rrtype: miekg_dns.TypeSOA, Class: miekg_dns.ClassINET, Ttl: ttl},
+		Ns:      "ns." + domain,
+		Mbox:    "hostmaster." + domain,
+		Serial:  s.services.serial.Load(),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+// validLabel - имя сервиса или экземпляра должно быть одной меткой DNS
+func validLabel(s string) bool {
+	if s == "" || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) servicesEnabled(w http.ResponseWriter) bool {
+	if s.cfg.Services.Domain == "" {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "services.domain is not configured"})
+		return false
+	}
+	return true
+}
+
+// handleRegister регистрирует экземпляр или продлевает его (heartbeat)
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if !s.servicesEnabled(w) {
+		return
+	}
+	var inst serviceInstance
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&inst); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON: " + err.Error()})
+		return
+	}
+
+	inst.Name = strings.ToLower(inst.Name)
+	inst.ip = net.ParseIP(inst.Address)
+	if inst.ID == "" && inst.ip != nil {
+		inst.ID = strings.NewReplacer(".", "-", ":", "-").Replace(inst.ip.String()) + "-" + strconv.Itoa(int(inst.Port))
+	}
+	inst.ID = strings.Trim(strings.ToLower(inst.ID), "-")
+	if inst.Protocol == "" {
+		inst.Protocol = "tcp"
+	}
+	var bad string
+	switch {
+	case !validLabel(inst.Name):
+		bad = "invalid name: " + inst.Name
+	case inst.ip == nil:
+		bad = "invalid address: " + inst.Address
+	case !validLabel(inst.ID):
+		bad = "invalid id: " + inst.ID
+	case inst.Port == 0:
+		bad = "port is required"
+	case inst.Protocol != "tcp" && inst.Protocol != "udp":
+		bad = "protocol must be tcp or udp: " + inst.Protocol
+	case inst.TTL < 0 || inst.TTL > maxServiceTTL:
+		bad = "ttl must be between 1 and " + strconv.Itoa(maxServiceTTL)
+	}
+	if bad != "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": bad})
+		return
+	}
+	if inst.TTL == 0 {
+		inst.TTL = int(s.cfg.Services.DefaultTTL / time.Second)
+	}
+	if ip4 := inst.ip.To4(); ip4 != nil {
+		inst.ip = ip4
+	}
+	inst.Address = inst.ip.String()
+	inst.Expires = time.Now().Add(time.Duration(inst.TTL) * time.Second)
+
+	if s.services.register(&inst) {
+		logging.Infof("service %s/%s registered at %s", inst.Name, inst.ID, net.JoinHostPort(inst.Address, strconv.Itoa(int(inst.Port))))
+	}
+	writeJSON(w, http.StatusOK, inst)
+}
+
+func (s *Server) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	if !s.servicesEnabled(w) {
+		return
+	}
+	name, id := r.PathValue("name"), r.PathValue("id")
+	if !s.services.deregister(name, id) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no instance " + id + " of " + name})
+		return
+	}
+	logging.Infof("service %s/%s deregistered", name, id)
+	writeJSON(w, http.StatusOK, map[string]int{"removed": 1})
+}
+
+func (s *Server) handleServices(w http.ResponseWriter, r *http.Request) {
+	if !s.servicesEnabled(w) {
+		return
+	}
+	instances := s.services.live(r.URL.Query().Get("name"), time.Now())
+	if instances == nil {
+		instances = []serviceInstance{}
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
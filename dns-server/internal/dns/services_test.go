@@ -0,0 +1,164 @@
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+func TestServicesAPI(t *testing.T) {
+	s, _ := newTestServer(t, "listen: 127.0.0.1:0\nservices:\n  domain: svc.test\n")
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{name: "register", body: `{"name": "api", "address": "10.0.0.5", "port": 8080, "ttl": 15}`, code: http.StatusOK},
+		{name: "default ttl", body: `{"name": "api", "address": "10.0.0.6", "port": 8080, "id": "b"}`, code: http.StatusOK},
+		{name: "ipv6", body: `{"name": "api", "address": "2001:db8::7", "port": 8080, "protocol": "udp"}`, code: http.StatusOK},
+		{name: "largest ttl", body: `{"name": "big", "address": "10.0.0.9", "port": 1, "ttl": 86400}`, code: http.StatusOK},
+		{name: "ttl too large", body: `{"name": "api", "address": "10.0.0.5", "port": 8080, "ttl": 9999999999}`, code: http.StatusBadRequest},
+		{name: "negative ttl", body: `{"name": "api", "address": "10.0.0.5", "port": 8080, "ttl": -1}`, code: http.StatusBadRequest},
+		{name: "bad name", body: `{"name": "a.b", "address": "10.0.0.5", "port": 8080}`, code: http.StatusBadRequest},
+		{name: "bad address", body: `{"name": "api", "address": "nowhere", "port": 8080}`, code: http.StatusBadRequest},
+		{name: "no port", body: `{"name": "api", "address": "10.0.0.5"}`, code: http.StatusBadRequest},
+		{name: "bad protocol", body: `{"name": "api", "address": "10.0.0.5", "port": 1, "protocol": "sctp"}`, code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := adminRequest(s, http.MethodPost, "/services", tt.body)
+		if rec.Code != tt.code {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.code)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var inst serviceInstance
+		if err := json.Unmarshal(rec.Body.Bytes(), &inst); err != nil {
+			t.Fatal(err)
+		}
+		if left := time.Until(inst.Expires); left <= 0 || left > time.Duration(inst.TTL)*time.Second {
+			t.Errorf("%s: expires in %v with ttl %d", tt.name, left, inst.TTL)
+		}
+	}
+
+	var list []serviceInstance
+	rec := adminRequest(s, http.MethodGet, "/services?name=api", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, inst := range list {
+		ids = append(ids, inst.ID)
+	}
+	if want := []string{"10-0-0-5-8080", "2001-db8--7-8080", "b"}; !slices.Equal(ids, want) {
+		t.Errorf("instances %v, want %v", ids, want)
+	}
+	if list[2].TTL != 30 {
+		t.Errorf("default ttl %d, want 30", list[2].TTL)
+	}
+
+	if rec := adminRequest(s, http.MethodDelete, "/services/api/b", ""); rec.Code != http.StatusOK {
+		t.Errorf("deregister: %d %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(s, http.MethodDelete, "/services/api/b", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second deregister: %d, want 404", rec.Code)
+	}
+}
+
+func TestServicesExpire(t *testing.T) {
+	s, _ := newTestServer(t, "listen: 127.0.0.1:0\nservices:\n  domain: svc.test\n")
+	if rec := adminRequest(s, http.MethodPost, "/services", `{"name": "api", "address": "10.0.0.5", "port": 80, "ttl": 1}`); rec.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", rec.Code, rec.Body)
+	}
+	serial := s.services.serial.Load()
+
+	// Heartbeat без изменений продлевает экземпляр и не меняет serial
+	before := s.services.live("api", time.Now())[0].Expires
+	time.Sleep(10 * time.Millisecond)
+	adminRequest(s, http.MethodPost, "/services", `{"name": "api", "address": "10.0.0.5", "port": 80, "ttl": 1}`)
+	if after := s.services.live("api", time.Now())[0].Expires; !after.After(before) {
+		t.Error("heartbeat did not extend the instance")
+	}
+	if s.services.serial.Load() != serial {
+		t.Error("heartbeat changed the SOA serial")
+	}
+
+	if expired := s.services.expire(time.Now().Add(2 * time.Second)); len(expired) != 1 {
+		t.Fatalf("expired %d instances, want 1", len(expired))
+	}
+	if s.services.serial.Load() == serial {
+		t.Error("expiry did not change the SOA serial")
+	}
+	if _, _, rcode := s.lookupService("api.svc.test.", miekg_dns.TypeA); rcode != miekg_dns.RcodeNameError {
+		t.Errorf("expired service: %s, want NXDOMAIN", miekg_dns.RcodeToString[rcode])
+	}
+}
+
+func TestLookupService(t *testing.T) {
+	s, _ := newTestServer(t, "listen: 127.0.0.1:0\nservices:\n  domain: svc.test\n  record_ttl: 7\n")
+	for _, body := range []string{
+		`{"name": "api", "address": "10.0.0.5", "port": 8080}`,
+		`{"name": "api", "address": "10.0.0.6", "port": 8081}`,
+		`{"name": "api", "address": "2001:db8::7", "port": 8082, "protocol": "udp"}`,
+	} {
+		if rec := adminRequest(s, http.MethodPost, "/services", body); rec.Code != http.StatusOK {
+			t.Fatalf("register: %d %s", rec.Code, rec.Body)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []string
+		extra  []string
+	}{
+		{name: "api.svc.test.", qtype: miekg_dns.TypeA, answer: []string{"A 10.0.0.5", "A 10.0.0.6"}},
+		{name: "api.svc.test.", qtype: miekg_dns.TypeAAAA, answer: []string{"AAAA 2001:db8::7"}},
+		{name: "api.svc.test.", qtype: miekg_dns.TypeMX},
+		{name: "10-0-0-6-8081.api.svc.test.", qtype: miekg_dns.TypeA, answer: []string{"A 10.0.0.6"}},
+		{name: "_api._tcp.svc.test.", qtype: miekg_dns.TypeSRV,
+			answer: []string{"SRV 0 10 8080 10-0-0-5-8080.api.svc.test.", "SRV 0 10 8081 10-0-0-6-8081.api.svc.test."},
+			extra:  []string{"A 10.0.0.5", "A 10.0.0.6"}},
+		{name: "_api._udp.svc.test.", qtype: miekg_dns.TypeSRV,
+			answer: []string{"SRV 0 10 8082 2001-db8--7-8082.api.svc.test."},
+			extra:  []string{"AAAA 2001:db8::7"}},
+		{name: "_api._tcp.svc.test.", qtype: miekg_dns.TypeA},
+		{name: "_tcp.svc.test.", qtype: miekg_dns.TypeSRV},
+		{name: "svc.test.", qtype: miekg_dns.TypeSOA, answer: []string{"SOA ns.svc.test. hostmaster.svc.test."}},
+		{name: "missing.svc.test.", qtype: miekg_dns.TypeA, rcode: miekg_dns.RcodeNameError},
+		{name: "nope.api.svc.test.", qtype: miekg_dns.TypeA, rcode: miekg_dns.RcodeNameError},
+		{name: "_api._sctp.svc.test.", qtype: miekg_dns.TypeSRV, rcode: miekg_dns.RcodeNameError},
+	}
+	// Без имени и TTL; для SOA - без серийного номера и таймеров
+	brief := func(rrs []miekg_dns.RR) []string {
+		var out []string
+		for _, rr := range rrs {
+			if rr.Header().Ttl != 7 {
+				t.Errorf("%s: ttl %d, want record_ttl 7", rr, rr.Header().Ttl)
+			}
+			f := strings.Fields(rr.String())[3:]
+			if rr.Header().Rrtype == miekg_dns.TypeSOA {
+				f = f[:3]
+			}
+			out = append(out, strings.Join(f, " "))
+		}
+		slices.Sort(out)
+		return out
+	}
+	for _, tt := range tests {
+		answer, extra, rcode := s.lookupService(tt.name, tt.qtype)
+		if rcode != tt.rcode || !slices.Equal(brief(answer), tt.answer) || !slices.Equal(brief(extra), tt.extra) {
+			t.Errorf("%s/%s: %s %v %v, want %s %v %v", tt.name, miekg_dns.TypeToString[tt.qtype],
+				miekg_dns.RcodeToString[rcode], brief(answer), brief(extra),
+				miekg_dns.RcodeToString[tt.rcode], tt.answer, tt.extra)
+		}
+	}
+}
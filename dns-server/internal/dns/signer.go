@@ -0,0 +1,420 @@
+package dns
+
+import (
+	"crypto"
+	"dns-server/internal/config"
+	"dns-server/internal/logging"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Онлайн-подпись локальных зон: RRSIG считаются при ответе (с кешем),
+// NSEC/NSEC3 строятся по текущим данным зоны.
+//
+// Ротация ключей задаётся временными метками в конфиге:
+//   publish  - ключ появляется в DNSKEY,
+//   activate - ключ начинает подписывать,
+//   inactive - ключ перестаёт подписывать,
+//   delete   - ключ убирается из DNSKEY.
+// KSK (флаг SEP) подписывают DNSKEY, ZSK - всё остальное. Если активного ZSK
+// нет, KSK работает как CSK и подписывает всю зону.
+
+type zoneKey struct {
+	dnskey *miekg_dns.DNSKEY
+	priv   crypto.Signer
+
+	publish, activate, inactive, remove time.Time
+}
+
+func (k *zoneKey) published(now time.Time) bool {
+	return (k.publish.IsZero() || !now.Before(k.publish)) && (k.remove.IsZero() || now.Before(k.remove))
+}
+
+func (k *zoneKey) active(now time.Time) bool {
+	return k.published(now) && (k.activate.IsZero() || !now.Before(k.activate)) && (k.inactive.IsZero() || now.Before(k.inactive))
+}
+
+func (k *zoneKey) ksk() bool {
+	return k.dnskey.Flags&miekg_dns.SEP != 0
+}
+
+type cachedSig struct {
+	sig     *miekg_dns.RRSIG
+	refresh time.Time
+}
+
+// nsecChain - отсортированные имена зоны (или их хеши для NSEC3) для конкретного serial
+type nsecChain struct {
+	serial uint32
+	types  map[string][]uint16 // owner (включая empty non-terminals) -> типы
+	names  []string            // канонический порядок
+	hashes []string            // отсортированные хеши NSEC3
+	owners map[string]string   // хеш -> имя
+}
+
+type signer struct {
+	zone       string
+	keys       []*zoneKey
+	nsec3      bool
+	iterations uint16
+	salt       string
+	validity   time.Duration
+
+	mu    sync.Mutex
+	sigs  map[string]cachedSig
+	chain *nsecChain
+}
+
+func newSigner(zone string, sc *config.ZoneSigningConfig) (*signer, error) {
+	sg := &signer{
+		zone:       zone,
+		nsec3:      sc.NSEC3,
+		iterations: sc.NSEC3Iterations,
+		salt:       strings.ToUpper(sc.NSEC3Salt),
+		validity:   sc.SignatureValidity,
+		sigs:       make(map[string]cachedSig),
+	}
+
+	for _, kc := range sc.Keys {
+		k, err := loadZoneKey(kc.File)
+		if err != nil {
+			return nil, err
+		}
+		if miekg_dns.CanonicalName(k.dnskey.Hdr.Name) != zone {
+			return nil, errors.New("key " + kc.File + " does not belong to zone " + zone)
+		}
+		k.publish, k.activate, k.inactive, k.remove = kc.Publish, kc.Activate, kc.Inactive, kc.Delete
+		sg.keys = append(sg.keys, k)
+	}
+
+	// DS для родительской зоны
+	for _, k := range sg.keys {
+		if k.ksk() && k.published(time.Now()) {
+			logging.Infof("zone %s DS: %s", zone, k.dnskey.ToDS(miekg_dns.SHA256))
+		}
+	}
+	return sg, nil
+}
+
+func loadZoneKey(base string) (*zoneKey, error) {
+	pub, err := os.ReadFile(base + ".key")
+	if err != nil {
+		return nil, err
+	}
+	rr, err := miekg_dns.NewRR(string(pub))
+	if err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*miekg_dns.DNSKEY)
+	if !ok {
+		return nil, errors.New(base + ".key: not a DNSKEY")
+	}
+
+	f, err := os.Open(base + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	priv, err := dnskey.ReadPrivateKey(f, base+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New(base + ".private: unsupported key")
+	}
+	return &zoneKey{dnskey: dnskey, priv: signer}, nil
+}
+
+// apexRRset отдаёт записи, которые появляются в зоне только при подписи
+func (sg *signer) apexRRset(qtype uint16, ttl uint32) []miekg_dns.RR {
+	now := time.Now()
+	var out []miekg_dns.RR
+	switch qtype {
+	case miekg_dns.TypeDNSKEY:
+		for _, k := range sg.keys {
+			if k.published(now) {
+				key := miekg_dns.Copy(k.dnskey)
+				key.Header().Ttl = ttl
+				out = append(out, key)
+			}
+		}
+	case miekg_dns.TypeNSEC3PARAM:
+		if sg.nsec3 {
+			out = append(out, &miekg_dns.NSEC3PARAM{
+				Hdr:        miekg_dns.RR_Header{Name: sg.zone, Rrtype: miekg_dns.TypeNSEC3PARAM, Class: miekg_dns.ClassINET},
+				Hash:       miekg_dns.SHA1,
+				Iterations: sg.iterations,
+				SaltLength: uint8(len(sg.salt) / 2),
+				Salt:       sg.salt,
+			})
+		}
+	}
+	return out
+}
+
+// signingKeys выбирает активные ключи для RRset данного типа
+func (sg *signer) signingKeys(rrtype uint16) []*zoneKey {
+	now := time.Now()
+	var ksk, zsk []*zoneKey
+	for _, k := range sg.keys {
+		if !k.active(now) {
+			continue
+		}
+		if k.ksk() {
+			ksk = append(ksk, k)
+		} else {
+			zsk = append(zsk, k)
+		}
+	}
+	if rrtype == miekg_dns.TypeDNSKEY && len(ksk) > 0 {
+		return ksk
+	}
+	if len(zsk) == 0 {
+		return ksk
+	}
+	return zsk
+}
+
+// signRRset возвращает подписи для RRset (из кеша, если ещё свежие)
+func (sg *signer) signRRset(rrset []miekg_dns.RR) []miekg_dns.RR {
+	h := rrset[0].Header()
+	var out []miekg_dns.RR
+	now := time.Now()
+
+	for _, k := range sg.signingKeys(h.Rrtype) {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%d/%d/", k.dnskey.Algorithm, k.dnskey.KeyTag())
+		for _, rr := range rrset {
+			b.WriteString(rr.String())
+		}
+		cacheKey := b.String()
+
+		sg.mu.Lock()
+		c, ok := sg.sigs[cacheKey]
+		sg.mu.Unlock()
+		if ok && now.Before(c.refresh) {
+			out = append(out, miekg_dns.Copy(c.sig))
+			continue
+		}
+
+		sig := &miekg_dns.RRSIG{
+			Hdr:         miekg_dns.RR_Header{Name: h.Name, Rrtype: miekg_dns.TypeRRSIG, Class: miekg_dns.ClassINET, Ttl: h.Ttl},
+			TypeCovered: h.Rrtype,
+			Algorithm:   k.dnskey.Algorithm,
+			Labels:      uint8(miekg_dns.CountLabel(h.Name)),
+			OrigTtl:     h.Ttl,
+			Expiration:  uint32(now.Add(sg.validity).Unix()),
+			Inception:   uint32(now.Add(-time.Hour).Unix()),
+			KeyTag:      k.dnskey.KeyTag(),
+			SignerName:  sg.zone,
+		}
+		if err := sig.Sign(k.priv, rrset); err != nil {
+			logging.Errorf("zone %s: failed to sign %s/%s: %v", sg.zone, h.Name, miekg_dns.TypeToString[h.Rrtype], err)
+			continue
+		}
+
+		sg.mu.Lock()
+		if len(sg.sigs) > 10000 {
+			sg.sigs = make(map[string]cachedSig)
+		}
+		sg.sigs[cacheKey] = cachedSig{sig: sig, refresh: now.Add(sg.validity / 2)}
+		sg.mu.Unlock()
+		out = append(out, miekg_dns.Copy(sig))
+	}
+	return out
+}
+
+// signSection добавляет RRSIG после каждого RRset секции
+func (sg *signer) signSection(rrs []miekg_dns.RR) []miekg_dns.RR {
+	var out []miekg_dns.RR
+	for i := 0; i < len(rrs); {
+		j := i + 1
+		for j < len(rrs) && rrs[j].Header().Rrtype == rrs[i].Header().Rrtype &&
+			strings.EqualFold(rrs[j].Header().Name, rrs[i].Header().Name) {
+			j++
+		}
+		out = append(out, rrs[i:j]...)
+		if rrs[i].Header().Rrtype != miekg_dns.TypeRRSIG {
+			out = append(out, sg.signRRset(rrs[i:j])...)
+		}
+		i = j
+	}
+	return out
+}
+
+// buildChain собирает имена зоны для NSEC/NSEC3, результат кешируется по serial
+func (sg *signer) buildChain(z *Zone) *nsecChain {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	sg.mu.Lock()
+	c := sg.chain
+	sg.mu.Unlock()
+	if c != nil && c.serial == z.soa.Serial {
+		return c
+	}
+
+	c = &nsecChain{serial: z.soa.Serial, types: make(map[string][]uint16)}
+	for name, types := range z.rrs {
+		for t := range types {
+			c.types[name] = append(c.types[name], t)
+		}
+		// Empty non-terminals нужны в цепочке NSEC3
+		for p := parentName(name); name != z.name && miekg_dns.IsSubDomain(z.name, p); p = parentName(p) {
+			if _, ok := c.types[p]; !ok {
+				c.types[p] = nil
+			}
+			if p == z.name {
+				break
+			}
+		}
+	}
+	c.types[z.name] = append(c.types[z.name], miekg_dns.TypeDNSKEY)
+	if sg.nsec3 {
+		c.types[z.name] = append(c.types[z.name], miekg_dns.TypeNSEC3PARAM)
+	}
+
+	if sg.nsec3 {
+		c.owners = make(map[string]string)
+		for name := range c.types {
+			h := miekg_dns.HashName(name, miekg_dns.SHA1, sg.iterations, sg.salt)
+			c.owners[h] = name
+			c.hashes = append(c.hashes, h)
+		}
+		sort.Strings(c.hashes)
+	} else {
+		for name, types := range c.types {
+			if len(types) > 0 {
+				c.names = append(c.names, name)
+			}
+		}
+		sort.Slice(c.names, func(i, j int) bool { return canonicalCompare(c.names[i], c.names[j]) < 0 })
+	}
+
+	sg.mu.Lock()
+	sg.chain = c
+	sg.mu.Unlock()
+	return c
+}
+
+func bitmap(types []uint16, extra ...uint16) []uint16 {
+	out := append(append([]uint16{}, types...), extra...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func (sg *signer) nsecAt(c *nsecChain, i int, ttl uint32) miekg_dns.RR {
+	name := c.names[i]
+	return &miekg_dns.NSEC{
+		Hdr:        miekg_dns.RR_Header{Name: name, Rrtype: miekg_dns.TypeNSEC, Class: miekg_dns.ClassINET, Ttl: ttl},
+		NextDomain: c.names[(i+1)%len(c.names)],
+		TypeBitMap: bitmap(c.types[name], miekg_dns.TypeRRSIG, miekg_dns.TypeNSEC),
+	}
+}
+
+// nsecCovering - индекс NSEC, который совпадает с name или покрывает его
+func (c *nsecChain) nsecCovering(name string) int {
+	i := sort.Search(len(c.names), func(i int) bool { return canonicalCompare(c.names[i], name) > 0 })
+	if i == 0 {
+		return len(c.names) - 1
+	}
+	return i - 1
+}
+
+func (sg *signer) nsec3At(c *nsecChain, i int, ttl uint32) miekg_dns.RR {
+	h := c.hashes[i]
+	types := c.types[c.owners[h]]
+	if len(types) > 0 {
+		types = bitmap(types, miekg_dns.TypeRRSIG)
+	}
+	return &miekg_dns.NSEC3{
+		Hdr:        miekg_dns.RR_Header{Name: strings.ToLower(h) + "." + sg.zone, Rrtype: miekg_dns.TypeNSEC3, Class: miekg_dns.ClassINET, Ttl: ttl},
+		Hash:       miekg_dns.SHA1,
+		Iterations: sg.iterations,
+		SaltLength: uint8(len(sg.salt) / 2),
+		Salt:       sg.salt,
+		HashLength: 20,
+		NextDomain: c.hashes[(i+1)%len(c.hashes)],
+		TypeBitMap: bitmap(types),
+	}
+}
+
+// nsec3Covering - индекс NSEC3, который совпадает с хешем name или покрывает его
+func (sg *signer) nsec3Covering(c *nsecChain, name string) int {
+	h := miekg_dns.HashName(name, miekg_dns.SHA1, sg.iterations, sg.salt)
+	i := sort.SearchStrings(c.hashes, h)
+	if i < len(c.hashes) && c.hashes[i] == h {
+		return i
+	}
+	if i == 0 {
+		return len(c.hashes) - 1
+	}
+	return i - 1
+}
+
+// closestEncloser - ближайший существующий предок name внутри зоны
+func (c *nsecChain) closestEncloser(zone, name string) (string, string) {
+	next := name
+	for cur := parentName(name); ; cur = parentName(cur) {
+		if _, ok := c.types[cur]; ok || cur == zone || cur == "." {
+			return cur, next
+		}
+		next = cur
+	}
+}
+
+// denial строит доказательство отсутствия name (или типа у name)
+func (sg *signer) denial(z *Zone, name string, nxdomain bool, ttl uint32) []miekg_dns.RR {
+	c := sg.buildChain(z)
+	var out []miekg_dns.RR
+	seen := make(map[int]bool)
+	add := func(i int, rr func(*nsecChain, int, uint32) miekg_dns.RR) {
+		if !seen[i] {
+			seen[i] = true
+			out = append(out, rr(c, i, ttl))
+		}
+	}
+
+	wildcard := func(ce string) string {
+		return "*." + ce
+	}
+
+	if !sg.nsec3 {
+		add(c.nsecCovering(name), sg.nsecAt)
+		if nxdomain {
+			ce, _ := c.closestEncloser(z.name, name)
+			add(c.nsecCovering(wildcard(ce)), sg.nsecAt)
+		}
+	} else if !nxdomain {
+		add(sg.nsec3Covering(c, name), sg.nsec3At)
+	} else {
+		ce, next := c.closestEncloser(z.name, name)
+		add(sg.nsec3Covering(c, ce), sg.nsec3At)
+		add(sg.nsec3Covering(c, next), sg.nsec3At)
+		add(sg.nsec3Covering(c, wildcard(ce)), sg.nsec3At)
+	}
+	return sg.signSection(out)
+}
+
+// signResponse подписывает ответ зоны для клиента с битом DO
+func (sg *signer) signResponse(z *Zone, msg *miekg_dns.Msg, name string, qtype uint16) {
+	msg.Answer = sg.signSection(msg.Answer)
+
+	target := cnameTarget(name, msg.Answer)
+	sets, _ := groupRRsets(msg.Answer)
+	negative := msg.Rcode == miekg_dns.RcodeNameError || !hasAnswer(target, qtype, sets)
+	if !negative || !z.contains(target) || len(msg.Ns) == 0 {
+		return
+	}
+
+	ttl := msg.Ns[0].Header().Ttl
+	msg.Ns = append(sg.signSection(msg.Ns), sg.denial(z, target, msg.Rcode == miekg_dns.RcodeNameError, ttl)...)
+}
@@ -0,0 +1,237 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// writeKey создаёт ключ зоны в формате BIND и возвращает путь без расширения
+func writeKey(t *testing.T, dir, zone string, flags uint16) (string, *miekg_dns.DNSKEY) {
+	t.Helper()
+	key := &miekg_dns.DNSKEY{
+		Hdr:       miekg_dns.RR_Header{Name: zone, Rrtype: miekg_dns.TypeDNSKEY, Class: miekg_dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: miekg_dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", zone, key.Algorithm, key.KeyTag()))
+	if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return base, key
+}
+
+// signedQuery задаёт вопрос серверу с битом DO
+func signedQuery(s *Server, name string, qtype uint16, do bool) *miekg_dns.Msg {
+	r := new(miekg_dns.Msg)
+	r.SetQuestion(name, qtype)
+	r.SetEdns0(4096, do)
+	w := udpClient("192.0.2.10")
+	s.ServeDNS(w, r)
+	return w.msg
+}
+
+func newSignedServer(t *testing.T, keys string, nsec3 bool) *Server {
+	t.Helper()
+	s, _ := newTestServer(t, fmt.Sprintf(`
+listen: 127.0.0.1:0
+zones:
+  - name: sig.test
+    records:
+      - "www IN A 192.0.2.1"
+      - "alias IN CNAME www"
+      - "host.ent IN A 192.0.2.2"
+    dnssec:
+      nsec3: %v
+      nsec3_salt: "abcd"
+      nsec3_iterations: 1
+      signature_validity: 24h
+      keys:
+%s`, nsec3, keys))
+	return s
+}
+
+// Ответы подписанной зоны проходят проверку валидатора с DS зоны как якорем
+func TestSignedZoneValidates(t *testing.T) {
+	dir := t.TempDir()
+	ksk, kskKey := writeKey(t, dir, "sig.test.", miekg_dns.ZONE|miekg_dns.SEP)
+	zsk, _ := writeKey(t, dir, "sig.test.", miekg_dns.ZONE)
+	keys := fmt.Sprintf("        - file: %s\n        - file: %s\n", ksk, zsk)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		{name: "www.sig.test.", qtype: miekg_dns.TypeA},
+		{name: "alias.sig.test.", qtype: miekg_dns.TypeA},
+		{name: "sig.test.", qtype: miekg_dns.TypeDNSKEY},
+		{name: "www.sig.test.", qtype: miekg_dns.TypeTXT},
+		{name: "ent.sig.test.", qtype: miekg_dns.TypeA},
+		{name: "nx.sig.test.", qtype: miekg_dns.TypeA, rcode: miekg_dns.RcodeNameError},
+		{name: "deep.nx.ent.sig.test.", qtype: miekg_dns.TypeA, rcode: miekg_dns.RcodeNameError},
+	}
+	for _, nsec3 := range []bool{false, true} {
+		s := newSignedServer(t, keys, nsec3)
+		v, err := newValidator([]string{kskKey.ToDS(miekg_dns.SHA256).String()},
+			func(_ context.Context, name string, qtype uint16) (*miekg_dns.Msg, error) {
+				return signedQuery(s, name, qtype, true), nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		denial := miekg_dns.TypeNSEC
+		if nsec3 {
+			denial = miekg_dns.TypeNSEC3
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("nsec3=%v/%s/%s", nsec3, tt.name, miekg_dns.TypeToString[tt.qtype]), func(t *testing.T) {
+				resp := signedQuery(s, tt.name, tt.qtype, true)
+				if resp.Rcode != tt.rcode {
+					t.Fatalf("rcode %s, want %s", miekg_dns.RcodeToString[resp.Rcode], miekg_dns.RcodeToString[tt.rcode])
+				}
+				q := miekg_dns.Question{Name: tt.name, Qtype: tt.qtype, Qclass: miekg_dns.ClassINET}
+				if status, why := v.validate(context.Background(), q, resp); status != statusSecure {
+					t.Errorf("status %d: %s\n%v", status, why, resp)
+				}
+				if len(resp.Answer) == 0 {
+					found := false
+					for _, rr := range resp.Ns {
+						found = found || rr.Header().Rrtype == denial
+					}
+					if !found {
+						t.Errorf("no %s in negative answer", miekg_dns.TypeToString[denial])
+					}
+				}
+
+				// Без DO ответ не подписывается
+				plain := signedQuery(s, tt.name, tt.qtype, false)
+				for _, rr := range append(plain.Answer, plain.Ns...) {
+					if rt := rr.Header().Rrtype; rt == miekg_dns.TypeRRSIG || rt == miekg_dns.TypeNSEC || rt == miekg_dns.TypeNSEC3 {
+						t.Errorf("%s without DO", miekg_dns.TypeToString[rt])
+					}
+				}
+			})
+		}
+	}
+}
+
+// sigTags - теги ключей, подписавших RRset типа covered в ответе
+func sigTags(resp *miekg_dns.Msg, covered uint16) []uint16 {
+	var tags []uint16
+	for _, rr := range resp.Answer {
+		if sig, ok := rr.(*miekg_dns.RRSIG); ok && sig.TypeCovered == covered {
+			tags = append(tags, sig.KeyTag)
+		}
+	}
+	return tags
+}
+
+func TestSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+	ksk, kskKey := writeKey(t, dir, "sig.test.", miekg_dns.ZONE|miekg_dns.SEP)
+	zsk, zskKey := writeKey(t, dir, "sig.test.", miekg_dns.ZONE)
+	next, nextKey := writeKey(t, dir, "sig.test.", miekg_dns.ZONE)
+	old, oldKey := writeKey(t, dir, "sig.test.", miekg_dns.ZONE)
+	gone, _ := writeKey(t, dir, "sig.test.", miekg_dns.ZONE)
+	now := time.Now().UTC()
+	stamp := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+
+	tests := []struct {
+		name   string
+		keys   string
+		dnskey []uint16 // опубликованные ключи, gone уже удалён
+		a      []uint16 // кто подписывает данные
+		keySig []uint16 // кто подписывает DNSKEY
+	}{
+		{
+			name:   "KSK and ZSK",
+			keys:   fmt.Sprintf("        - file: %s\n        - file: %s\n", ksk, zsk),
+			dnskey: []uint16{kskKey.KeyTag(), zskKey.KeyTag()},
+			a:      []uint16{zskKey.KeyTag()},
+			keySig: []uint16{kskKey.KeyTag()},
+		},
+		{
+			name:   "KSK alone signs everything",
+			keys:   fmt.Sprintf("        - file: %s\n", ksk),
+			dnskey: []uint16{kskKey.KeyTag()},
+			a:      []uint16{kskKey.KeyTag()},
+			keySig: []uint16{kskKey.KeyTag()},
+		},
+		{
+			name: "rollover",
+			keys: fmt.Sprintf("        - file: %s\n        - file: %s\n"+
+				"        - file: %s\n          publish: %s\n          activate: %s\n"+
+				"        - file: %s\n          inactive: %s\n"+
+				"        - file: %s\n          inactive: %s\n          delete: %s\n",
+				ksk, zsk, next, stamp(-time.Hour), stamp(time.Hour), old, stamp(-time.Hour), gone, stamp(-2*time.Hour), stamp(-time.Hour)),
+			dnskey: []uint16{kskKey.KeyTag(), zskKey.KeyTag(), nextKey.KeyTag(), oldKey.KeyTag()},
+			a:      []uint16{zskKey.KeyTag()},
+			keySig: []uint16{kskKey.KeyTag()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSignedServer(t, tt.keys, false)
+
+			resp := signedQuery(s, "sig.test.", miekg_dns.TypeDNSKEY, true)
+			var published []uint16
+			for _, rr := range resp.Answer {
+				if k, ok := rr.(*miekg_dns.DNSKEY); ok {
+					published = append(published, k.KeyTag())
+				}
+			}
+			if !sameTags(published, tt.dnskey) {
+				t.Errorf("DNSKEY %v, want %v", published, tt.dnskey)
+			}
+			if got := sigTags(resp, miekg_dns.TypeDNSKEY); !sameTags(got, tt.keySig) {
+				t.Errorf("DNSKEY signed by %v, want %v", got, tt.keySig)
+			}
+			resp = signedQuery(s, "www.sig.test.", miekg_dns.TypeA, true)
+			if got := sigTags(resp, miekg_dns.TypeA); !sameTags(got, tt.a) {
+				t.Errorf("A signed by %v, want %v", got, tt.a)
+			}
+		})
+	}
+}
+
+// sameTags сравнивает наборы тегов без учёта порядка
+func sameTags(a, b []uint16) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+func TestNSEC3Param(t *testing.T) {
+	dir := t.TempDir()
+	ksk, _ := writeKey(t, dir, "sig.test.", miekg_dns.ZONE|miekg_dns.SEP)
+	keys := fmt.Sprintf("        - file: %s\n", ksk)
+
+	resp := signedQuery(newSignedServer(t, keys, true), "sig.test.", miekg_dns.TypeNSEC3PARAM, true)
+	if len(resp.Answer) == 0 {
+		t.Fatal("no NSEC3PARAM")
+	}
+	p, ok := resp.Answer[0].(*miekg_dns.NSEC3PARAM)
+	if !ok || p.Iterations != 1 || !strings.EqualFold(p.Salt, "abcd") {
+		t.Errorf("NSEC3PARAM %v", resp.Answer[0])
+	}
+	if resp := signedQuery(newSignedServer(t, keys, false), "sig.test.", miekg_dns.TypeNSEC3PARAM, true); len(resp.Answer) != 0 {
+		t.Errorf("NSEC3PARAM in NSEC zone: %v", resp.Answer)
+	}
+}
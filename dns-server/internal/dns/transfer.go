@@ -0,0 +1,220 @@
+package dns
+
+import (
+	"dns-server/internal/logging"
+	"errors"
+	"net"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Исходящие AXFR/IXFR (RFC 5936, RFC 1995) и NOTIFY (RFC 1996)
+
+const (
+	journalSize  = 100
+	xfrChunkSize = 100
+)
+
+// zoneDiff - одно изменение зоны для IXFR
+type zoneDiff struct {
+	from, to *miekg_dns.SOA
+	deleted  []miekg_dns.RR
+	added    []miekg_dns.RR
+}
+
+// commit сравнивает состояние зоны с before и пишет разницу в журнал. Вызывать под локом.
+func (z *Zone) commit(before []miekg_dns.RR) {
+	after := z.records()
+
+	index := func(rrs []miekg_dns.RR) map[string]miekg_dns.RR {
+		m := make(map[string]miekg_dns.RR, len(rrs))
+		for _, rr := range rrs[1:] {
+			m[rr.String()] = rr
+		}
+		return m
+	}
+	old, cur := index(before), index(after)
+
+	d := zoneDiff{from: before[0].(*miekg_dns.SOA), to: after[0].(*miekg_dns.SOA)}
+	for _, rr := range before[1:] {
+		if _, ok := cur[rr.String()]; !ok {
+			d.deleted = append(d.deleted, rr)
+		}
+	}
+	for _, rr := range after[1:] {
+		if _, ok := old[rr.String()]; !ok {
+			d.added = append(d.added, rr)
+		}
+	}
+
+	z.journal = append(z.journal, d)
+	if len(z.journal) > journalSize {
+		z.journal = z.journal[len(z.journal)-journalSize:]
+	}
+}
+
+// ixfrDiffs возвращает цепочку изменений от serial до текущего SOA, если журнал её покрывает
+func (z *Zone) ixfrDiffs(serial uint32) ([]zoneDiff, bool) {
+	for i, d := range z.journal {
+		if d.from.Serial != serial {
+			continue
+		}
+		chain := z.journal[i:]
+		for j := 1; j < len(chain); j++ {
+			if chain[j].from.Serial != chain[j-1].to.Serial {
+				return nil, false
+			}
+		}
+		if chain[len(chain)-1].to.Serial != z.soa.Serial {
+			return nil, false
+		}
+		return chain, true
+	}
+	return nil, false
+}
+
+func (z *Zone) transferAllowed(w miekg_dns.ResponseWriter) bool {
+	if len(z.transferFrom) == 0 {
+		return true
+	}
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	ip := net.ParseIP(host)
+	for _, n := range z.transferFrom {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleTransfer(w miekg_dns.ResponseWriter, r *miekg_dns.Msg, z *Zone) {
+	q := r.Question[0]
+	m := new(miekg_dns.Msg)
+	m.SetReply(r)
+
+	rcode := s.checkTSIG(w, r, z.allowTransfer)
+	if rcode == miekg_dns.RcodeSuccess && !z.transferAllowed(w) {
+		rcode = miekg_dns.RcodeRefused
+	}
+	if rcode == miekg_dns.RcodeSuccess && miekg_dns.CanonicalName(q.Name) != z.name {
+		rcode = miekg_dns.RcodeNotAuth
+	}
+	if rcode == miekg_dns.RcodeSuccess && !z.serving() {
+		rcode = miekg_dns.RcodeServerFailure
+	}
+	if rcode != miekg_dns.RcodeSuccess {
+		logging.Warnf("%s %s from %s refused: %s", miekg_dns.TypeToString[q.Qtype], z.name, w.RemoteAddr(), miekg_dns.RcodeToString[rcode])
+		m.Rcode = rcode
+		writeMsg(w, r, m)
+		return
+	}
+
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if udp && q.Qtype == miekg_dns.TypeAXFR {
+		m.Rcode = miekg_dns.RcodeRefused
+		writeMsg(w, r, m)
+		return
+	}
+
+	z.mu.RLock()
+	soa := miekg_dns.Copy(z.soa)
+	var rrs []miekg_dns.RR
+	if q.Qtype == miekg_dns.TypeIXFR && len(r.Ns) == 1 {
+		if client, ok := r.Ns[0].(*miekg_dns.SOA); ok {
+			if !serialGreater(z.soa.Serial, client.Serial) {
+				// Вторичный сервер уже актуален
+				rrs = []miekg_dns.RR{soa}
+			} else if diffs, ok := z.ixfrDiffs(client.Serial); ok {
+				rrs = []miekg_dns.RR{soa}
+				for _, d := range diffs {
+					rrs = append(rrs, d.from)
+					rrs = append(rrs, d.deleted...)
+					rrs = append(rrs, d.to)
+					rrs = append(rrs, d.added...)
+				}
+				rrs = append(rrs, soa)
+			}
+		}
+	}
+	if rrs == nil {
+		rrs = append(z.records(), soa)
+	}
+	z.mu.RUnlock()
+
+	// По UDP отдаём только SOA, клиент повторит по TCP (RFC 1995, 2)
+	if udp && len(rrs) > 1 {
+		rrs = []miekg_dns.RR{soa}
+	}
+
+	ch := make(chan *miekg_dns.Envelope)
+	tr := new(miekg_dns.Transfer)
+	done := make(chan error, 1)
+	go func() { done <- tr.Out(w, r, ch) }()
+
+	// Out перестаёт читать ch после ошибки записи (клиент отключился),
+	// поэтому отправка ждёт и завершения Out
+	var err error
+	for len(rrs) > 0 && err == nil {
+		n := min(len(rrs), xfrChunkSize)
+		select {
+		case ch <- &miekg_dns.Envelope{RR: rrs[:n]}:
+			rrs = rrs[n:]
+		case err = <-done:
+			if err == nil {
+				err = errors.New("transfer stopped early")
+			}
+		}
+	}
+	close(ch)
+	if len(rrs) == 0 {
+		err = <-done
+	}
+
+	if err != nil {
+		logging.Errorf("%s %s to %s failed: %v", miekg_dns.TypeToString[q.Qtype], z.name, w.RemoteAddr(), err)
+		return
+	}
+	logging.Infof("%s %s to %s, serial %d", miekg_dns.TypeToString[q.Qtype], z.name, w.RemoteAddr(), soa.(*miekg_dns.SOA).Serial)
+}
+
+// sendNotify уведомляет вторичные серверы о новой версии зоны
+func (s *Server) sendNotify(z *Zone) {
+	if len(z.notify) == 0 {
+		return
+	}
+
+	z.mu.RLock()
+	soa := miekg_dns.Copy(z.soa)
+	z.mu.RUnlock()
+
+	key := z.notifyKey
+	for _, addr := range z.notify {
+		go func(addr string) {
+			c := &miekg_dns.Client{Net: "udp", Timeout: 2 * time.Second}
+			if key != "" {
+				c.TsigSecret = map[string]string{key: s.cfg.TSIGKeys[key].Secret}
+			}
+
+			for attempt := 0; attempt < 5; attempt++ {
+				m := new(miekg_dns.Msg)
+				m.SetNotify(z.name)
+				m.Answer = []miekg_dns.RR{soa}
+				if key != "" {
+					m.SetTsig(key, s.cfg.TSIGKeys[key].Algorithm, 300, time.Now().Unix())
+				}
+
+				resp, _, err := c.Exchange(m, addr)
+				if err == nil && resp.Rcode == miekg_dns.RcodeSuccess {
+					return
+				}
+				if err == nil {
+					logging.Warnf("NOTIFY %s to %s: %s", z.name, addr, miekg_dns.RcodeToString[resp.Rcode])
+					return
+				}
+				time.Sleep(time.Duration(attempt+1) * 2 * time.Second)
+			}
+			logging.Warnf("NOTIFY %s to %s: no response", z.name, addr)
+		}(addr)
+	}
+}
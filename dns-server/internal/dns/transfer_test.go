@@ -0,0 +1,205 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+const xfrSecret = "eGZyc2VjcmV0eGZyc2VjcmV0"
+
+// serveTest запускает h на UDP и TCP на одном порту и возвращает адрес
+func serveTest(t *testing.T, h miekg_dns.Handler, secrets map[string]string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip("port taken for TCP: ", err)
+	}
+	for _, srv := range []*miekg_dns.Server{
+		{PacketConn: pc, Handler: h, TsigSecret: secrets},
+		{Listener: l, Handler: h, TsigSecret: secrets},
+	} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func() { _ = srv.ActivateAndServe() }()
+		<-started
+		t.Cleanup(func() { _ = srv.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+func newTransferServer(t *testing.T, notify string) (*Server, string) {
+	t.Helper()
+	s, _ := newTestServer(t, fmt.Sprintf(`
+listen: 127.0.0.1:0
+tsig_keys:
+  xfr-key:
+    secret: %q
+zones:
+  - name: xfr.test
+    records:
+      - "www IN A 192.0.2.1"
+      - "mail IN A 192.0.2.2"
+    allow_transfer: [xfr-key]
+    transfer_from: [127.0.0.0/8]
+    notify: [%s]
+  - name: closed.test
+    allow_transfer: [xfr-key]
+    transfer_from: [10.0.0.0/8]
+`, xfrSecret, notify))
+	addr := serveTest(t, miekg_dns.HandlerFunc(s.ServeDNS), map[string]string{"xfr-key.": xfrSecret})
+	return s, addr
+}
+
+// transferIn забирает зону по TCP и возвращает все записи ответа
+func transferIn(t *testing.T, addr string, m *miekg_dns.Msg) []miekg_dns.RR {
+	t.Helper()
+	m.SetTsig("xfr-key.", miekg_dns.HmacSHA256, 300, time.Now().Unix())
+	tr := &miekg_dns.Transfer{TsigSecret: map[string]string{"xfr-key.": xfrSecret}}
+	ch, err := tr.In(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rrs []miekg_dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			t.Fatal(env.Error)
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	return rrs
+}
+
+func TestTransferRefused(t *testing.T) {
+	_, addr := newTransferServer(t, "127.0.0.1:1")
+	tests := []struct {
+		name  string
+		zone  string
+		net   string
+		sign  bool
+		rcode int
+	}{
+		{name: "unsigned", zone: "xfr.test.", net: "tcp", rcode: miekg_dns.RcodeRefused},
+		{name: "client network not allowed", zone: "closed.test.", net: "tcp", sign: true, rcode: miekg_dns.RcodeRefused},
+		{name: "AXFR over UDP", zone: "xfr.test.", net: "udp", sign: true, rcode: miekg_dns.RcodeRefused},
+		{name: "not a zone apex", zone: "www.xfr.test.", net: "tcp", sign: true, rcode: miekg_dns.RcodeNotAuth},
+	}
+	for _, tt := range tests {
+		m := new(miekg_dns.Msg)
+		m.SetAxfr(tt.zone)
+		c := &miekg_dns.Client{Net: tt.net, Timeout: 2 * time.Second}
+		if tt.sign {
+			m.SetTsig("xfr-key.", miekg_dns.HmacSHA256, 300, time.Now().Unix())
+			c.TsigSecret = map[string]string{"xfr-key.": xfrSecret}
+		}
+		resp, _, err := c.Exchange(m, addr)
+		// Подписанный NOTAUTH клиент miekg/dns отвергает, не проверяя подпись
+		if tt.rcode == miekg_dns.RcodeNotAuth && errors.Is(err, miekg_dns.ErrAuth) {
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if resp.Rcode != tt.rcode || len(resp.Answer) != 0 {
+			t.Errorf("%s: %s with %d records, want %s", tt.name, miekg_dns.RcodeToString[resp.Rcode],
+				len(resp.Answer), miekg_dns.RcodeToString[tt.rcode])
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	s, addr := newTransferServer(t, "127.0.0.1:1")
+	z := s.zones["xfr.test."]
+	z.notify = nil
+	serial := z.soa.Serial
+
+	m := new(miekg_dns.Msg)
+	m.SetAxfr("xfr.test.")
+	axfr := transferIn(t, addr, m)
+	// SOA, NS, две A и снова SOA
+	if len(axfr) != 5 || axfr[0].Header().Rrtype != miekg_dns.TypeSOA || axfr[len(axfr)-1].Header().Rrtype != miekg_dns.TypeSOA {
+		t.Fatalf("AXFR: %v", axfr)
+	}
+
+	rcode, changed := z.update(nil, []miekg_dns.RR{
+		testRR("new.xfr.test. 300 IN A 192.0.2.3"),
+		&miekg_dns.A{Hdr: miekg_dns.RR_Header{Name: "mail.xfr.test.", Rrtype: miekg_dns.TypeA, Class: miekg_dns.ClassNONE}, A: net.ParseIP("192.0.2.2")},
+	})
+	if rcode != miekg_dns.RcodeSuccess || !changed {
+		t.Fatalf("update: %s %v", miekg_dns.RcodeToString[rcode], changed)
+	}
+
+	ixfr := func(serial uint32) []miekg_dns.RR {
+		m := new(miekg_dns.Msg)
+		m.SetIxfr("xfr.test.", serial, "ns1.xfr.test.", "hostmaster.xfr.test.")
+		return transferIn(t, addr, m)
+	}
+	got := ixfr(serial)
+	var text []string
+	for _, rr := range got {
+		text = append(text, rr.Header().Name+" "+miekg_dns.TypeToString[rr.Header().Rrtype])
+	}
+	want := []string{
+		"xfr.test. SOA", "xfr.test. SOA", "mail.xfr.test. A", "xfr.test. SOA", "new.xfr.test. A", "xfr.test. SOA",
+	}
+	if fmt.Sprint(text) != fmt.Sprint(want) {
+		t.Errorf("IXFR from %d: %v, want %v", serial, text, want)
+	}
+	if got[1].(*miekg_dns.SOA).Serial != serial || got[3].(*miekg_dns.SOA).Serial != serial+1 {
+		t.Errorf("IXFR serials %d -> %d, want %d -> %d", got[1].(*miekg_dns.SOA).Serial, got[3].(*miekg_dns.SOA).Serial, serial, serial+1)
+	}
+
+	// Актуальный вторичный получает только SOA, неизвестный номер - полную зону
+	if got := ixfr(serial + 1); len(got) != 1 {
+		t.Errorf("IXFR from current serial: %d records, want 1", len(got))
+	}
+	if got := ixfr(serial - 5); len(got) != 5 || got[1].Header().Rrtype == miekg_dns.TypeSOA {
+		t.Errorf("IXFR from unknown serial: %v, want full zone", got)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	type notify struct {
+		msg  *miekg_dns.Msg
+		tsig error
+	}
+	got := make(chan notify, 1)
+	notifyAddr := serveTest(t, miekg_dns.HandlerFunc(func(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+		got <- notify{msg: r, tsig: w.TsigStatus()}
+		m := new(miekg_dns.Msg)
+		m.SetReply(r)
+		if r.IsTsig() != nil {
+			m.SetTsig("xfr-key.", miekg_dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		_ = w.WriteMsg(m)
+	}), map[string]string{"xfr-key.": xfrSecret})
+
+	s, _ := newTransferServer(t, notifyAddr)
+	z := s.zones["xfr.test."]
+	s.sendNotify(z)
+
+	select {
+	case n := <-got:
+		if n.msg.Opcode != miekg_dns.OpcodeNotify || n.msg.Question[0].Name != "xfr.test." {
+			t.Errorf("NOTIFY: %v", n.msg)
+		}
+		if n.msg.IsTsig() == nil || n.tsig != nil {
+			t.Errorf("NOTIFY not signed with xfr-key: %v", n.tsig)
+		}
+		if len(n.msg.Answer) != 1 || n.msg.Answer[0].(*miekg_dns.SOA).Serial != z.soa.Serial {
+			t.Errorf("NOTIFY answer %v, want current SOA", n.msg.Answer)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no NOTIFY received")
+	}
+}
@@ -0,0 +1,339 @@
+package dns
+
+import (
+	"dns-server/internal/logging"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Динамические обновления зон по RFC 2136, только с TSIG
+
+func (s *Server) handleUpdate(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+	m := new(miekg_dns.Msg)
+	m.SetReply(r)
+
+	if len(r.Question) != 1 || r.Question[0].Qtype != miekg_dns.TypeSOA {
+		m.Rcode = miekg_dns.RcodeFormatError
+		writeMsg(w, r, m)
+		return
+	}
+
+	z, ok := s.zones[miekg_dns.CanonicalName(r.Question[0].Name)]
+	if !ok {
+		m.Rcode = miekg_dns.RcodeNotAuth
+		writeMsg(w, r, m)
+		return
+	}
+
+	// Без файла обновления пропали бы при перезапуске
+	if z.file == "" {
+		m.Rcode = miekg_dns.RcodeRefused
+		writeMsg(w, r, m)
+		return
+	}
+
+	if rcode := s.checkTSIG(w, r, z.allowUpdate); rcode != miekg_dns.RcodeSuccess {
+		logging.Warnf("update %s from %s refused: %s", z.name, w.RemoteAddr(), miekg_dns.RcodeToString[rcode])
+		m.Rcode = rcode
+		writeMsg(w, r, m)
+		return
+	}
+
+	rcode, changed := z.update(r.Answer, r.Ns)
+	if changed {
+		z.mu.Lock()
+		err := z.save()
+		serial := z.soa.Serial
+		z.mu.Unlock()
+		if err != nil {
+			logging.Errorf("failed to persist zone %s: %v", z.name, err)
+		}
+		logging.Infof("zone %s updated by %s, serial %d", z.name, r.IsTsig().Hdr.Name, serial)
+		s.sendNotify(z)
+	}
+
+	m.Rcode = rcode
+	writeMsg(w, r, m)
+}
+
+// checkTSIG проверяет, что запрос подписан одним из разрешённых ключей
+func (s *Server) checkTSIG(w miekg_dns.ResponseWriter, r *miekg_dns.Msg, allowed map[string]bool) int {
+	t := r.IsTsig()
+	if t == nil {
+		return miekg_dns.RcodeRefused
+	}
+	if err := w.TsigStatus(); err != nil {
+		return miekg_dns.RcodeNotAuth
+	}
+	name := miekg_dns.CanonicalName(t.Hdr.Name)
+	if key, ok := s.cfg.TSIGKeys[name]; !ok || key.Algorithm != miekg_dns.CanonicalName(t.Algorithm) {
+		return miekg_dns.RcodeNotAuth
+	}
+	if !allowed[name] {
+		return miekg_dns.RcodeRefused
+	}
+	return miekg_dns.RcodeSuccess
+}
+
+// writeMsg отдаёт ответ с OPT по запросу клиента, обрезает его под размер UDP
+// и подписывает, если запрос пришёл с валидным TSIG
+func writeMsg(w miekg_dns.ResponseWriter, r, m *miekg_dns.Msg) {
+	setEdns(r, m)
+	if _, ok := w.(capturer); ok {
+		_ = w.WriteMsg(m)
+		return
+	}
+	truncate(w, r, m)
+	if t := r.IsTsig(); t != nil && w.TsigStatus() == nil {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+	_ = w.WriteMsg(m)
+}
+
+func isMetaType(t uint16) bool {
+	return t == miekg_dns.TypeOPT || (t >= 128 && t <= 255)
+}
+
+func (z *Zone) update(prereq, updates []miekg_dns.RR) (int, bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if rcode := z.checkPrereq(prereq); rcode != miekg_dns.RcodeSuccess {
+		return rcode, false
+	}
+	if rcode := z.prescan(updates); rcode != miekg_dns.RcodeSuccess {
+		return rcode, false
+	}
+
+	before := z.records()
+	changed := false
+	for _, rr := range updates {
+		if z.apply(rr) {
+			changed = true
+		}
+	}
+	if changed {
+		if z.soa.Serial == before[0].(*miekg_dns.SOA).Serial {
+			z.bumpSerial()
+		}
+		z.commit(before)
+	}
+	return miekg_dns.RcodeSuccess, changed
+}
+
+// RFC 2136, 3.2
+func (z *Zone) checkPrereq(prereq []miekg_dns.RR) int {
+	exact := make(map[string]map[uint16][]miekg_dns.RR)
+
+	for _, rr := range prereq {
+		h := rr.Header()
+		name := miekg_dns.CanonicalName(h.Name)
+		if h.Ttl != 0 {
+			return miekg_dns.RcodeFormatError
+		}
+		if !z.contains(name) {
+			return miekg_dns.RcodeNotZone
+		}
+
+		switch h.Class {
+		case miekg_dns.ClassANY:
+			if h.Rdlength != 0 {
+				return miekg_dns.RcodeFormatError
+			}
+			if h.Rrtype == miekg_dns.TypeANY {
+				if len(z.rrs[name]) == 0 {
+					return miekg_dns.RcodeNameError
+				}
+			} else if len(z.rrs[name][h.Rrtype]) == 0 {
+				return miekg_dns.RcodeNXRrset
+			}
+
+		case miekg_dns.ClassNONE:
+			if h.Rdlength != 0 {
+				return miekg_dns.RcodeFormatError
+			}
+			if h.Rrtype == miekg_dns.TypeANY {
+				if len(z.rrs[name]) > 0 {
+					return miekg_dns.RcodeYXDomain
+				}
+			} else if len(z.rrs[name][h.Rrtype]) > 0 {
+				return miekg_dns.RcodeYXRrset
+			}
+
+		case miekg_dns.ClassINET:
+			if exact[name] == nil {
+				exact[name] = make(map[uint16][]miekg_dns.RR)
+			}
+			exact[name][h.Rrtype] = append(exact[name][h.Rrtype], rr)
+
+		default:
+			return miekg_dns.RcodeFormatError
+		}
+	}
+
+	// Value-dependent: RRset должен совпадать целиком
+	for name, types := range exact {
+		for t, want := range types {
+			if !sameRRset(z.rrs[name][t], want) {
+				return miekg_dns.RcodeNXRrset
+			}
+		}
+	}
+	return miekg_dns.RcodeSuccess
+}
+
+func sameRRset(a, b []miekg_dns.RR) bool {
+	contains := func(set []miekg_dns.RR, rr miekg_dns.RR) bool {
+		for _, x := range set {
+			if miekg_dns.IsDuplicate(x, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// RFC 2136, 3.4.1
+func (z *Zone) prescan(updates []miekg_dns.RR) int {
+	for _, rr := range updates {
+		h := rr.Header()
+		if !z.contains(h.Name) {
+			return miekg_dns.RcodeNotZone
+		}
+		switch h.Class {
+		case miekg_dns.ClassINET:
+			if isMetaType(h.Rrtype) {
+				return miekg_dns.RcodeFormatError
+			}
+		case miekg_dns.ClassANY:
+			if h.Ttl != 0 || h.Rdlength != 0 || (isMetaType(h.Rrtype) && h.Rrtype != miekg_dns.TypeANY) {
+				return miekg_dns.RcodeFormatError
+			}
+		case miekg_dns.ClassNONE:
+			if h.Ttl != 0 || isMetaType(h.Rrtype) {
+				return miekg_dns.RcodeFormatError
+			}
+		default:
+			return miekg_dns.RcodeFormatError
+		}
+	}
+	return miekg_dns.RcodeSuccess
+}
+
+// apply применяет одну операцию (RFC 2136, 3.4.2), возвращает true, если зона изменилась
+func (z *Zone) apply(rr miekg_dns.RR) bool {
+	h := rr.Header()
+	name := miekg_dns.CanonicalName(h.Name)
+	apex := name == z.name
+
+	switch h.Class {
+	case miekg_dns.ClassINET:
+		return z.add(rr)
+
+	case miekg_dns.ClassANY:
+		if len(z.rrs[name]) == 0 {
+			return false
+		}
+		if h.Rrtype == miekg_dns.TypeANY {
+			changed := false
+			for t := range z.rrs[name] {
+				if apex && (t == miekg_dns.TypeSOA || t == miekg_dns.TypeNS) {
+					continue
+				}
+				z.set(name, t, nil)
+				changed = true
+			}
+			return changed
+		}
+		if apex && (h.Rrtype == miekg_dns.TypeSOA || h.Rrtype == miekg_dns.TypeNS) {
+			return false
+		}
+		if len(z.rrs[name][h.Rrtype]) == 0 {
+			return false
+		}
+		z.set(name, h.Rrtype, nil)
+		return true
+
+	case miekg_dns.ClassNONE:
+		if h.Rrtype == miekg_dns.TypeSOA {
+			return false
+		}
+		rrset := z.rrs[name][h.Rrtype]
+		if apex && h.Rrtype == miekg_dns.TypeNS && len(rrset) <= 1 {
+			return false
+		}
+		// Сравниваем rdata, класс у удаления NONE
+		probe := miekg_dns.Copy(rr)
+		probe.Header().Class = miekg_dns.ClassINET
+		for i, old := range rrset {
+			if miekg_dns.IsDuplicate(old, probe) {
+				kept := append(append([]miekg_dns.RR{}, rrset[:i]...), rrset[i+1:]...)
+				z.set(name, h.Rrtype, kept)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (z *Zone) add(rr miekg_dns.RR) bool {
+	h := rr.Header()
+	name := miekg_dns.CanonicalName(h.Name)
+
+	switch h.Rrtype {
+	case miekg_dns.TypeSOA:
+		soa := rr.(*miekg_dns.SOA)
+		if name != z.name || !serialGreater(soa.Serial, z.soa.Serial) {
+			return false
+		}
+		z.put(soa)
+		return true
+
+	case miekg_dns.TypeCNAME:
+		for t := range z.rrs[name] {
+			if t != miekg_dns.TypeCNAME {
+				return false
+			}
+		}
+		if old := z.rrs[name][miekg_dns.TypeCNAME]; len(old) > 0 && miekg_dns.IsDuplicate(old[0], rr) {
+			return false
+		}
+		z.set(name, miekg_dns.TypeCNAME, nil)
+		z.put(rr)
+		return true
+
+	default:
+		if _, ok := z.rrs[name][miekg_dns.TypeCNAME]; ok {
+			return false
+		}
+		before := len(z.rrs[name][h.Rrtype])
+		z.put(rr)
+		return len(z.rrs[name][h.Rrtype]) != before
+	}
+}
+
+func (z *Zone) bumpSerial() {
+	soa := miekg_dns.Copy(z.soa).(*miekg_dns.SOA)
+	soa.Serial++
+	if soa.Serial == 0 {
+		soa.Serial = 1
+	}
+	z.put(soa)
+}
+
+// Сравнение серийных номеров по RFC 1982
+func serialGreater(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
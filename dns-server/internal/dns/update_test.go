@@ -0,0 +1,233 @@
+package dns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// tsigWriter - testWriter с заданным результатом проверки TSIG
+type tsigWriter struct {
+	testWriter
+	status error
+}
+
+func (w *tsigWriter) TsigStatus() error { return w.status }
+
+func newUpdateServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "dyn.test.zone")
+	s, _ := newTestServer(t, fmt.Sprintf(`
+listen: 127.0.0.1:0
+tsig_keys:
+  ci-key:
+    secret: "c2VjcmV0c2VjcmV0c2VjcmV0"
+  other-key:
+    secret: "b3RoZXJvdGhlcm90aGVy"
+zones:
+  - name: dyn.test
+    file: %s
+    ns: [ns1.dyn.test, ns2.dyn.test]
+    records:
+      - "www IN A 192.0.2.1"
+      - "www IN A 192.0.2.2"
+      - "alias IN CNAME www"
+    allow_update: [ci-key]
+  - name: mem.test
+    records:
+      - "www IN A 192.0.2.1"
+    allow_update: [ci-key]
+`, file))
+	return s, file
+}
+
+// sendUpdate отправляет UPDATE для zone, подписанный ключом key, и возвращает rcode
+func sendUpdate(s *Server, zone, key string, status error, build func(m *miekg_dns.Msg)) int {
+	m := new(miekg_dns.Msg)
+	m.SetUpdate(zone)
+	build(m)
+	if key != "" {
+		m.SetTsig(key, miekg_dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	w := &tsigWriter{testWriter: *udpClient("127.0.0.1"), status: status}
+	s.handleUpdate(w, m)
+	return w.msg.Rcode
+}
+
+func rrs(lines ...string) []miekg_dns.RR {
+	var out []miekg_dns.RR
+	for _, l := range lines {
+		out = append(out, testRR("%s", l))
+	}
+	return out
+}
+
+func TestUpdateAuth(t *testing.T) {
+	s, _ := newUpdateServer(t)
+	insert := func(m *miekg_dns.Msg) { m.Insert(rrs("new.dyn.test. 60 IN A 192.0.2.9")) }
+	tests := []struct {
+		name   string
+		zone   string
+		key    string
+		status error
+		rcode  int
+	}{
+		{name: "unsigned", zone: "dyn.test.", rcode: miekg_dns.RcodeRefused},
+		{name: "bad signature", zone: "dyn.test.", key: "ci-key.", status: miekg_dns.ErrSig, rcode: miekg_dns.RcodeNotAuth},
+		{name: "unknown key", zone: "dyn.test.", key: "nope.", rcode: miekg_dns.RcodeNotAuth},
+		{name: "key not allowed", zone: "dyn.test.", key: "other-key.", rcode: miekg_dns.RcodeRefused},
+		{name: "not our zone", zone: "other.test.", key: "ci-key.", rcode: miekg_dns.RcodeNotAuth},
+		{name: "zone without file", zone: "mem.test.", key: "ci-key.", rcode: miekg_dns.RcodeRefused},
+		{name: "allowed", zone: "dyn.test.", key: "ci-key.", rcode: miekg_dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		if got := sendUpdate(s, tt.zone, tt.key, tt.status, insert); got != tt.rcode {
+			t.Errorf("%s: %s, want %s", tt.name, miekg_dns.RcodeToString[got], miekg_dns.RcodeToString[tt.rcode])
+		}
+	}
+	if _, _, rcode := s.zones["mem.test."].lookup("new.mem.test.", miekg_dns.TypeA); rcode != miekg_dns.RcodeNameError {
+		t.Error("refused update applied to zone without file")
+	}
+}
+
+func TestUpdatePrereq(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(m *miekg_dns.Msg)
+		rcode int
+	}{
+		{name: "name in use", build: func(m *miekg_dns.Msg) { m.NameUsed(rrs("www.dyn.test. 0 IN A 0.0.0.0")) }},
+		{name: "name not in use", build: func(m *miekg_dns.Msg) { m.NameUsed(rrs("nx.dyn.test. 0 IN A 0.0.0.0")) },
+			rcode: miekg_dns.RcodeNameError},
+		{name: "name free", build: func(m *miekg_dns.Msg) { m.NameNotUsed(rrs("nx.dyn.test. 0 IN A 0.0.0.0")) }},
+		{name: "name taken", build: func(m *miekg_dns.Msg) { m.NameNotUsed(rrs("www.dyn.test. 0 IN A 0.0.0.0")) },
+			rcode: miekg_dns.RcodeYXDomain},
+		{name: "rrset exists", build: func(m *miekg_dns.Msg) { m.RRsetUsed(rrs("www.dyn.test. 0 IN A 0.0.0.0")) }},
+		{name: "rrset missing", build: func(m *miekg_dns.Msg) { m.RRsetUsed(rrs("www.dyn.test. 0 IN TXT x")) },
+			rcode: miekg_dns.RcodeNXRrset},
+		{name: "rrset absent", build: func(m *miekg_dns.Msg) { m.RRsetNotUsed(rrs("www.dyn.test. 0 IN TXT x")) }},
+		{name: "rrset present", build: func(m *miekg_dns.Msg) { m.RRsetNotUsed(rrs("www.dyn.test. 0 IN A 0.0.0.0")) },
+			rcode: miekg_dns.RcodeYXRrset},
+		{name: "exact rrset", build: func(m *miekg_dns.Msg) {
+			m.Used(rrs("www.dyn.test. 60 IN A 192.0.2.2", "www.dyn.test. 60 IN A 192.0.2.1"))
+		}},
+		{name: "partial rrset", build: func(m *miekg_dns.Msg) { m.Used(rrs("www.dyn.test. 60 IN A 192.0.2.1")) },
+			rcode: miekg_dns.RcodeNXRrset},
+		{name: "nonzero TTL", build: func(m *miekg_dns.Msg) {
+			m.Answer = append(m.Answer, &miekg_dns.ANY{Hdr: miekg_dns.RR_Header{Name: "www.dyn.test.", Rrtype: miekg_dns.TypeANY, Class: miekg_dns.ClassANY, Ttl: 60}})
+		}, rcode: miekg_dns.RcodeFormatError},
+		{name: "out of zone", build: func(m *miekg_dns.Msg) { m.NameUsed(rrs("www.other.test. 0 IN A 0.0.0.0")) },
+			rcode: miekg_dns.RcodeNotZone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newUpdateServer(t)
+			z := s.zones["dyn.test."]
+			serial := z.soa.Serial
+			rcode := sendUpdate(s, "dyn.test.", "ci-key.", nil, func(m *miekg_dns.Msg) {
+				tt.build(m)
+				m.Insert(rrs("added.dyn.test. 60 IN A 192.0.2.9"))
+			})
+			if rcode != tt.rcode {
+				t.Fatalf("rcode %s, want %s", miekg_dns.RcodeToString[rcode], miekg_dns.RcodeToString[tt.rcode])
+			}
+			_, _, found := z.lookup("added.dyn.test.", miekg_dns.TypeA)
+			if applied := found == miekg_dns.RcodeSuccess; applied != (rcode == miekg_dns.RcodeSuccess) {
+				t.Errorf("update applied = %v with rcode %s", applied, miekg_dns.RcodeToString[rcode])
+			}
+			if rcode != miekg_dns.RcodeSuccess && z.soa.Serial != serial {
+				t.Error("serial changed by failed update")
+			}
+		})
+	}
+}
+
+// Удаление SOA и NS на вершине зоны игнорируется, серийный номер не меняется
+func TestUpdateApexProtected(t *testing.T) {
+	apex := rrs("dyn.test. 0 IN SOA ns1.dyn.test. hostmaster.dyn.test. 1 3600 600 604800 60")
+	tests := []struct {
+		name  string
+		build func(m *miekg_dns.Msg)
+	}{
+		{name: "delete SOA rrset", build: func(m *miekg_dns.Msg) { m.RemoveRRset(apex) }},
+		{name: "delete NS rrset", build: func(m *miekg_dns.Msg) { m.RemoveRRset(rrs("dyn.test. 0 IN NS ns1.dyn.test.")) }},
+		{name: "delete apex name", build: func(m *miekg_dns.Msg) { m.RemoveName(apex) }},
+		{name: "delete SOA record", build: func(m *miekg_dns.Msg) {
+			m.Remove(rrs("dyn.test. 0 IN SOA ns1.dyn.test. hostmaster.dyn.test. 1 3600 600 604800 60"))
+		}},
+		{name: "older SOA", build: func(m *miekg_dns.Msg) {
+			m.Insert(rrs("dyn.test. 60 IN SOA ns1.dyn.test. hostmaster.dyn.test. 1 3600 600 604800 60"))
+		}},
+		{name: "record next to CNAME", build: func(m *miekg_dns.Msg) { m.Insert(rrs("alias.dyn.test. 60 IN A 192.0.2.9")) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newUpdateServer(t)
+			z := s.zones["dyn.test."]
+			serial := z.soa.Serial
+			if rcode := sendUpdate(s, "dyn.test.", "ci-key.", nil, tt.build); rcode != miekg_dns.RcodeSuccess {
+				t.Fatalf("rcode %s", miekg_dns.RcodeToString[rcode])
+			}
+			if len(z.rrs["dyn.test."][miekg_dns.TypeSOA]) != 1 || len(z.rrs["dyn.test."][miekg_dns.TypeNS]) == 0 {
+				t.Errorf("apex damaged: %v", z.rrs["dyn.test."])
+			}
+			if z.soa.Serial != serial {
+				t.Errorf("serial %d, want %d", z.soa.Serial, serial)
+			}
+		})
+	}
+}
+
+func TestUpdateSerial(t *testing.T) {
+	s, file := newUpdateServer(t)
+	z := s.zones["dyn.test."]
+	serial := z.soa.Serial
+
+	rcode := sendUpdate(s, "dyn.test.", "ci-key.", nil, func(m *miekg_dns.Msg) {
+		m.Insert(rrs("new.dyn.test. 60 IN A 192.0.2.9"))
+		m.Remove(rrs("www.dyn.test. 0 IN A 192.0.2.1"))
+		m.Remove(rrs("dyn.test. 0 IN NS ns2.dyn.test."))
+	})
+	if rcode != miekg_dns.RcodeSuccess {
+		t.Fatalf("rcode %s", miekg_dns.RcodeToString[rcode])
+	}
+	if z.soa.Serial != serial+1 {
+		t.Errorf("serial %d, want %d", z.soa.Serial, serial+1)
+	}
+	if got := len(z.rrs["www.dyn.test."][miekg_dns.TypeA]); got != 1 {
+		t.Errorf("%d A records for www, want 1", got)
+	}
+	if got := len(z.rrs["dyn.test."][miekg_dns.TypeNS]); got != 1 {
+		t.Errorf("%d apex NS, want 1", got)
+	}
+
+	// Повтор того же добавления и удаление последнего NS ничего не меняют
+	sendUpdate(s, "dyn.test.", "ci-key.", nil, func(m *miekg_dns.Msg) {
+		m.Insert(rrs("new.dyn.test. 60 IN A 192.0.2.9"))
+		m.Remove(rrs("dyn.test. 0 IN NS ns1.dyn.test."))
+	})
+	if z.soa.Serial != serial+1 || len(z.rrs["dyn.test."][miekg_dns.TypeNS]) != 1 {
+		t.Errorf("no-op update changed zone: serial %d, NS %v", z.soa.Serial, z.rrs["dyn.test."][miekg_dns.TypeNS])
+	}
+
+	// Явный SOA с большим номером заменяет текущий без дополнительного увеличения
+	sendUpdate(s, "dyn.test.", "ci-key.", nil, func(m *miekg_dns.Msg) {
+		m.Insert(rrs(fmt.Sprintf("dyn.test. 60 IN SOA ns1.dyn.test. hostmaster.dyn.test. %d 3600 600 604800 60", serial+10)))
+	})
+	if z.soa.Serial != serial+10 {
+		t.Errorf("serial %d, want %d", z.soa.Serial, serial+10)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "new.dyn.test.") || !strings.Contains(string(data), fmt.Sprint(serial+10)) {
+		t.Errorf("zone file not updated:\n%s", data)
+	}
+}
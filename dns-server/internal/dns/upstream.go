@@ -0,0 +1,332 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"dns-server/internal/config"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Соединения с апстримами по TCP и TLS (DoT, RFC 7858) не закрываются после
+// ответа, а переиспользуются: запросы идут конвейером, не дожидаясь ответов
+// на предыдущие, ответы сопоставляются по ID и могут прийти в любом порядке
+// (RFC 7766, 6.2.1). Простаивающие соединения закрываются по idle_timeout.
+
+var errPoolClosed = errors.New("upstream connections closed")
+
+type upstream struct {
+	proto      string // "" - UDP с повтором по TCP, tcp или tls
+	addr       string
+	serverName string // имя в сертификате DoT
+}
+
+func parseUpstream(s string) upstream {
+	var u upstream
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		rest = s
+	} else {
+		u.proto = scheme
+	}
+	port := "53"
+	if u.proto == config.UpstreamTLS {
+		port = "853"
+		rest, u.serverName, _ = strings.Cut(rest, "#")
+	}
+	if _, _, err := net.SplitHostPort(rest); err != nil {
+		rest = net.JoinHostPort(rest, port)
+	}
+	u.addr = rest
+	if u.proto == config.UpstreamTLS && u.serverName == "" {
+		u.serverName, _, _ = net.SplitHostPort(rest)
+	}
+	return u
+}
+
+func (u upstream) String() string {
+	if u.proto == "" {
+		return u.addr
+	}
+	s := u.proto + "://" + u.addr
+	if host, _, _ := net.SplitHostPort(u.addr); u.proto == config.UpstreamTLS && u.serverName != host {
+		s += "#" + u.serverName
+	}
+	return s
+}
+
+// connPools - пулы соединений по апстримам
+type connPools struct {
+	size        int
+	idle        time.Duration
+	dialTimeout time.Duration
+	tlsConfig   *tls.Config // общая часть настроек DoT, ServerName - свой у апстрима
+
+	mu     sync.Mutex
+	pools  map[upstream]*connPool
+	closed atomic.Bool // атомарный: проверяется и под локами отдельных пулов
+}
+
+func newConnPools(cfg config.UpstreamPoolConfig, dialTimeout time.Duration) *connPools {
+	return &connPools{
+		size:        cfg.Size,
+		idle:        cfg.IdleTimeout,
+		dialTimeout: dialTimeout,
+		tlsConfig:   &tls.Config{MinVersion: tls.VersionTLS12},
+		pools:       make(map[upstream]*connPool),
+	}
+}
+
+func (p *connPools) exchange(ctx context.Context, u upstream, m *miekg_dns.Msg) (*miekg_dns.Msg, error) {
+	p.mu.Lock()
+	if p.closed.Load() {
+		p.mu.Unlock()
+		return nil, errPoolClosed
+	}
+	pool, ok := p.pools[u]
+	if !ok {
+		pool = &connPool{parent: p, u: u}
+		p.pools[u] = pool
+	}
+	p.mu.Unlock()
+	return pool.exchange(ctx, m)
+}
+
+// close закрывает все соединения; запросы в них завершаются ошибкой
+func (p *connPools) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed.Store(true)
+	for _, pool := range p.pools {
+		pool.mu.Lock()
+		for _, c := range pool.conns {
+			c.fail(errPoolClosed)
+		}
+		pool.conns = nil
+		pool.mu.Unlock()
+	}
+}
+
+type connPool struct {
+	parent *connPools
+	u      upstream
+
+	mu    sync.Mutex
+	conns []*pipeConn
+}
+
+func (p *connPool) exchange(ctx context.Context, m *miekg_dns.Msg) (*miekg_dns.Msg, error) {
+	var err error
+	// Сервер мог закрыть простаивающее соединение - один повтор на новом
+	for range 2 {
+		var c *pipeConn
+		if c, err = p.get(); err != nil {
+			return nil, err
+		}
+		var resp *miekg_dns.Msg
+		resp, err = c.exchange(ctx, m)
+		if err == nil || ctx.Err() != nil {
+			return resp, err
+		}
+	}
+	return nil, err
+}
+
+// get выбирает наименее загруженное живое соединение. Новое открывается,
+// если все заняты, а пул ещё не заполнен.
+func (p *connPool) get() (*pipeConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// close мог пройти по пулу между проверкой в connPools.exchange и этим
+	// локом - новое соединение в закрытом пуле никто бы не закрыл
+	if p.parent.closed.Load() {
+		return nil, errPoolClosed
+	}
+	var best *pipeConn
+	live := p.conns[:0]
+	for _, c := range p.conns {
+		if !c.alive() {
+			continue
+		}
+		live = append(live, c)
+		if best == nil || c.inflight.Load() < best.inflight.Load() {
+			best = c
+		}
+	}
+	clear(p.conns[len(live):])
+	p.conns = live
+	if best == nil || best.inflight.Load() > 0 && len(p.conns) < p.parent.size {
+		best = newPipeConn(p.u, p.parent)
+		p.conns = append(p.conns, best)
+	}
+	return best, nil
+}
+
+// pipeConn - одно соединение: запись под wmu, чтение - в readLoop,
+// ожидающие ответа запросы - в pending по ID
+type pipeConn struct {
+	idle     time.Duration
+	ready    chan struct{} // закрывается после установки соединения
+	inflight atomic.Int32
+
+	wmu  sync.Mutex
+	conn *miekg_dns.Conn
+
+	mu      sync.Mutex
+	pending map[uint16]chan *miekg_dns.Msg
+	err     error
+}
+
+func newPipeConn(u upstream, p *connPools) *pipeConn {
+	c := &pipeConn{
+		idle:    p.idle,
+		ready:   make(chan struct{}),
+		pending: make(map[uint16]chan *miekg_dns.Msg),
+	}
+	go c.dial(u, p)
+	return c
+}
+
+func (c *pipeConn) dial(u upstream, p *connPools) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	d := &net.Dialer{}
+	if u.proto == config.UpstreamTLS {
+		tc := p.tlsConfig.Clone()
+		tc.ServerName = u.serverName
+		td := &tls.Dialer{NetDialer: d, Config: tc}
+		conn, err = td.DialContext(ctx, "tcp", u.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", u.addr)
+	}
+
+	c.mu.Lock()
+	switch {
+	case err != nil:
+		c.err = err
+	case c.err != nil:
+		// Пул закрыли, пока соединение устанавливалось
+		conn.Close()
+	case p.closed.Load():
+		conn.Close()
+		c.err = errPoolClosed
+	default:
+		c.conn = &miekg_dns.Conn{Conn: conn}
+	}
+	ok := c.err == nil
+	c.mu.Unlock()
+	close(c.ready)
+	if ok {
+		c.readLoop()
+	}
+}
+
+func (c *pipeConn) alive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil
+}
+
+// readLoop раздаёт ответы ожидающим запросам. Соединение закрывается,
+// если из него ничего не приходит дольше idle.
+func (c *pipeConn) readLoop() {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.idle))
+		resp, err := c.conn.ReadMsg()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[resp.Id]
+		delete(c.pending, resp.Id)
+		c.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+func (c *pipeConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *pipeConn) exchange(ctx context.Context, m *miekg_dns.Msg) (*miekg_dns.Msg, error) {
+	c.inflight.Add(1)
+	defer c.inflight.Add(-1)
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// ID должен быть уникален среди запросов в соединении
+	ch := make(chan *miekg_dns.Msg, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	id := m.Id
+	for c.pending[id] != nil {
+		id = miekg_dns.Id()
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+	q := m
+	if id != m.Id {
+		q = m.Copy()
+		q.Id = id
+	}
+
+	// Дедлайн запроса тут не подходит: недописанное сообщение
+	// сломает соединение для всех запросов в нём
+	c.wmu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.idle))
+	err := c.conn.WriteMsg(q)
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.idle))
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return nil, c.err
+		}
+		resp.Id = m.Id
+		return resp, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		if c.pending[id] == ch {
+			delete(c.pending, id)
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
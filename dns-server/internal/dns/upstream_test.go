@@ -0,0 +1,299 @@
+package dns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"dns-server/internal/config"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Сравнение пула с конвейером и отдельного соединения на каждый запрос
+// (Client.Exchange) на локальном апстриме:
+//
+//	go test ./internal/dns -run '^$' -bench Upstream
+
+const benchServerName = "upstream.test"
+
+// testUpstream запускает локальный апстрим, отвечающий A 192.0.2.1 на всё.
+// Для tls возвращает и пул корневых сертификатов, которому он доверяет.
+func testUpstream(tb testing.TB, proto string) (string, *x509.CertPool) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var roots *x509.CertPool
+	if proto == config.UpstreamTLS {
+		cert, pool := testCertificate(tb)
+		l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+		roots = pool
+	}
+
+	started := make(chan struct{})
+	srv := &miekg_dns.Server{
+		Listener:          l,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: miekg_dns.HandlerFunc(func(w miekg_dns.ResponseWriter, r *miekg_dns.Msg) {
+			m := new(miekg_dns.Msg)
+			m.SetReply(r)
+			m.Answer = []miekg_dns.RR{&miekg_dns.A{
+				Hdr: miekg_dns.RR_Header{Name: r.Question[0].Name, Rrtype: miekg_dns.TypeA, Class: miekg_dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, 1),
+			}}
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+	tb.Cleanup(func() { _ = srv.Shutdown() })
+	return l.Addr().String(), roots
+}
+
+func testCertificate(tb testing.TB) (tls.Certificate, *x509.CertPool) {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: benchServerName},
+		DNSNames:              []string{benchServerName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// testPipeServer принимает TCP-соединения и отдаёт каждое handle
+func testPipeServer(t *testing.T, handle func(c *miekg_dns.Conn)) (string, *atomic.Int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	accepted := new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				handle(&miekg_dns.Conn{Conn: conn})
+			}()
+		}
+	}()
+	return l.Addr().String(), accepted
+}
+
+func reply(c *miekg_dns.Conn, q *miekg_dns.Msg) error {
+	m := new(miekg_dns.Msg)
+	m.SetReply(q)
+	m.Answer = []miekg_dns.RR{testRR("%s 60 IN A 192.0.2.1", q.Question[0].Name)}
+	return c.WriteMsg(m)
+}
+
+func testPools(t *testing.T, size int) *connPools {
+	p := newConnPools(config.UpstreamPoolConfig{Size: size, IdleTimeout: 10 * time.Second}, 5*time.Second)
+	t.Cleanup(p.close)
+	return p
+}
+
+// Запросы уходят в одно соединение, не дожидаясь ответов, а ответы в обратном
+// порядке раздаются по ID. Одинаковые ID клиентов не путаются.
+func TestPipeline(t *testing.T) {
+	const n = 3
+	addr, accepted := testPipeServer(t, func(c *miekg_dns.Conn) {
+		var queries []*miekg_dns.Msg
+		for range n {
+			q, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			queries = append(queries, q)
+		}
+		for _, q := range slices.Backward(queries) {
+			if reply(c, q) != nil {
+				return
+			}
+		}
+		_, _ = c.ReadMsg()
+	})
+	p := testPools(t, 1)
+	u := upstream{proto: config.UpstreamTCP, addr: addr}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := new(miekg_dns.Msg)
+			m.SetQuestion(fmt.Sprintf("q%d.example.", i), miekg_dns.TypeA)
+			m.Id = 42
+			resp, err := p.exchange(ctx, u, m)
+			if err != nil {
+				t.Errorf("q%d: %v", i, err)
+				return
+			}
+			if resp.Id != 42 || resp.Question[0].Name != m.Question[0].Name {
+				t.Errorf("q%d: got answer %d for %s", i, resp.Id, resp.Question[0].Name)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted.Load() != 1 {
+		t.Errorf("%d connections, want 1", accepted.Load())
+	}
+}
+
+// Соединение, закрытое сервером, помечается мёртвым, запрос повторяется на новом
+func TestPoolRedial(t *testing.T) {
+	addr, accepted := testPipeServer(t, func(c *miekg_dns.Conn) {
+		if q, err := c.ReadMsg(); err == nil {
+			_ = reply(c, q)
+		}
+	})
+	p := testPools(t, 1)
+	u := upstream{proto: config.UpstreamTCP, addr: addr}
+
+	var first *pipeConn
+	for i := range 3 {
+		m := new(miekg_dns.Msg)
+		m.SetQuestion("redial.example.", miekg_dns.TypeA)
+		if _, err := p.exchange(context.Background(), u, m); err != nil {
+			t.Fatalf("exchange %d: %v", i, err)
+		}
+		if first == nil {
+			pool := p.pools[u]
+			pool.mu.Lock()
+			first = pool.conns[0]
+			pool.mu.Unlock()
+		}
+	}
+	if first.alive() {
+		t.Error("connection closed by server is still alive")
+	}
+	if accepted.Load() != 3 {
+		t.Errorf("%d connections, want 3", accepted.Load())
+	}
+}
+
+func TestPoolClosed(t *testing.T) {
+	addr, _ := testPipeServer(t, func(c *miekg_dns.Conn) { _, _ = c.ReadMsg() })
+	p := testPools(t, 2)
+	u := upstream{proto: config.UpstreamTCP, addr: addr}
+	m := new(miekg_dns.Msg)
+	m.SetQuestion("closed.example.", miekg_dns.TypeA)
+	pool := &connPool{parent: p, u: u}
+	p.pools[u] = pool
+	p.close()
+
+	if _, err := p.exchange(context.Background(), u, m); !errors.Is(err, errPoolClosed) {
+		t.Errorf("exchange after close: %v", err)
+	}
+	// Запрос прошёл проверку в connPools.exchange до close
+	if _, err := pool.exchange(context.Background(), m); !errors.Is(err, errPoolClosed) {
+		t.Errorf("pool exchange after close: %v", err)
+	}
+	if len(pool.conns) != 0 {
+		t.Errorf("%d connections added to a closed pool", len(pool.conns))
+	}
+	// Соединение, которое устанавливалось во время close, закрывается
+	c := newPipeConn(u, p)
+	<-c.ready
+	if c.alive() || c.conn != nil {
+		t.Error("connection dialed after close is alive")
+	}
+}
+
+// checkAnswer вызывается из горутин RunParallel, где Fatal нельзя
+func checkAnswer(b *testing.B, m, resp *miekg_dns.Msg, err error) bool {
+	b.Helper()
+	if err != nil {
+		b.Error(err)
+		return false
+	}
+	if resp.Id != m.Id || len(resp.Answer) != 1 || resp.Question[0].Name != m.Question[0].Name {
+		b.Errorf("unexpected response: %v", resp)
+		return false
+	}
+	return true
+}
+
+func BenchmarkUpstream(b *testing.B) {
+	for _, proto := range []string{config.UpstreamTCP, config.UpstreamTLS} {
+		addr, roots := testUpstream(b, proto)
+
+		b.Run(proto+"/pool", func(b *testing.B) {
+			p := newConnPools(config.UpstreamPoolConfig{Size: 2, IdleTimeout: 10 * time.Second}, 5*time.Second)
+			p.tlsConfig.RootCAs = roots
+			defer p.close()
+			u := upstream{proto: proto, addr: addr, serverName: benchServerName}
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					m := new(miekg_dns.Msg)
+					m.SetQuestion("bench.example.", miekg_dns.TypeA)
+					resp, err := p.exchange(context.Background(), u, m)
+					if !checkAnswer(b, m, resp, err) {
+						return
+					}
+				}
+			})
+		})
+
+		b.Run(proto+"/exchange", func(b *testing.B) {
+			c := &miekg_dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+			if proto == config.UpstreamTLS {
+				c.Net = "tcp-tls"
+				c.TLSConfig = &tls.Config{ServerName: benchServerName, RootCAs: roots, MinVersion: tls.VersionTLS12}
+			}
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					m := new(miekg_dns.Msg)
+					m.SetQuestion("bench.example.", miekg_dns.TypeA)
+					resp, _, err := c.Exchange(m, addr)
+					if !checkAnswer(b, m, resp, err) {
+						return
+					}
+				}
+			})
+		})
+	}
+}
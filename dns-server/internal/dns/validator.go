@@ -0,0 +1,728 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Валидация DNSSEC для ответов из апстрима (RFC 4035, 5).
+// Цепочка доверия строится сверху вниз от якоря: для каждого имени запрашиваем DS,
+// при наличии DS - DNSKEY дочерней зоны. Доказательства отрицания проверяются
+// для NSEC и NSEC3 (включая opt-out). Ответ, синтезированный из wildcard,
+// принимается только с доказательством, что более точного совпадения нет.
+
+type secStatus int
+
+const (
+	statusInsecure secStatus = iota
+	statusSecure
+	statusBogus
+)
+
+var errBogus = errors.New("bogus")
+
+const maxLinks = 10000 // зон в кеше цепочек доверия
+
+// chainLink - результат проверки цепочки для имени: ближайшая зона и её ключи
+type chainLink struct {
+	status secStatus
+	zone   string
+	keys   []*miekg_dns.DNSKEY
+	expiry time.Time
+}
+
+type validator struct {
+	anchors map[string][]miekg_dns.RR
+	query   func(ctx context.Context, name string, qtype uint16) (*miekg_dns.Msg, error)
+
+	mu    sync.Mutex
+	links map[string]chainLink
+}
+
+func newValidator(anchors []string, query func(context.Context, string, uint16) (*miekg_dns.Msg, error)) (*validator, error) {
+	v := &validator{
+		anchors: make(map[string][]miekg_dns.RR),
+		query:   query,
+		links:   make(map[string]chainLink),
+	}
+	for _, s := range anchors {
+		rr, err := miekg_dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		zone := miekg_dns.CanonicalName(rr.Header().Name)
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+	return v, nil
+}
+
+func parentName(name string) string {
+	off, end := miekg_dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
+
+// chain возвращает статус зоны, в которой находится name. Запросы цепочки
+// укладываются в дедлайн ctx проверяемого ответа.
+func (v *validator) chain(ctx context.Context, name string) chainLink {
+	name = miekg_dns.CanonicalName(name)
+
+	v.mu.Lock()
+	l, ok := v.links[name]
+	v.mu.Unlock()
+	if ok && time.Now().Before(l.expiry) {
+		return l
+	}
+
+	if anchors, ok := v.anchors[name]; ok {
+		l = v.anchorLink(ctx, name, anchors)
+	} else if name == "." {
+		// Выше нет якоря - всё, что под ним, небезопасно
+		l = chainLink{status: statusInsecure, zone: ".", expiry: time.Now().Add(time.Hour)}
+	} else {
+		l = v.step(ctx, v.chain(ctx, parentName(name)), name)
+	}
+	// Не успели за дедлайн запроса - это не повод считать зону поддельной
+	// для следующих запросов. Кешируются только разрезы зон: имя внутри зоны
+	// берёт статус у неё, иначе случайные поддомены раздували бы кеш.
+	if ctx.Err() != nil || l.zone != name {
+		return l
+	}
+
+	now := time.Now()
+	v.mu.Lock()
+	if _, ok := v.links[name]; !ok && len(v.links) >= maxLinks {
+		v.evict(now)
+	}
+	v.links[name] = l
+	v.mu.Unlock()
+	return l
+}
+
+// evict освобождает место в кеше цепочек так же, как resolver.evict.
+// Вызывать под mu.
+func (v *validator) evict(now time.Time) {
+	for name, l := range v.links {
+		if !now.Before(l.expiry) {
+			delete(v.links, name)
+		}
+	}
+	if len(v.links) < maxLinks {
+		return
+	}
+	for name := range v.links {
+		if len(v.links) < maxLinks*3/4 {
+			break
+		}
+		delete(v.links, name)
+	}
+}
+
+func linkExpiry(rrs []miekg_dns.RR) time.Time {
+	ttl := uint32(3600)
+	for _, rr := range rrs {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return time.Now().Add(time.Duration(max(ttl, 30)) * time.Second)
+}
+
+func bogusLink(zone string) chainLink {
+	return chainLink{status: statusBogus, zone: zone, expiry: time.Now().Add(10 * time.Second)}
+}
+
+func (v *validator) anchorLink(ctx context.Context, zone string, anchors []miekg_dns.RR) chainLink {
+	keys, sigs, err := v.fetchKeys(ctx, zone)
+	if err != nil {
+		return bogusLink(zone)
+	}
+
+	for _, key := range keys {
+		trusted := false
+		for _, a := range anchors {
+			switch a := a.(type) {
+			case *miekg_dns.DS:
+				trusted = trusted || dsMatches(a, key)
+			case *miekg_dns.DNSKEY:
+				trusted = trusted || (a.Algorithm == key.Algorithm && a.PublicKey == key.PublicKey)
+			}
+		}
+		if trusted && verifyWith(dnskeysToRRs(keys), sigs, []*miekg_dns.DNSKEY{key}, zone) == nil {
+			return chainLink{status: statusSecure, zone: zone, keys: keys, expiry: linkExpiry(dnskeysToRRs(keys))}
+		}
+	}
+	return bogusLink(zone)
+}
+
+func (v *validator) step(ctx context.Context, parent chainLink, name string) chainLink {
+	if parent.status != statusSecure {
+		return parent
+	}
+
+	resp, err := v.query(ctx, name, miekg_dns.TypeDS)
+	if err != nil {
+		return bogusLink(parent.zone)
+	}
+
+	sets, sigs := groupRRsets(resp.Answer)
+	dsKey := rrsetKey{name, miekg_dns.TypeDS}
+	if dsSet := sets[dsKey]; len(dsSet) > 0 {
+		if verifyWith(dsSet, sigs[dsKey], parent.keys, parent.zone) != nil {
+			return bogusLink(parent.zone)
+		}
+
+		var supported []*miekg_dns.DS
+		for _, rr := range dsSet {
+			ds := rr.(*miekg_dns.DS)
+			if supportedAlgorithm(ds.Algorithm) && supportedDigest(ds.DigestType) {
+				supported = append(supported, ds)
+			}
+		}
+		// Алгоритмы нам неизвестны - считаем зону неподписанной (RFC 4035, 5.2)
+		if len(supported) == 0 {
+			return chainLink{status: statusInsecure, zone: name, expiry: linkExpiry(dsSet)}
+		}
+
+		keys, keySigs, err := v.fetchKeys(ctx, name)
+		if err != nil {
+			return bogusLink(name)
+		}
+		for _, key := range keys {
+			for _, ds := range supported {
+				if dsMatches(ds, key) && verifyWith(dnskeysToRRs(keys), keySigs, []*miekg_dns.DNSKEY{key}, name) == nil {
+					return chainLink{status: statusSecure, zone: name, keys: keys, expiry: linkExpiry(append(dsSet, dnskeysToRRs(keys)...))}
+				}
+			}
+		}
+		return bogusLink(name)
+	}
+
+	// DS нет: нужно подписанное доказательство от родительской зоны
+	nsecs, nsec3s, authority, ok := v.verifiedDenial(resp, parent)
+	if !ok {
+		return bogusLink(parent.zone)
+	}
+	notCut := chainLink{status: statusSecure, zone: parent.zone, keys: parent.keys, expiry: linkExpiry(authority)}
+	if resp.Rcode == miekg_dns.RcodeNameError {
+		return notCut
+	}
+
+	for _, n := range nsecs {
+		if miekg_dns.CanonicalName(n.Hdr.Name) != name {
+			continue
+		}
+		if hasType(n.TypeBitMap, miekg_dns.TypeDS) {
+			return bogusLink(parent.zone)
+		}
+		if hasType(n.TypeBitMap, miekg_dns.TypeNS) && !hasType(n.TypeBitMap, miekg_dns.TypeSOA) {
+			return chainLink{status: statusInsecure, zone: name, expiry: linkExpiry(authority)}
+		}
+		return notCut
+	}
+	for _, n := range nsec3s {
+		if !n.Match(name) {
+			continue
+		}
+		if hasType(n.TypeBitMap, miekg_dns.TypeDS) {
+			return bogusLink(parent.zone)
+		}
+		if hasType(n.TypeBitMap, miekg_dns.TypeNS) && !hasType(n.TypeBitMap, miekg_dns.TypeSOA) {
+			return chainLink{status: statusInsecure, zone: name, expiry: linkExpiry(authority)}
+		}
+		return notCut
+	}
+	// Opt-out: делегирование покрыто NSEC3 с флагом opt-out
+	if _, next, ok := closestEncloser(name, nsec3s); ok {
+		for _, n := range nsec3s {
+			if n.Flags&1 == 1 && n.Cover(next) {
+				return chainLink{status: statusInsecure, zone: name, expiry: linkExpiry(authority)}
+			}
+		}
+	}
+	for _, n := range nsecs {
+		if nsecCovers(n, name) {
+			return notCut
+		}
+	}
+	return bogusLink(parent.zone)
+}
+
+// verifiedDenial проверяет подписи NSEC/NSEC3 (и SOA) в authority ключами зоны link
+func (v *validator) verifiedDenial(resp *miekg_dns.Msg, link chainLink) ([]*miekg_dns.NSEC, []*miekg_dns.NSEC3, []miekg_dns.RR, bool) {
+	var nsecs []*miekg_dns.NSEC
+	var nsec3s []*miekg_dns.NSEC3
+	var authority []miekg_dns.RR
+
+	sets, sigs := groupRRsets(resp.Ns)
+	for key, rrset := range sets {
+		switch key.t {
+		case miekg_dns.TypeNSEC, miekg_dns.TypeNSEC3, miekg_dns.TypeSOA:
+		default:
+			continue
+		}
+		if verifyWith(rrset, sigs[key], link.keys, link.zone) != nil {
+			return nil, nil, nil, false
+		}
+		authority = append(authority, rrset...)
+		for _, rr := range rrset {
+			switch rr := rr.(type) {
+			case *miekg_dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *miekg_dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+	return nsecs, nsec3s, authority, len(nsecs)+len(nsec3s) > 0
+}
+
+func (v *validator) fetchKeys(ctx context.Context, zone string) ([]*miekg_dns.DNSKEY, []*miekg_dns.RRSIG, error) {
+	resp, err := v.query(ctx, zone, miekg_dns.TypeDNSKEY)
+	if err != nil {
+		return nil, nil, err
+	}
+	sets, sigs := groupRRsets(resp.Answer)
+	k := rrsetKey{zone, miekg_dns.TypeDNSKEY}
+	var keys []*miekg_dns.DNSKEY
+	for _, rr := range sets[k] {
+		keys = append(keys, rr.(*miekg_dns.DNSKEY))
+	}
+	if len(keys) == 0 {
+		return nil, nil, errors.New("no DNSKEY for " + zone)
+	}
+	return keys, sigs[k], nil
+}
+
+// validate проверяет ответ апстрима на вопрос q
+func (v *validator) validate(ctx context.Context, q miekg_dns.Question, resp *miekg_dns.Msg) (secStatus, string) {
+	status := statusSecure
+	lower := func(st secStatus) {
+		if st == statusInsecure && status == statusSecure {
+			status = statusInsecure
+		}
+	}
+
+	sets, sigs := groupRRsets(resp.Answer)
+	var wildcards []string // next closer name для RRsets из wildcard
+	for key, rrset := range sets {
+		// CNAME, синтезированный из подписанного DNAME, подписи не имеет
+		if key.t == miekg_dns.TypeCNAME && len(sigs[key]) == 0 && synthesizedFromDNAME(key.name, sets) {
+			continue
+		}
+		st, why := v.verifySet(ctx, key, rrset, sigs[key])
+		if st == statusBogus {
+			return statusBogus, why
+		}
+		lower(st)
+		if next, ok := wildcardNextCloser(key.name, sigs[key]); ok && st == statusSecure {
+			wildcards = append(wildcards, next)
+		}
+	}
+
+	target := cnameTarget(miekg_dns.CanonicalName(q.Name), resp.Answer)
+	negative := resp.Rcode == miekg_dns.RcodeNameError || (!hasAnswer(target, q.Qtype, sets) && resp.Rcode == miekg_dns.RcodeSuccess)
+	if !negative && len(wildcards) == 0 {
+		return status, ""
+	}
+
+	nsSets, nsSigs := groupRRsets(resp.Ns)
+	var nsecs []*miekg_dns.NSEC
+	var nsec3s []*miekg_dns.NSEC3
+	signed := false
+	for key, rrset := range nsSets {
+		switch key.t {
+		case miekg_dns.TypeNSEC, miekg_dns.TypeNSEC3, miekg_dns.TypeSOA:
+		default:
+			continue
+		}
+		if len(nsSigs[key]) == 0 {
+			continue
+		}
+		signed = true
+		st, why := v.verifySet(ctx, key, rrset, nsSigs[key])
+		if st == statusBogus {
+			return statusBogus, why
+		}
+		lower(st)
+		for _, rr := range rrset {
+			switch rr := rr.(type) {
+			case *miekg_dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *miekg_dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+
+	// Подписанный wildcard можно подставить вместо существующего имени -
+	// нужен NSEC/NSEC3, покрывающий next closer name (RFC 4035, 5.3.4; RFC 5155, 8.8)
+	for _, next := range wildcards {
+		if !covers(next, nsecs, nsec3s) {
+			return statusBogus, "no proof that wildcard answer for " + next + " has no closer match"
+		}
+	}
+	if !negative {
+		return status, ""
+	}
+
+	// Отрицательный ответ: NXDOMAIN или NODATA
+	if !signed {
+		// Апстрим отдал только начало цепочки CNAME - отрицать тут нечего
+		if target != miekg_dns.CanonicalName(q.Name) && resp.Rcode == miekg_dns.RcodeSuccess && len(resp.Ns) == 0 {
+			return status, ""
+		}
+		if v.chain(ctx, target).status == statusInsecure {
+			return statusInsecure, ""
+		}
+		return statusBogus, "missing denial of existence for " + target
+	}
+	if status != statusSecure {
+		return status, ""
+	}
+
+	if !denies(target, q.Qtype, resp.Rcode == miekg_dns.RcodeNameError, nsecs, nsec3s) {
+		return statusBogus, "denial of existence does not prove " + target + "/" + miekg_dns.TypeToString[q.Qtype]
+	}
+	return statusSecure, ""
+}
+
+func (v *validator) verifySet(ctx context.Context, key rrsetKey, rrset []miekg_dns.RR, sigs []*miekg_dns.RRSIG) (secStatus, string) {
+	if len(sigs) == 0 {
+		link := v.chain(ctx, key.name)
+		if link.status == statusSecure {
+			return statusBogus, "missing RRSIG for " + key.String()
+		}
+		return link.status, "no chain of trust for " + key.String()
+	}
+
+	signer := miekg_dns.CanonicalName(sigs[0].SignerName)
+	if !miekg_dns.IsSubDomain(signer, key.name) {
+		return statusBogus, "signer " + signer + " is not an ancestor of " + key.String()
+	}
+	link := v.chain(ctx, signer)
+	if link.status != statusSecure {
+		return link.status, "no chain of trust for " + signer
+	}
+	if link.zone != signer {
+		return statusBogus, "signer " + signer + " is not a zone apex"
+	}
+	if err := verifyWith(rrset, sigs, link.keys, signer); err != nil {
+		return statusBogus, "bad signature on " + key.String()
+	}
+	return statusSecure, ""
+}
+
+// verifyWith проверяет, что хотя бы одна действующая подпись сделана одним из keys
+func verifyWith(rrset []miekg_dns.RR, sigs []*miekg_dns.RRSIG, keys []*miekg_dns.DNSKEY, zone string) error {
+	now := time.Now()
+	for _, sig := range sigs {
+		if miekg_dns.CanonicalName(sig.SignerName) != zone || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range keys {
+			if k.Flags&miekg_dns.ZONE == 0 || k.Algorithm != sig.Algorithm || k.KeyTag() != sig.KeyTag {
+				continue
+			}
+			if sig.Verify(k, rrset) == nil {
+				return nil
+			}
+		}
+	}
+	return errBogus
+}
+
+func dsMatches(ds *miekg_dns.DS, key *miekg_dns.DNSKEY) bool {
+	if ds.Algorithm != key.Algorithm || ds.KeyTag != key.KeyTag() {
+		return false
+	}
+	d := key.ToDS(ds.DigestType)
+	return d != nil && strings.EqualFold(d.Digest, ds.Digest)
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case miekg_dns.RSASHA1, miekg_dns.RSASHA1NSEC3SHA1, miekg_dns.RSASHA256, miekg_dns.RSASHA512,
+		miekg_dns.ECDSAP256SHA256, miekg_dns.ECDSAP384SHA384, miekg_dns.ED25519:
+		return true
+	}
+	return false
+}
+
+func supportedDigest(t uint8) bool {
+	return t == miekg_dns.SHA1 || t == miekg_dns.SHA256 || t == miekg_dns.SHA384
+}
+
+func dnskeysToRRs(keys []*miekg_dns.DNSKEY) []miekg_dns.RR {
+	out := make([]miekg_dns.RR, len(keys))
+	for i, k := range keys {
+		out[i] = k
+	}
+	return out
+}
+
+type rrsetKey struct {
+	name string
+	t    uint16
+}
+
+func (k rrsetKey) String() string {
+	return k.name + "/" + miekg_dns.TypeToString[k.t]
+}
+
+// groupRRsets раскладывает секцию на RRsets и подписи к ним
+func groupRRsets(rrs []miekg_dns.RR) (map[rrsetKey][]miekg_dns.RR, map[rrsetKey][]*miekg_dns.RRSIG) {
+	sets := make(map[rrsetKey][]miekg_dns.RR)
+	sigs := make(map[rrsetKey][]*miekg_dns.RRSIG)
+	for _, rr := range rrs {
+		name := miekg_dns.CanonicalName(rr.Header().Name)
+		if sig, ok := rr.(*miekg_dns.RRSIG); ok {
+			k := rrsetKey{name, sig.TypeCovered}
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		if rr.Header().Rrtype == miekg_dns.TypeOPT {
+			continue
+		}
+		k := rrsetKey{name, rr.Header().Rrtype}
+		sets[k] = append(sets[k], rr)
+	}
+	return sets, sigs
+}
+
+func cnameTarget(name string, answer []miekg_dns.RR) string {
+	for i := 0; i < 16; i++ {
+		found := false
+		for _, rr := range answer {
+			if c, ok := rr.(*miekg_dns.CNAME); ok && miekg_dns.CanonicalName(c.Hdr.Name) == name {
+				name = miekg_dns.CanonicalName(c.Target)
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return name
+}
+
+func hasAnswer(name string, qtype uint16, sets map[rrsetKey][]miekg_dns.RR) bool {
+	if qtype == miekg_dns.TypeANY || qtype == miekg_dns.TypeCNAME {
+		return len(sets) > 0
+	}
+	return len(sets[rrsetKey{name, qtype}]) > 0
+}
+
+func synthesizedFromDNAME(name string, sets map[rrsetKey][]miekg_dns.RR) bool {
+	for key := range sets {
+		if key.t == miekg_dns.TypeDNAME && key.name != name && miekg_dns.IsSubDomain(key.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, x := range bitmap {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardNextCloser определяет по полю Labels подписи, что RRset name
+// синтезирован из wildcard, и возвращает next closer name: предка name
+// на одну метку длиннее источника синтеза
+func wildcardNextCloser(name string, sigs []*miekg_dns.RRSIG) (string, bool) {
+	labels := miekg_dns.SplitDomainName(name)
+	n := len(labels)
+	if n > 0 && labels[0] == "*" {
+		n--
+	}
+	for _, sig := range sigs {
+		if int(sig.Labels) < n {
+			return strings.Join(labels[len(labels)-int(sig.Labels)-1:], ".") + ".", true
+		}
+	}
+	return "", false
+}
+
+func covers(name string, nsecs []*miekg_dns.NSEC, nsec3s []*miekg_dns.NSEC3) bool {
+	for _, n := range nsecs {
+		if nsecCovers(n, name) {
+			return true
+		}
+	}
+	for _, n := range nsec3s {
+		if n.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// denies проверяет, что NSEC/NSEC3 доказывают отсутствие name (или типа qtype у name)
+func denies(name string, qtype uint16, nxdomain bool, nsecs []*miekg_dns.NSEC, nsec3s []*miekg_dns.NSEC3) bool {
+	if !nxdomain {
+		for _, n := range nsecs {
+			if miekg_dns.CanonicalName(n.Hdr.Name) == name {
+				return !hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, miekg_dns.TypeCNAME)
+			}
+		}
+		for _, n := range nsec3s {
+			if n.Match(name) {
+				return !hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, miekg_dns.TypeCNAME)
+			}
+		}
+		// Empty non-terminal: своего NSEC у имени нет, а следующее за ним
+		// имя цепочки лежит под ним (RFC 4035, 3.1.3.2)
+		for _, n := range nsecs {
+			if nsecCovers(n, name) && miekg_dns.IsSubDomain(name, miekg_dns.CanonicalName(n.NextDomain)) {
+				return true
+			}
+		}
+		// NODATA для DS под opt-out
+		if qtype == miekg_dns.TypeDS {
+			if _, next, ok := closestEncloser(name, nsec3s); ok {
+				for _, n := range nsec3s {
+					if n.Flags&1 == 1 && n.Cover(next) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+
+	for _, n := range nsecs {
+		if !nsecCovers(n, name) {
+			continue
+		}
+		// Ближайший существующий предок и отсутствие wildcard под ним
+		ce := commonAncestor(name, n.Hdr.Name)
+		if c := commonAncestor(name, n.NextDomain); miekg_dns.CountLabel(c) > miekg_dns.CountLabel(ce) {
+			ce = c
+		}
+		wildcard := "*." + ce
+		if ce == "." {
+			wildcard = "*."
+		}
+		for _, w := range nsecs {
+			if nsecCovers(w, wildcard) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ce, next, ok := closestEncloser(name, nsec3s); ok {
+		wildcard := "*." + ce
+		if ce == "." {
+			wildcard = "*."
+		}
+		nextCovered, wildcardCovered := false, false
+		for _, n := range nsec3s {
+			nextCovered = nextCovered || n.Cover(next)
+			wildcardCovered = wildcardCovered || n.Cover(wildcard)
+		}
+		return nextCovered && wildcardCovered
+	}
+	return false
+}
+
+// closestEncloser ищет ближайшего предка name с совпадающим NSEC3 и next closer name
+func closestEncloser(name string, nsec3s []*miekg_dns.NSEC3) (string, string, bool) {
+	next := name
+	for cur := parentName(name); ; cur = parentName(cur) {
+		for _, n := range nsec3s {
+			if n.Match(cur) {
+				return cur, next, true
+			}
+		}
+		if cur == "." {
+			return "", "", false
+		}
+		next = cur
+	}
+}
+
+func commonAncestor(a, b string) string {
+	n := miekg_dns.CompareDomainName(a, b)
+	labels := miekg_dns.SplitDomainName(miekg_dns.CanonicalName(a))
+	if n == 0 {
+		return "."
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+func nsecCovers(n *miekg_dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// Последняя запись цепочки указывает обратно на apex
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare сравнивает имена в каноническом порядке (RFC 4034, 6.1)
+func canonicalCompare(a, b string) int {
+	la := miekg_dns.SplitDomainName(strings.ToLower(a))
+	lb := miekg_dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(unescapeLabel(la[len(la)-i]), unescapeLabel(lb[len(lb)-i])); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func unescapeLabel(l string) string {
+	if !strings.Contains(l, `\`) {
+		return l
+	}
+	var b strings.Builder
+	for i := 0; i < len(l); i++ {
+		if l[i] != '\\' || i+1 >= len(l) {
+			b.WriteByte(l[i])
+			continue
+		}
+		if i+3 < len(l) {
+			if n, err := strconv.Atoi(l[i+1 : i+4]); err == nil && n < 256 {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(l[i+1])
+		i++
+	}
+	return b.String()
+}
+
+// stripDNSSEC убирает DNSSEC-записи для клиентов без бита DO (RFC 4035, 3.2.1)
+func stripDNSSEC(m *miekg_dns.Msg, qtype uint16) {
+	filter := func(rrs []miekg_dns.RR) []miekg_dns.RR {
+		out := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case miekg_dns.TypeRRSIG, miekg_dns.TypeNSEC, miekg_dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	m.Answer = filter(m.Answer)
+	m.Ns = filter(m.Ns)
+	m.Extra = filter(m.Extra)
+}
@@ -0,0 +1,441 @@
+package dns
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Поддельная иерархия, подписанная ключами, созданными в тесте:
+//
+//	.              якорь доверия
+//	example.       NSEC: a, n3 (делегирование), *.w, host.w
+//	n3.example.    NSEC3: *.w, host.w
+//	insecure.      без DS - неподписанная зона
+//	bad.           DS не совпадает с ключом зоны
+
+type testZone struct {
+	name string
+	key  *miekg_dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	key := &miekg_dns.DNSKEY{
+		Hdr:       miekg_dns.RR_Header{Name: name, Rrtype: miekg_dns.TypeDNSKEY, Class: miekg_dns.ClassINET, Ttl: 3600},
+		Flags:     miekg_dns.ZONE | miekg_dns.SEP,
+		Protocol:  3,
+		Algorithm: miekg_dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign возвращает RRset вместе с подписью
+func (z *testZone) sign(t *testing.T, rrset ...miekg_dns.RR) []miekg_dns.RR {
+	t.Helper()
+	sig := &miekg_dns.RRSIG{
+		Hdr:        miekg_dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrset, sig)
+}
+
+func (z *testZone) ds() miekg_dns.RR {
+	return z.key.ToDS(miekg_dns.SHA256)
+}
+
+func mustRR(t *testing.T, s string) miekg_dns.RR {
+	t.Helper()
+	rr, err := miekg_dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// expand - подписанный wildcard-RRset с подставленным именем, как его отдаёт сервер
+func expand(rrs []miekg_dns.RR, name string) []miekg_dns.RR {
+	out := make([]miekg_dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = miekg_dns.Copy(rr)
+		out[i].Header().Name = name
+	}
+	return out
+}
+
+// nsec3Chain строит NSEC3 зоны по именам и их типам
+func nsec3Chain(zone string, names map[string][]uint16) []*miekg_dns.NSEC3 {
+	type entry struct {
+		hash  string
+		types []uint16
+	}
+	var entries []entry
+	for name, types := range names {
+		slices.Sort(types)
+		entries = append(entries, entry{miekg_dns.HashName(name, miekg_dns.SHA1, 0, ""), types})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+	out := make([]*miekg_dns.NSEC3, len(entries))
+	for i, e := range entries {
+		out[i] = &miekg_dns.NSEC3{
+			Hdr:        miekg_dns.RR_Header{Name: strings.ToLower(e.hash) + "." + zone, Rrtype: miekg_dns.TypeNSEC3, Class: miekg_dns.ClassINET, Ttl: 300},
+			Hash:       miekg_dns.SHA1,
+			NextDomain: entries[(i+1)%len(entries)].hash,
+			HashLength: 20,
+			TypeBitMap: e.types,
+		}
+	}
+	return out
+}
+
+func nsec3Covering(chain []*miekg_dns.NSEC3, name string) miekg_dns.RR {
+	for _, n := range chain {
+		if n.Cover(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func nsec3Matching(chain []*miekg_dns.NSEC3, name string) miekg_dns.RR {
+	for _, n := range chain {
+		if n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	n3 := newTestZone(t, "n3.example.")
+	bad, other := newTestZone(t, "bad."), newTestZone(t, "bad.")
+
+	n3Chain := nsec3Chain(n3.name, map[string][]uint16{
+		"n3.example.":        {miekg_dns.TypeSOA, miekg_dns.TypeNS, miekg_dns.TypeDNSKEY, miekg_dns.TypeRRSIG, miekg_dns.TypeNSEC3PARAM},
+		"w.n3.example.":      nil,
+		"*.w.n3.example.":    {miekg_dns.TypeA, miekg_dns.TypeRRSIG},
+		"host.w.n3.example.": {miekg_dns.TypeA, miekg_dns.TypeRRSIG},
+	})
+
+	upstream := map[rrsetKey]*miekg_dns.Msg{}
+	answer := func(name string, qtype uint16, rrs ...[]miekg_dns.RR) {
+		m := new(miekg_dns.Msg)
+		for _, r := range rrs {
+			m.Answer = append(m.Answer, r...)
+		}
+		upstream[rrsetKey{name, qtype}] = m
+	}
+	answer(".", miekg_dns.TypeDNSKEY, root.sign(t, root.key))
+	answer("example.", miekg_dns.TypeDNSKEY, example.sign(t, example.key))
+	answer("n3.example.", miekg_dns.TypeDNSKEY, n3.sign(t, n3.key))
+	answer("example.", miekg_dns.TypeDS, root.sign(t, example.ds()))
+	answer("n3.example.", miekg_dns.TypeDS, example.sign(t, n3.ds()))
+	answer("bad.", miekg_dns.TypeDNSKEY, bad.sign(t, bad.key))
+	answer("bad.", miekg_dns.TypeDS, root.sign(t, other.ds()))
+	noDS := new(miekg_dns.Msg)
+	noDS.Ns = root.sign(t, mustRR(t, "insecure. 300 IN NSEC . NS RRSIG NSEC"))
+	upstream[rrsetKey{"insecure.", miekg_dns.TypeDS}] = noDS
+
+	query := func(_ context.Context, name string, qtype uint16) (*miekg_dns.Msg, error) {
+		if m, ok := upstream[rrsetKey{miekg_dns.CanonicalName(name), qtype}]; ok {
+			return m.Copy(), nil
+		}
+		return nil, errors.New("no answer for " + name)
+	}
+
+	wildcardA := example.sign(t, mustRR(t, "*.w.example. 300 IN A 192.0.2.99"))
+	tampered := example.sign(t, mustRR(t, "a.example. 300 IN A 192.0.2.1"))
+	tampered[0].(*miekg_dns.A).A[3] = 66
+	n3WildcardA := n3.sign(t, mustRR(t, "*.w.n3.example. 300 IN A 192.0.2.99"))
+	soa := example.sign(t, mustRR(t, "example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 604800 300"))
+
+	tests := []struct {
+		name   string
+		qname  string
+		rcode  int
+		answer [][]miekg_dns.RR
+		ns     [][]miekg_dns.RR
+		want   secStatus
+	}{
+		{
+			name:   "signed answer",
+			qname:  "a.example.",
+			answer: [][]miekg_dns.RR{example.sign(t, mustRR(t, "a.example. 300 IN A 192.0.2.1"))},
+			want:   statusSecure,
+		},
+		{
+			name:   "tampered answer",
+			qname:  "a.example.",
+			answer: [][]miekg_dns.RR{tampered},
+			want:   statusBogus,
+		},
+		{
+			name:   "missing signature",
+			qname:  "a.example.",
+			answer: [][]miekg_dns.RR{{mustRR(t, "a.example. 300 IN A 192.0.2.1")}},
+			want:   statusBogus,
+		},
+		{
+			name:   "signed by another key",
+			qname:  "a.example.",
+			answer: [][]miekg_dns.RR{n3.sign(t, mustRR(t, "a.example. 300 IN A 192.0.2.1"))},
+			want:   statusBogus,
+		},
+		{
+			name:   "DS does not match DNSKEY",
+			qname:  "a.bad.",
+			answer: [][]miekg_dns.RR{bad.sign(t, mustRR(t, "a.bad. 300 IN A 192.0.2.1"))},
+			want:   statusBogus,
+		},
+		{
+			name:   "unsigned zone",
+			qname:  "www.insecure.",
+			answer: [][]miekg_dns.RR{{mustRR(t, "www.insecure. 300 IN A 192.0.2.7")}},
+			want:   statusInsecure,
+		},
+		{
+			name:   "wildcard with NSEC proof",
+			qname:  "x.w.example.",
+			answer: [][]miekg_dns.RR{expand(wildcardA, "x.w.example.")},
+			ns:     [][]miekg_dns.RR{example.sign(t, mustRR(t, "host.w.example. 300 IN NSEC example. A RRSIG NSEC"))},
+			want:   statusSecure,
+		},
+		{
+			name:   "wildcard without proof",
+			qname:  "x.w.example.",
+			answer: [][]miekg_dns.RR{expand(wildcardA, "x.w.example.")},
+			want:   statusBogus,
+		},
+		{
+			name:   "wildcard replayed over existing name",
+			qname:  "host.w.example.",
+			answer: [][]miekg_dns.RR{expand(wildcardA, "host.w.example.")},
+			ns: [][]miekg_dns.RR{
+				example.sign(t, mustRR(t, "*.w.example. 300 IN NSEC host.w.example. A RRSIG NSEC")),
+				example.sign(t, mustRR(t, "host.w.example. 300 IN NSEC example. A RRSIG NSEC")),
+			},
+			want: statusBogus,
+		},
+		{
+			name:   "wildcard with NSEC3 proof",
+			qname:  "x.w.n3.example.",
+			answer: [][]miekg_dns.RR{expand(n3WildcardA, "x.w.n3.example.")},
+			ns:     [][]miekg_dns.RR{n3.sign(t, nsec3Covering(n3Chain, "x.w.n3.example."))},
+			want:   statusSecure,
+		},
+		{
+			name:   "wildcard replayed over existing name with NSEC3",
+			qname:  "host.w.n3.example.",
+			answer: [][]miekg_dns.RR{expand(n3WildcardA, "host.w.n3.example.")},
+			ns:     [][]miekg_dns.RR{n3.sign(t, nsec3Covering(n3Chain, "x.w.n3.example."))},
+			want:   statusBogus,
+		},
+		{
+			name:  "NXDOMAIN with NSEC proof",
+			qname: "b.example.",
+			rcode: miekg_dns.RcodeNameError,
+			ns: [][]miekg_dns.RR{
+				soa,
+				example.sign(t, mustRR(t, "a.example. 300 IN NSEC n3.example. A RRSIG NSEC")),
+				example.sign(t, mustRR(t, "example. 300 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY")),
+			},
+			want: statusSecure,
+		},
+		{
+			name:  "NXDOMAIN without wildcard denial",
+			qname: "b.example.",
+			rcode: miekg_dns.RcodeNameError,
+			ns: [][]miekg_dns.RR{
+				soa,
+				example.sign(t, mustRR(t, "a.example. 300 IN NSEC n3.example. A RRSIG NSEC")),
+			},
+			want: statusBogus,
+		},
+		{
+			name:  "NODATA with NSEC proof",
+			qname: "c.example.",
+			ns: [][]miekg_dns.RR{
+				soa,
+				example.sign(t, mustRR(t, "c.example. 300 IN NSEC n3.example. TXT RRSIG NSEC")),
+			},
+			want: statusSecure,
+		},
+		{
+			name:  "NODATA with NSEC listing the type",
+			qname: "c.example.",
+			ns: [][]miekg_dns.RR{
+				soa,
+				example.sign(t, mustRR(t, "c.example. 300 IN NSEC n3.example. A TXT RRSIG NSEC")),
+			},
+			want: statusBogus,
+		},
+		{
+			name:  "NODATA at empty non-terminal with NSEC proof",
+			qname: "ent.example.",
+			ns: [][]miekg_dns.RR{
+				soa,
+				example.sign(t, mustRR(t, "a.example. 300 IN NSEC host.ent.example. A RRSIG NSEC")),
+			},
+			want: statusSecure,
+		},
+		{
+			name:  "NODATA with NSEC covering a nonexistent name",
+			qname: "b.example.",
+			ns: [][]miekg_dns.RR{
+				soa,
+				example.sign(t, mustRR(t, "a.example. 300 IN NSEC host.ent.example. A RRSIG NSEC")),
+			},
+			want: statusBogus,
+		},
+		{
+			name:  "NODATA with NSEC3 proof",
+			qname: "w.n3.example.",
+			ns:    [][]miekg_dns.RR{n3.sign(t, nsec3Matching(n3Chain, "w.n3.example."))},
+			want:  statusSecure,
+		},
+		{
+			name:  "NODATA with NSEC3 listing the type",
+			qname: "host.w.n3.example.",
+			ns:    [][]miekg_dns.RR{n3.sign(t, nsec3Matching(n3Chain, "host.w.n3.example."))},
+			want:  statusBogus,
+		},
+		{
+			name:  "NXDOMAIN without denial",
+			qname: "b.example.",
+			rcode: miekg_dns.RcodeNameError,
+			ns:    [][]miekg_dns.RR{{soa[0]}},
+			want:  statusBogus,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newValidator([]string{root.ds().String()}, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := new(miekg_dns.Msg)
+			resp.Rcode = tt.rcode
+			for _, rrs := range tt.answer {
+				resp.Answer = append(resp.Answer, rrs...)
+			}
+			for _, rrs := range tt.ns {
+				resp.Ns = append(resp.Ns, rrs...)
+			}
+			q := miekg_dns.Question{Name: tt.qname, Qtype: miekg_dns.TypeA, Qclass: miekg_dns.ClassINET}
+			if got, why := v.validate(context.Background(), q, resp); got != tt.want {
+				t.Errorf("validate = %v (%s), want %v", got, why, tt.want)
+			}
+		})
+	}
+}
+
+// Запросы цепочки доверия укладываются в дедлайн ответа, а неудача из-за
+// дедлайна не кешируется
+func TestValidateDeadline(t *testing.T) {
+	root := newTestZone(t, ".")
+	queries := 0
+	query := func(ctx context.Context, name string, qtype uint16) (*miekg_dns.Msg, error) {
+		queries++
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	v, err := newValidator([]string{root.ds().String()}, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := miekg_dns.Question{Name: "a.example.", Qtype: miekg_dns.TypeA, Qclass: miekg_dns.ClassINET}
+	resp := new(miekg_dns.Msg)
+	resp.Answer = root.sign(t, mustRR(t, "a.example. 300 IN A 192.0.2.1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if got, _ := v.validate(ctx, q, resp); got != statusBogus {
+		t.Errorf("validate = %v, want bogus", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("validate took %v with a 100ms deadline", elapsed)
+	}
+	if len(v.links) != 0 {
+		t.Errorf("links cached after deadline: %v", v.links)
+	}
+	if queries == 0 {
+		t.Error("no chain queries")
+	}
+}
+
+// Имена внутри зон не попадают в кеш цепочек, а сам кеш ограничен
+func TestChainCacheBounded(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	upstream := map[rrsetKey][]miekg_dns.RR{
+		{".", miekg_dns.TypeDNSKEY}:        root.sign(t, root.key),
+		{"example.", miekg_dns.TypeDNSKEY}: example.sign(t, example.key),
+		{"example.", miekg_dns.TypeDS}:     root.sign(t, example.ds()),
+	}
+	query := func(_ context.Context, name string, qtype uint16) (*miekg_dns.Msg, error) {
+		m := new(miekg_dns.Msg)
+		name = miekg_dns.CanonicalName(name)
+		if rrs, ok := upstream[rrsetKey{name, qtype}]; ok {
+			m.Answer = rrs
+			return m, nil
+		}
+		// Под example. DS нет и имя не разрез зоны, остальные зоны неподписаны
+		m.Ns = example.sign(t, mustRR(t, "example. 300 IN NSEC example. NS SOA RRSIG NSEC DNSKEY"))
+		if !miekg_dns.IsSubDomain("example.", name) {
+			m.Ns = root.sign(t, mustRR(t, name+" 300 IN NSEC . NS RRSIG NSEC"))
+		}
+		return m, nil
+	}
+	v, err := newValidator([]string{root.ds().String()}, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 100 {
+		for _, zone := range []string{"example.", "insecure."} {
+			name := "r" + strconv.Itoa(i) + "." + zone
+			if l := v.chain(context.Background(), name); l.zone != zone {
+				t.Fatalf("chain(%s) = %s %v, want zone %s", name, l.zone, l.status, zone)
+			}
+		}
+	}
+	if len(v.links) != 3 {
+		t.Errorf("%d links cached, want ., example. and insecure.", len(v.links))
+	}
+
+	expired := chainLink{status: statusInsecure, expiry: time.Now().Add(-time.Second)}
+	for i := range maxLinks {
+		v.links["old"+strconv.Itoa(i)+"."] = expired
+	}
+	v.chain(context.Background(), "new.")
+	if len(v.links) > maxLinks {
+		t.Errorf("%d links cached, limit %d", len(v.links), maxLinks)
+	}
+	if _, ok := v.links["old0."]; ok {
+		t.Error("expired link survived eviction")
+	}
+}
@@ -0,0 +1,314 @@
+package dns
+
+import (
+	"bufio"
+	"dns-server/internal/config"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	miekg_dns "github.com/miekg/dns"
+)
+
+// Zone - локальная зона в памяти: owner -> type -> RRset
+type Zone struct {
+	name        string
+	file        string
+	allowUpdate map[string]bool
+
+	allowTransfer map[string]bool
+	transferFrom  []*net.IPNet
+	notify        []string
+	notifyKey     string
+
+	signer  *signer
+	flatten bool
+
+	// Для вторичных зон
+	primaries   []string
+	primaryIPs  []net.IP // адреса primaries для проверки NOTIFY
+	xfrKey      string
+	refreshCh   chan struct{}
+	lastRefresh time.Time
+
+	mu      sync.RWMutex
+	soa     *miekg_dns.SOA
+	rrs     map[string]map[uint16][]miekg_dns.RR
+	journal []zoneDiff
+}
+
+func newZone(zc config.ZoneConfig, ttl uint32) (*Zone, error) {
+	z := &Zone{
+		name:        zc.Name,
+		file:        zc.File,
+		allowUpdate: make(map[string]bool),
+		rrs:         make(map[string]map[uint16][]miekg_dns.RR),
+
+		allowTransfer: make(map[string]bool),
+		notify:        zc.Notify,
+		flatten:       zc.FlattenCNAME,
+	}
+	for _, k := range zc.AllowUpdate {
+		z.allowUpdate[k] = true
+	}
+	for _, k := range zc.AllowTransfer {
+		z.allowTransfer[k] = true
+	}
+	// NOTIFY подписываем первым ключом трансфера
+	if len(zc.AllowTransfer) > 0 {
+		z.notifyKey = zc.AllowTransfer[0]
+	}
+	for _, cidr := range zc.TransferFrom {
+		_, n, _ := net.ParseCIDR(cidr)
+		z.transferFrom = append(z.transferFrom, n)
+	}
+	if zc.DNSSEC != nil {
+		sg, err := newSigner(z.name, zc.DNSSEC)
+		if err != nil {
+			return nil, err
+		}
+		z.signer = sg
+	}
+
+	// Сохранённая копия важнее начальных записей из конфига
+	if z.file != "" {
+		if _, err := os.Stat(z.file); err == nil {
+			if err := z.load(); err != nil {
+				return nil, err
+			}
+			return z, nil
+		}
+	}
+
+	ns := zc.NS
+	if len(ns) == 0 {
+		ns = []string{"ns1." + z.name}
+	}
+	// Серийный номер от времени: после перезапуска или правки конфига он
+	// больше прежнего, и вторичные серверы забирают новую версию
+	z.soa = &miekg_dns.SOA{
+		Hdr:     miekg_dns.RR_Header{Name: z.name, Rrtype: miekg_dns.TypeSOA, Class: miekg_dns.ClassINET, Ttl: ttl},
+		Ns:      miekg_dns.Fqdn(ns[0]),
+		Mbox:    "hostmaster." + z.name,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  ttl,
+	}
+	z.put(z.soa)
+	for _, n := range ns {
+		z.put(&miekg_dns.NS{
+			Hdr: miekg_dns.RR_Header{Name: z.name, Rrtype: miekg_dns.TypeNS, Class: miekg_dns.ClassINET, Ttl: ttl},
+			Ns:  miekg_dns.Fqdn(n),
+		})
+	}
+	for _, s := range zc.Records {
+		rr, err := miekg_dns.NewRR("$ORIGIN " + z.name + "\n$TTL " + fmt.Sprint(ttl) + "\n" + s)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: %w", z.name, err)
+		}
+		if rr == nil || !z.contains(rr.Header().Name) {
+			return nil, errors.New("zone " + z.name + ": record out of zone: " + s)
+		}
+		z.put(rr)
+	}
+	return z, nil
+}
+
+func (z *Zone) contains(name string) bool {
+	return miekg_dns.IsSubDomain(z.name, name)
+}
+
+// put добавляет запись без проверок, вызывать под локом (или до публикации зоны)
+func (z *Zone) put(rr miekg_dns.RR) {
+	rr = miekg_dns.Copy(rr)
+	h := rr.Header()
+	h.Name = miekg_dns.CanonicalName(h.Name)
+	h.Class = miekg_dns.ClassINET
+	h.Rdlength = 0
+
+	if soa, ok := rr.(*miekg_dns.SOA); ok {
+		z.soa = soa
+		z.set(h.Name, miekg_dns.TypeSOA, []miekg_dns.RR{soa})
+		return
+	}
+	for _, old := range z.rrs[h.Name][h.Rrtype] {
+		if miekg_dns.IsDuplicate(old, rr) {
+			return
+		}
+	}
+	z.set(h.Name, h.Rrtype, append(z.rrs[h.Name][h.Rrtype], rr))
+}
+
+func (z *Zone) set(name string, t uint16, rrset []miekg_dns.RR) {
+	if len(rrset) == 0 {
+		delete(z.rrs[name], t)
+		if len(z.rrs[name]) == 0 {
+			delete(z.rrs, name)
+		}
+		return
+	}
+	if z.rrs[name] == nil {
+		z.rrs[name] = make(map[uint16][]miekg_dns.RR)
+	}
+	z.rrs[name][t] = rrset
+}
+
+func (z *Zone) negativeSOA() miekg_dns.RR {
+	soa := miekg_dns.Copy(z.soa).(*miekg_dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// lookup отвечает на вопрос из данных зоны (с раскруткой CNAME внутри зоны)
+func (z *Zone) lookup(name string, qtype uint16) ([]miekg_dns.RR, []miekg_dns.RR, int) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var answer []miekg_dns.RR
+	for i := 0; i < 8; i++ {
+		types, ok := z.rrs[name]
+		if !ok {
+			if len(answer) > 0 || z.hasChildren(name) {
+				return answer, []miekg_dns.RR{z.negativeSOA()}, miekg_dns.RcodeSuccess
+			}
+			return answer, []miekg_dns.RR{z.negativeSOA()}, miekg_dns.RcodeNameError
+		}
+
+		if qtype == miekg_dns.TypeANY {
+			for _, rrset := range types {
+				answer = append(answer, copyRRs(rrset)...)
+			}
+			return answer, nil, miekg_dns.RcodeSuccess
+		}
+		if rrset, ok := types[qtype]; ok {
+			return append(answer, copyRRs(rrset)...), nil, miekg_dns.RcodeSuccess
+		}
+		cname, ok := types[miekg_dns.TypeCNAME]
+		if !ok {
+			return answer, []miekg_dns.RR{z.negativeSOA()}, miekg_dns.RcodeSuccess
+		}
+		answer = append(answer, copyRRs(cname)...)
+		name = miekg_dns.CanonicalName(cname[0].(*miekg_dns.CNAME).Target)
+		if !z.contains(name) {
+			break
+		}
+	}
+	return answer, nil, miekg_dns.RcodeSuccess
+}
+
+// hasChildren - есть ли имена ниже name (empty non-terminal)
+func (z *Zone) hasChildren(name string) bool {
+	for owner := range z.rrs {
+		if owner != name && miekg_dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyRRs(rrs []miekg_dns.RR) []miekg_dns.RR {
+	out := make([]miekg_dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		out = append(out, miekg_dns.Copy(rr))
+	}
+	return out
+}
+
+// records возвращает все записи зоны, SOA первой, остальные в стабильном порядке
+func (z *Zone) records() []miekg_dns.RR {
+	names := make([]string, 0, len(z.rrs))
+	for n := range z.rrs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	out := []miekg_dns.RR{miekg_dns.Copy(z.soa)}
+	for _, n := range names {
+		types := make([]int, 0, len(z.rrs[n]))
+		for t := range z.rrs[n] {
+			if t != miekg_dns.TypeSOA {
+				types = append(types, int(t))
+			}
+		}
+		sort.Ints(types)
+		for _, t := range types {
+			out = append(out, copyRRs(z.rrs[n][uint16(t)])...)
+		}
+	}
+	return out
+}
+
+func (z *Zone) load() error {
+	f, err := os.Open(z.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zp := miekg_dns.NewZoneParser(f, z.name, z.file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if !z.contains(rr.Header().Name) {
+			return errors.New("zone " + z.name + ": record out of zone in " + z.file)
+		}
+		z.put(rr)
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	if z.soa == nil {
+		return errors.New("zone " + z.name + ": no SOA in " + z.file)
+	}
+	return nil
+}
+
+// save пишет зону в файл атомарно (через временный файл). Вызывать под локом.
+func (z *Zone) save() error {
+	if z.file == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(z.file), 0o755); err != nil {
+		return err
+	}
+
+	tmp := z.file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for _, rr := range z.records() {
+		fmt.Fprintln(bw, rr.String())
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, z.file)
+}
+
+// findZone ищет ближайшую объемлющую локальную зону
+func (s *Server) findZone(name string) *Zone {
+	name = strings.ToLower(miekg_dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = miekg_dns.NextLabel(name, off) {
+		if z, ok := s.zones[name[off:]]; ok {
+			return z
+		}
+	}
+	if z, ok := s.zones["."]; ok {
+		return z
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Уровни логирования поверх стандартного log
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// level читается при каждой записи из любых горутин, а меняется при перезагрузке конфига
+var level atomic.Int32
+
+func init() {
+	level.Store(int32(LevelInfo))
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, errors.New("unknown log level: " + s)
+}
+
+// SetLevel можно вызывать в любой момент, в том числе при перезагрузке конфига
+func SetLevel(l Level) {
+	level.Store(int32(l))
+}
+
+func Debugf(format string, args ...any) {
+	logf(LevelDebug, format, args...)
+}
+
+func Infof(format string, args ...any) {
+	logf(LevelInfo, format, args...)
+}
+
+func Warnf(format string, args ...any) {
+	logf(LevelWarn, format, args...)
+}
+
+func Errorf(format string, args ...any) {
+	logf(LevelError, format, args...)
+}
+
+func logf(l Level, format string, args ...any) {
+	if int32(l) >= level.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// Логи одного запроса помечаются его ID, который передаётся в контексте
+
+type idKey struct{}
+
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+func ID(ctx context.Context) string {
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
+
+// Logger добавляет к сообщениям префикс "[id] "
+type Logger struct {
+	prefix string
+}
+
+func Ctx(ctx context.Context) Logger {
+	if id := ID(ctx); id != "" {
+		return Logger{prefix: "[" + id + "] "}
+	}
+	return Logger{}
+}
+
+func (l Logger) Debugf(format string, args ...any) {
+	logf(LevelDebug, l.prefix+format, args...)
+}
+
+func (l Logger) Infof(format string, args ...any) {
+	logf(LevelInfo, l.prefix+format, args...)
+}
+
+func (l Logger) Warnf(format string, args ...any) {
+	logf(LevelWarn, l.prefix+format, args...)
+}
+
+func (l Logger) Errorf(format string, args ...any) {
+	logf(LevelError, l.prefix+format, args...)
+}